@@ -9,8 +9,13 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jcmturner/authenvoy/jwt"
 	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
 )
 
 const (
@@ -29,6 +34,85 @@ type Config struct {
 	LogPath  string
 	Loggers  Loggers
 	KRB5Conf *config.Config
+	// KRB5ConfPath is the path the krb5.conf was loaded from.
+	KRB5ConfPath      string
+	HideFailureReason bool
+	// KDCFailureThreshold is the number of consecutive failures to contact a realm's KDC after which requests for
+	// the realm fail fast for the KDCCoolDown period. Zero disables the circuit breaker.
+	KDCFailureThreshold int
+	KDCCoolDown         time.Duration
+	// Keytab holds the keys of the service principal used to validate service tickets.
+	Keytab           *keytab.Keytab
+	ServicePrincipal string
+	// VerifyKDC requires that a service ticket for the service principal, decrypted with the keytab, is obtained before
+	// credentials are considered valid.
+	VerifyKDC bool
+	// GroupMap translates group SIDs to names and application roles.
+	GroupMap *GroupMap
+	// Policies are the authorization policies evaluated for valid identities. Nil if not configured.
+	Policies *Policies
+	// JWTSigner signs the tokens issued to valid and authorized identities. Nil if token issuance is not enabled.
+	JWTSigner *jwt.Signer
+	// SessionIdleTimeout is the period after which a session that has not been looked up expires. Zero disables.
+	SessionIdleTimeout time.Duration
+	// SessionFile is the path sessions are persisted to so they survive restarts. Sessions are only held in memory if
+	// empty.
+	SessionFile string
+	// RenewLifetime is the period for which renewable TGTs are requested so sessions can be renewed. If zero the
+	// renew_lifetime of the krb5.conf applies.
+	RenewLifetime time.Duration
+	// RateLimitUser, RateLimitSource and RateLimitClientIP are the authentication attempts per minute allowed for each
+	// login name, for each calling address and for each end user IP address provided by the caller. Zero disables.
+	RateLimitUser     int
+	RateLimitSource   int
+	RateLimitClientIP int
+	// LockoutThreshold is the number of consecutive invalid credential failures for a login name after which attempts
+	// are no longer passed to the KDC for the LockoutDuration. It should be below the domain's lockout threshold so
+	// that the account is not locked in the directory. Zero disables.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// NegativeCacheTTL is the period for which a password rejected by the KDC is answered from the negative cache
+	// rather than sent to the KDC again. Zero disables. NegativeCacheSize is the maximum number of entries held.
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int
+	// AuthTimeout is the overall deadline for the KDC exchanges of a request. Zero disables.
+	AuthTimeout time.Duration
+	// MaxKDCExchanges is the maximum number of requests exchanging with KDCs at once. Further requests wait up to the
+	// KDCQueueTimeout for one to finish before being refused. Zero disables.
+	MaxKDCExchanges int
+	KDCQueueTimeout time.Duration
+	// ReadinessCacheTTL is the period the results of probing the KDCs for readiness are reused for. Zero probes on
+	// every readiness check. KDCProbeTimeout is the period to wait for each KDC to answer a probe, and if zero
+	// defaults to 2 seconds.
+	ReadinessCacheTTL time.Duration
+	KDCProbeTimeout   time.Duration
+	// Timeouts of the HTTP server. Zero disables each timeout. WriteTimeout must not be shorter than AuthTimeout and
+	// should leave headroom for a password change, which is waited for past AuthTimeout once sent.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownGracePeriod is the period to wait, when stopping, for requests in progress to finish.
+	ShutdownGracePeriod time.Duration
+	// Metrics records the metrics served to Prometheus. Nil if metrics are not enabled.
+	Metrics *Metrics
+	// MetricsPort is the loopback port metrics are served on. If zero they are served with the API.
+	MetricsPort int
+	// AdminPort is the loopback port the administration endpoints are served on. If zero they are not served.
+	AdminPort int
+	// Socket is the path of a Unix domain socket the API is served on instead of the loopback port. It is created
+	// with the SocketMode and, unless -1, owned by SocketUID and SocketGID.
+	Socket     string
+	SocketUID  int
+	SocketGID  int
+	SocketMode os.FileMode
+	// AllowUIDs and AllowGIDs are the users and primary groups of the processes allowed to call over the socket. A
+	// caller is allowed if either matches. If both are empty any process able to connect is allowed.
+	AllowUIDs []uint32
+	AllowGIDs []uint32
+	// current holds the configuration in use, which is replaced when the configuration is reloaded. It is shared by
+	// the copies of the configuration.
+	current *atomic.Value
 }
 
 // Loggers holds the logging configuration for the application.
@@ -39,10 +123,25 @@ type Loggers struct {
 	ApplicationWriter *log.Logger   `json:"-"`
 	Access            string        `json:"Access"`
 	AccessWriter      *json.Encoder `json:"-"`
+	// ApplicationSink, AccessSink and EventSink write the log lines asynchronously. They are nil unless a log buffer
+	// has been set.
+	ApplicationSink *LogSink `json:"-"`
+	AccessSink      *LogSink `json:"-"`
+	EventSink       *LogSink `json:"-"`
+	// The outputs the logs were opened on.
+	applicationOut io.Writer
+	accessOut      io.Writer
+	eventOut       io.Writer
+	// writeErrors counts the lines of each log that could not be written synchronously, keyed by log name.
+	writeErrors map[string]*uint64
 }
 
+// encoderMux serialises writes to log encoders that are not behind a log sink.
+var encoderMux sync.Mutex
+
 // New returns a new Config instance.
-func New(port int, krbconf, lp string) (*Config, error) {
+// If the path to a group mapping file is empty only well-known group SIDs are mapped to names.
+func New(port int, krbconf, lp, gm string) (*Config, error) {
 	if port > 65535 || port < 1 {
 		return &Config{}, errors.New("port number invalid")
 	}
@@ -51,9 +150,16 @@ func New(port int, krbconf, lp string) (*Config, error) {
 		return &Config{}, fmt.Errorf("could not load krb5.conf: %v", err)
 	}
 	c := &Config{
-		Port:     port,
-		LogPath:  lp,
-		KRB5Conf: k,
+		Port:         port,
+		LogPath:      lp,
+		KRB5Conf:     k,
+		KRB5ConfPath: krbconf,
+		current:      new(atomic.Value),
+	}
+	c.current.Store(c)
+	c.Loggers.writeErrors = make(map[string]*uint64)
+	for _, n := range logNames {
+		c.Loggers.writeErrors[n] = new(uint64)
 	}
 	//Default logging to stdout
 	err = c.SetApplicationLog(lp)
@@ -68,11 +174,109 @@ func New(port int, krbconf, lp string) (*Config, error) {
 	if err != nil {
 		return &Config{}, err
 	}
+	if gm != "" {
+		c.GroupMap, err = LoadGroupMap(gm)
+		if err != nil {
+			return &Config{}, err
+		}
+	}
 	return c, nil
 }
 
+// SetServiceKeytab loads the keytab at the file path specified for validating service tickets issued to the service
+// principal. If the service principal is empty the principal named in each service ticket is used to find the key.
+func (c *Config) SetServiceKeytab(p, spn string) error {
+	kt, err := keytab.Load(p)
+	if err != nil {
+		return fmt.Errorf("could not load keytab: %v", err)
+	}
+	c.Keytab = kt
+	c.ServicePrincipal = spn
+	return nil
+}
+
+// SetJWTSigner enables issuance of JWTs signed using the algorithm specified. If the key file path is empty a key is
+// generated, otherwise the key is loaded from the PEM file. The algorithm can be empty if a key file is provided.
+func (c *Config) SetJWTSigner(alg, keyFile, issuer string) error {
+	s, err := jwt.NewSigner(alg, keyFile, issuer)
+	if err != nil {
+		return fmt.Errorf("could not create JWT signer: %v", err)
+	}
+	c.JWTSigner = s
+	return nil
+}
+
+// SetVerifyKDC enables or disables verification of the KDC using the service keytab.
+// A keytab and service principal must be configured before verification can be enabled.
+func (c *Config) SetVerifyKDC(b bool) error {
+	if b && (c.Keytab == nil || c.ServicePrincipal == "") {
+		return errors.New("KDC verification requires a keytab and service principal")
+	}
+	c.VerifyKDC = b
+	return nil
+}
+
+// Validate checks that the limits and timeouts of the configuration are usable. Errors name the offending option.
+func (c *Config) Validate() error {
+	ints := []struct {
+		option string
+		v      int
+	}{
+		{"kdc-failure-threshold", c.KDCFailureThreshold},
+		{"rate-limit-user", c.RateLimitUser},
+		{"rate-limit-source", c.RateLimitSource},
+		{"rate-limit-client-ip", c.RateLimitClientIP},
+		{"lockout-threshold", c.LockoutThreshold},
+		{"negative-cache-size", c.NegativeCacheSize},
+		{"max-kdc-exchanges", c.MaxKDCExchanges},
+	}
+	for _, i := range ints {
+		if i.v < 0 {
+			return fmt.Errorf("%s: must not be negative", i.option)
+		}
+	}
+	durations := []struct {
+		option string
+		v      time.Duration
+	}{
+		{"kdc-cooldown", c.KDCCoolDown},
+		{"session-idle-timeout", c.SessionIdleTimeout},
+		{"renew-lifetime", c.RenewLifetime},
+		{"lockout-duration", c.LockoutDuration},
+		{"negative-cache-ttl", c.NegativeCacheTTL},
+		{"auth-timeout", c.AuthTimeout},
+		{"kdc-queue-timeout", c.KDCQueueTimeout},
+		{"readiness-cache-ttl", c.ReadinessCacheTTL},
+		{"kdc-probe-timeout", c.KDCProbeTimeout},
+		{"read-header-timeout", c.ReadHeaderTimeout},
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-grace-period", c.ShutdownGracePeriod},
+	}
+	for _, d := range durations {
+		if d.v < 0 {
+			return fmt.Errorf("%s: must not be negative", d.option)
+		}
+	}
+	if c.LockoutThreshold > 0 && c.LockoutDuration == 0 {
+		return errors.New("lockout-duration: must be set when lockout-threshold is enabled")
+	}
+	if c.KDCFailureThreshold > 0 && c.KDCCoolDown == 0 {
+		return errors.New("kdc-cooldown: must be set when kdc-failure-threshold is enabled")
+	}
+	if c.WriteTimeout > 0 && c.AuthTimeout > c.WriteTimeout {
+		return errors.New("auth-timeout: must not be longer than write-timeout")
+	}
+	return nil
+}
+
 func (c *Config) logWriter(p string, f string) (w io.Writer, wp string, err error) {
 	wp = strings.TrimSuffix(p, "/")
+	if isSyslog(wp) {
+		w, err = openSyslog(wp, logNames[f])
+		return
+	}
 	switch strings.ToLower(wp) {
 	case "":
 		wp = "stdout"
@@ -88,7 +292,11 @@ func (c *Config) logWriter(p string, f string) (w io.Writer, wp string, err erro
 		w = ioutil.Discard
 	default:
 		wp = p + "/" + f
-		w, err = os.OpenFile(wp, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		var lf *LogFile
+		lf, err = OpenLogFile(wp)
+		if err == nil {
+			w = lf
+		}
 	}
 	return
 }
@@ -107,6 +315,9 @@ func (c *Config) SetApplicationLogWriter(l *log.Logger) *Config {
 // stderr
 //
 // null - discard log lines
+//
+// syslog://unix/dev/log, syslog+udp://host:port, syslog+tcp://host:port or journald - send log lines to syslog or the
+// systemd journal
 func (c *Config) SetApplicationLog(p string) error {
 	w, wp, err := c.logWriter(p, AppLog)
 	if err != nil {
@@ -114,6 +325,7 @@ func (c *Config) SetApplicationLog(p string) error {
 		return err
 	}
 	c.Loggers.Application = wp
+	c.Loggers.applicationOut = w
 	l := log.New(w, logPrefix, log.Ldate|log.Ltime)
 	c.SetApplicationLogWriter(l)
 	return nil
@@ -125,16 +337,22 @@ func (c Config) ApplicationLogf(format string, v ...interface{}) {
 		l := log.New(os.Stdout, logPrefix, log.Ldate|log.Ltime)
 		c.Loggers.ApplicationWriter = l
 	}
+	var err error
 	if len(v) > 0 {
-		c.Loggers.ApplicationWriter.Printf(format, v...)
+		err = c.Loggers.ApplicationWriter.Output(2, fmt.Sprintf(format, v...))
 	} else {
-		c.Loggers.ApplicationWriter.Print(format)
+		err = c.Loggers.ApplicationWriter.Output(2, fmt.Sprint(format))
+	}
+	if err != nil {
+		c.Loggers.writeError(logNames[AppLog], err)
 	}
 }
 
 // SetAccessLogWriter sets the access log lines to be written to the JSON encoder provided.
 func (c *Config) SetAccessLogWriter(e *json.Encoder) *Config {
 	c.Loggers.AccessWriter = e
+	c.Loggers.AccessSink = nil
+	c.Loggers.accessOut = nil
 	return c
 }
 
@@ -146,6 +364,9 @@ func (c *Config) SetAccessLogWriter(e *json.Encoder) *Config {
 // stderr
 //
 // null - discard log lines
+//
+// syslog://unix/dev/log, syslog+udp://host:port, syslog+tcp://host:port or journald - send log lines to syslog or the
+// systemd journal
 func (c *Config) SetAccessLog(p string) error {
 	w, wp, err := c.logWriter(p, AccessLog)
 	if err != nil {
@@ -155,16 +376,16 @@ func (c *Config) SetAccessLog(p string) error {
 	c.Loggers.Access = wp
 	enc := json.NewEncoder(w)
 	c.SetAccessLogWriter(enc)
+	c.Loggers.accessOut = w
 	return nil
 }
 
 // AccessLog write the value provided to the access log.
 func (c Config) AccessLog(v interface{}) {
-	if c.Loggers.AccessWriter != nil {
-		err := c.Loggers.AccessWriter.Encode(v)
-		if err != nil {
-			c.ApplicationLogf("could not log access event: %v\n", err)
-		}
+	err := writeJSONLine(c.Loggers.AccessSink, c.Loggers.AccessWriter, v)
+	if err != nil {
+		c.Loggers.writeError(logNames[AccessLog], err)
+		c.ApplicationLogf("could not log access event: %v\n", err)
 	}
 }
 
@@ -176,6 +397,9 @@ func (c Config) AccessLog(v interface{}) {
 // stderr
 //
 // null - discard log lines
+//
+// syslog://unix/dev/log, syslog+udp://host:port, syslog+tcp://host:port or journald - send log lines to syslog or the
+// systemd journal
 func (c *Config) SetEventLog(p string) error {
 	w, wp, err := c.logWriter(p, EventLog)
 	if err != nil {
@@ -185,21 +409,224 @@ func (c *Config) SetEventLog(p string) error {
 	c.Loggers.Event = wp
 	enc := json.NewEncoder(w)
 	c.SetEventLogWriter(enc)
+	c.Loggers.eventOut = w
 	return nil
 }
 
 // SetEventLogWriter sets the event log lines to be written to the JSON encoder provided.
 func (c *Config) SetEventLogWriter(e *json.Encoder) *Config {
 	c.Loggers.EventWriter = e
+	c.Loggers.EventSink = nil
+	c.Loggers.eventOut = nil
 	return c
 }
 
 // EventLog write the value provided to the access log.
 func (c *Config) EventLog(v interface{}) {
-	if c.Loggers.EventWriter != nil {
-		err := c.Loggers.EventWriter.Encode(v)
+	err := writeJSONLine(c.Loggers.EventSink, c.Loggers.EventWriter, v)
+	if err != nil {
+		c.Loggers.writeError(logNames[EventLog], err)
+		c.ApplicationLogf("could not log event: %v\n", err)
+	}
+}
+
+// writeJSONLine writes the value as a line of JSON to the log sink or, if there is no sink, with the encoder.
+func writeJSONLine(s *LogSink, e *json.Encoder, v interface{}) error {
+	if s != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = s.Write(append(b, '\n'))
+		return err
+	}
+	if e != nil {
+		encoderMux.Lock()
+		defer encoderMux.Unlock()
+		return e.Encode(v)
+	}
+	return nil
+}
+
+// SetLogBuffer makes the application, access and event logs write asynchronously, each through a LogSink with a
+// buffer of the size given and the overflow policy. Counts of dropped lines are reported in the application log.
+func (c *Config) SetLogBuffer(size int, overflow string) error {
+	var sinks []*LogSink
+	for _, l := range []struct {
+		name string
+		out  io.Writer
+		sink **LogSink
+	}{
+		{"application", c.Loggers.applicationOut, &c.Loggers.ApplicationSink},
+		{"access", c.Loggers.accessOut, &c.Loggers.AccessSink},
+		{"event", c.Loggers.eventOut, &c.Loggers.EventSink},
+	} {
+		if l.out == nil {
+			continue
+		}
+		s, err := NewLogSink(l.name, l.out, size, overflow)
 		if err != nil {
-			c.ApplicationLogf("could not log event: %v\n", err)
+			return err
+		}
+		*l.sink = s
+		sinks = append(sinks, s)
+	}
+	if c.Loggers.ApplicationSink != nil {
+		c.SetApplicationLogWriter(log.New(c.Loggers.ApplicationSink, logPrefix, log.Ldate|log.Ltime))
+	}
+	go func() {
+		for range time.Tick(logDropReportInterval) {
+			c.reportDroppedLines(sinks)
+		}
+	}()
+	return nil
+}
+
+// reportDroppedLines reports in the application log the lines each sink has dropped since the last report.
+func (c *Config) reportDroppedLines(sinks []*LogSink) {
+	for _, s := range sinks {
+		if d := s.unreported(); d > 0 {
+			c.ApplicationLogf("%s log dropped %d lines as its buffer was full (%d in total)", s.Name(), d, s.Dropped())
+		}
+	}
+}
+
+// CloseLogs writes any buffered log lines and closes the log files. It should be called when the application stops.
+func (c *Config) CloseLogs() {
+	var sinks []*LogSink
+	for _, s := range []*LogSink{c.Loggers.AccessSink, c.Loggers.EventSink, c.Loggers.ApplicationSink} {
+		if s != nil {
+			sinks = append(sinks, s)
+		}
+	}
+	c.reportDroppedLines(sinks)
+	// The application log is closed last so errors closing the others can be logged
+	for _, l := range []struct {
+		sink *LogSink
+		out  io.Writer
+	}{
+		{c.Loggers.AccessSink, c.Loggers.accessOut},
+		{c.Loggers.EventSink, c.Loggers.eventOut},
+		{c.Loggers.ApplicationSink, c.Loggers.applicationOut},
+	} {
+		var err error
+		if l.sink != nil {
+			err = l.sink.Close()
+		} else if cl, ok := l.out.(io.Closer); ok && !isStdStream(l.out) {
+			err = cl.Close()
+		}
+		if err != nil && l.sink != c.Loggers.ApplicationSink {
+			c.ApplicationLogf("could not close log: %v", err)
+		}
+	}
+}
+
+// writeError counts a line of the named log that could not be written. Lines written after the log sink was closed
+// are counted as dropped by the sink instead.
+func (l *Loggers) writeError(name string, err error) {
+	if err == errSinkClosed {
+		return
+	}
+	if n, ok := l.writeErrors[name]; ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+// sinks returns the log sinks keyed by log name.
+func (l *Loggers) sinks() map[string]*LogSink {
+	m := make(map[string]*LogSink)
+	for n, s := range map[string]*LogSink{
+		logNames[AppLog]:    l.ApplicationSink,
+		logNames[AccessLog]: l.AccessSink,
+		logNames[EventLog]:  l.EventSink,
+	} {
+		if s != nil {
+			m[n] = s
 		}
 	}
+	return m
+}
+
+// LogWriteErrors returns the number of lines that could not be written to each log, keyed by log name.
+func (c *Config) LogWriteErrors() map[string]uint64 {
+	m := make(map[string]uint64)
+	for n, e := range c.Loggers.writeErrors {
+		m[n] = atomic.LoadUint64(e)
+	}
+	for n, s := range c.Loggers.sinks() {
+		m[n] += s.WriteErrors()
+	}
+	return m
+}
+
+// LogDropped returns the number of lines dropped from each log written through a log sink, keyed by log name.
+func (c *Config) LogDropped() map[string]uint64 {
+	m := make(map[string]uint64)
+	for n, s := range c.Loggers.sinks() {
+		m[n] = s.Dropped()
+	}
+	return m
+}
+
+// logChecker is a log output that can check that lines can be written to it.
+type logChecker interface {
+	check() error
+}
+
+// CheckLogs checks that lines can be written to the application, access and event logs and returns the error of each
+// that cannot, keyed by log name. Logs that are discarded, written to the standard output or error, or written with
+// an encoder set directly are not checked.
+func (c *Config) CheckLogs() map[string]error {
+	m := make(map[string]error)
+	for _, l := range []struct {
+		name string
+		sink *LogSink
+		out  io.Writer
+	}{
+		{logNames[AppLog], c.Loggers.ApplicationSink, c.Loggers.applicationOut},
+		{logNames[AccessLog], c.Loggers.AccessSink, c.Loggers.accessOut},
+		{logNames[EventLog], c.Loggers.EventSink, c.Loggers.eventOut},
+	} {
+		w := l.out
+		if l.sink != nil {
+			w = l.sink
+		}
+		if lc, ok := w.(logChecker); ok {
+			if err := lc.check(); err != nil {
+				m[l.name] = err
+			}
+		}
+	}
+	return m
+}
+
+// isStdStream indicates if the writer is the standard output or error, which must not be closed.
+func isStdStream(w io.Writer) bool {
+	return w == os.Stdout || w == os.Stderr
+}
+
+// Realm returns the realm of the krb5.conf matching the domain given, ignoring case. The bool returned is false if the
+// domain is not a configured realm, in which case the domain is returned unchanged.
+func (c *Config) Realm(domain string) (string, bool) {
+	if c.KRB5Conf != nil {
+		for _, r := range c.KRB5Conf.Realms {
+			if strings.EqualFold(r.Realm, domain) {
+				return r.Realm, true
+			}
+		}
+	}
+	return domain, false
+}
+
+// KnownRealm indicates if the domain is a realm whose KDCs can be found: either a realm of the krb5.conf or, if
+// dns_lookup_kdc is enabled, a realm with KDCs in DNS.
+func (c *Config) KnownRealm(domain string) bool {
+	if _, ok := c.Realm(domain); ok {
+		return true
+	}
+	if c.KRB5Conf == nil || !c.KRB5Conf.LibDefaults.DNSLookupKDC || domain == "" {
+		return false
+	}
+	n, _, err := c.KRB5Conf.GetKDCs(domain, true)
+	return err == nil && n > 0
 }
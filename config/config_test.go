@@ -1,10 +1,13 @@
 package config
 
 import (
+	"encoding/hex"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -58,7 +61,7 @@ func TestConfig_New(t *testing.T) {
 	defer os.Remove(cf.Name())
 	cf.WriteString(krb5Conf)
 
-	c, err := New(8020, cf.Name(), os.TempDir())
+	c, err := New(8020, cf.Name(), os.TempDir(), "")
 	if err != nil {
 		t.Fatalf("could not create new config: %v", err)
 	}
@@ -71,19 +74,19 @@ func TestConfig_New(t *testing.T) {
 	assert.NotNil(t, c.Loggers.ApplicationWriter)
 	assert.NotNil(t, c.Loggers.EventWriter)
 	assert.NotNil(t, c.Loggers.AccessWriter)
-	_, err = New(802000, cf.Name(), os.TempDir())
+	_, err = New(802000, cf.Name(), os.TempDir(), "")
 	if err == nil {
 		t.Fatal("should have errored for port number that's too large")
 	}
-	_, err = New(-123, cf.Name(), os.TempDir())
+	_, err = New(-123, cf.Name(), os.TempDir(), "")
 	if err == nil {
 		t.Fatal("should have errored for port number that's too small")
 	}
-	_, err = New(8088, "/does/not/exist", os.TempDir())
+	_, err = New(8088, "/does/not/exist", os.TempDir(), "")
 	if err == nil {
 		t.Fatal("should have errored for krb5.conf file that does not exist")
 	}
-	_, err = New(8088, cf.Name(), "/does/not/exist")
+	_, err = New(8088, cf.Name(), "/does/not/exist", "")
 	if err == nil {
 		t.Fatal("should have errored for a log path that does not exist")
 	}
@@ -94,7 +97,7 @@ func TestConfig_New(t *testing.T) {
 		"null",
 	}
 	for _, lp := range lps {
-		c, err := New(8020, cf.Name(), lp)
+		c, err := New(8020, cf.Name(), lp, "")
 		if err != nil {
 			t.Fatalf("could not create new config with log path %s: %v", lp, err)
 		}
@@ -109,3 +112,98 @@ func TestConfig_New(t *testing.T) {
 	}
 
 }
+
+func TestConfig_SetVerifyKDC(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	b, _ := hex.DecodeString(testdata.HTTP_KEYTAB)
+	kf, _ := ioutil.TempFile(os.TempDir(), "TEST-http.keytab")
+	defer os.Remove(kf.Name())
+	kf.Write(b)
+
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	err = c.SetVerifyKDC(true)
+	if err == nil {
+		t.Fatal("should have errored enabling KDC verification without a keytab")
+	}
+	err = c.SetServiceKeytab("/does/not/exist", "HTTP/host.test.gokrb5")
+	if err == nil {
+		t.Fatal("should have errored for a keytab that does not exist")
+	}
+	err = c.SetServiceKeytab(kf.Name(), "HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not load keytab: %v", err)
+	}
+	assert.NotNil(t, c.Keytab)
+	assert.Equal(t, "HTTP/host.test.gokrb5", c.ServicePrincipal)
+	err = c.SetVerifyKDC(true)
+	if err != nil {
+		t.Fatalf("could not enable KDC verification: %v", err)
+	}
+	assert.True(t, c.VerifyKDC)
+}
+
+func TestConfig_CheckLogs(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+
+	c, err := New(8020, cf.Name(), dir, "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	assert.Empty(t, c.CheckLogs())
+
+	// A log file moved away is written to until it is reopened
+	os.Rename(filepath.Join(dir, AccessLog), filepath.Join(dir, AccessLog+".1"))
+	assert.Empty(t, c.CheckLogs())
+
+	// A path that can no longer be opened for writing is reported
+	os.Mkdir(filepath.Join(dir, AccessLog), 0750)
+	errs := c.CheckLogs()
+	assert.Len(t, errs, 1)
+	assert.Error(t, errs["access"])
+	os.Remove(filepath.Join(dir, AccessLog))
+
+	err = c.SetLogBuffer(8, OverflowBlock)
+	if err != nil {
+		t.Fatalf("could not set log buffer: %v", err)
+	}
+	assert.Empty(t, c.CheckLogs())
+	c.CloseLogs()
+	errs = c.CheckLogs()
+	assert.Len(t, errs, 3, "closed logs should be reported")
+	assert.Equal(t, errSinkClosed, errs["event"])
+
+	// Discarded logs are not checked
+	c, err = New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.CloseLogs()
+	assert.Empty(t, c.CheckLogs())
+}
+
+func TestConfig_Realm(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	r, ok := c.Realm("test.gokrb5")
+	assert.True(t, ok)
+	assert.Equal(t, "TEST.GOKRB5", r)
+	r, ok = c.Realm("ATTACKER.CHOSEN")
+	assert.False(t, ok)
+	assert.Equal(t, "ATTACKER.CHOSEN", r)
+	assert.True(t, c.KnownRealm("Test.Gokrb5"))
+	assert.False(t, c.KnownRealm("ATTACKER.CHOSEN"), "realm not in the krb5.conf should not be known without DNS lookup")
+}
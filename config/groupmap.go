@@ -0,0 +1,139 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// domainSIDPrefix is the prefix of the SIDs of Active Directory domains.
+const domainSIDPrefix = "S-1-5-21-"
+
+// wellKnownSIDs are the names of SIDs that are the same in every domain.
+var wellKnownSIDs = map[string]string{
+	"S-1-1-0":      "Everyone",
+	"S-1-2-0":      "Local",
+	"S-1-5-2":      "Network",
+	"S-1-5-4":      "Interactive",
+	"S-1-5-9":      "Enterprise Domain Controllers",
+	"S-1-5-11":     "Authenticated Users",
+	"S-1-5-15":     "This Organization",
+	"S-1-5-18":     "Local System",
+	"S-1-5-32-544": "Administrators",
+	"S-1-5-32-545": "Users",
+	"S-1-5-32-546": "Guests",
+	"S-1-5-32-548": "Account Operators",
+	"S-1-5-32-549": "Server Operators",
+	"S-1-5-32-550": "Print Operators",
+	"S-1-5-32-551": "Backup Operators",
+	"S-1-5-32-555": "Remote Desktop Users",
+	"S-1-5-64-10":  "NTLM Authentication",
+	"S-1-5-64-21":  "Digest Authentication",
+	"S-1-18-1":     "Authentication Authority Asserted Identity",
+	"S-1-18-2":     "Service Asserted Identity",
+}
+
+// wellKnownRIDs are the names of the groups with well-known relative IDs within every domain. They are only used to name
+// groups of the user's own domain as the groups of other domains have the same names.
+var wellKnownRIDs = map[string]string{
+	"498": "Enterprise Read-only Domain Controllers",
+	"512": "Domain Admins",
+	"513": "Domain Users",
+	"514": "Domain Guests",
+	"515": "Domain Computers",
+	"516": "Domain Controllers",
+	"517": "Cert Publishers",
+	"518": "Schema Admins",
+	"519": "Enterprise Admins",
+	"520": "Group Policy Creator Owners",
+	"521": "Read-only Domain Controllers",
+	"553": "RAS and IAS Servers",
+}
+
+// GroupMapping is the friendly name and application roles for a group SID.
+type GroupMapping struct {
+	Name  string   `json:"Name"`
+	Roles []string `json:"Roles"`
+}
+
+// GroupMap translates group SIDs to friendly names and application roles.
+// The mapping file is a JSON object keyed by SID, for example:
+//
+// {"S-1-5-21-2284869408-3503417140-1141177250-1110": {"Name": "Finance", "Roles": ["finance-approver"]}}
+type GroupMap struct {
+	path   string
+	mux    sync.RWMutex
+	groups map[string]GroupMapping
+}
+
+// LoadGroupMap loads the group mapping file at the path specified.
+func LoadGroupMap(p string) (*GroupMap, error) {
+	g := &GroupMap{path: p}
+	err := g.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reads the group mapping file again. If the file cannot be loaded the existing mapping is kept.
+func (g *GroupMap) Reload() error {
+	b, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return fmt.Errorf("could not read group mapping file: %v", err)
+	}
+	m := make(map[string]GroupMapping)
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("could not parse group mapping file %s: %v", g.path, err)
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.groups = m
+	return nil
+}
+
+// Map returns the names of, and the application roles granted to, the group SIDs provided.
+// SIDs without a name in the mapping file are named from the table of well-known SIDs if possible. Groups with
+// well-known relative IDs are only named if they belong to the domain of the SID provided, the user's domain.
+// Map can be called on a nil GroupMap, in which case only well-known SIDs are named.
+func (g *GroupMap) Map(domainSID string, sids []string) (names, roles []string) {
+	if g != nil {
+		g.mux.RLock()
+		defer g.mux.RUnlock()
+	}
+	seen := make(map[string]bool)
+	for _, sid := range sids {
+		var gm GroupMapping
+		if g != nil {
+			gm = g.groups[sid]
+		}
+		if gm.Name == "" {
+			gm.Name = wellKnownName(domainSID, sid)
+		}
+		if gm.Name != "" {
+			names = append(names, gm.Name)
+		}
+		for _, r := range gm.Roles {
+			if !seen[r] {
+				seen[r] = true
+				roles = append(roles, r)
+			}
+		}
+	}
+	return
+}
+
+// wellKnownName returns the name of a well-known SID, or of a group with a well-known relative ID in the domain
+// provided, or an empty string if the SID is not well-known.
+func wellKnownName(domainSID, sid string) string {
+	if n, ok := wellKnownSIDs[sid]; ok {
+		return n
+	}
+	if strings.HasPrefix(domainSID, domainSIDPrefix) && strings.HasPrefix(sid, domainSID+"-") {
+		return wellKnownRIDs[strings.TrimPrefix(sid, domainSID+"-")]
+	}
+	return ""
+}
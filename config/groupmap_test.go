@@ -0,0 +1,85 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGroupMap = `{
+  "S-1-5-21-2284869408-3503417140-1141177250-1110": {"Name": "Finance", "Roles": ["finance-approver", "reader"]},
+  "S-1-5-21-2284869408-3503417140-1141177250-1109": {"Roles": ["reader"]},
+  "S-1-5-21-2284869408-3503417140-1141177250-513": {"Name": "All Staff"}
+}`
+
+func TestGroupMap_Map(t *testing.T) {
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-groupmap.json")
+	defer os.Remove(f.Name())
+	f.WriteString(testGroupMap)
+
+	g, err := LoadGroupMap(f.Name())
+	if err != nil {
+		t.Fatalf("could not load group mapping: %v", err)
+	}
+	names, roles := g.Map("S-1-5-21-2284869408-3503417140-1141177250", []string{
+		"S-1-5-21-2284869408-3503417140-1141177250-1110",
+		"S-1-5-21-2284869408-3503417140-1141177250-1109",
+		"S-1-5-21-2284869408-3503417140-1141177250-513",
+		"S-1-5-21-2284869408-3503417140-1141177250-512",
+		"S-1-5-21-2284869408-3503417140-1141177250-9999",
+		"S-1-5-21-1111111111-2222222222-3333333333-519",
+		"S-1-18-1",
+	})
+	assert.Equal(t, []string{"Finance", "All Staff", "Domain Admins", "Authentication Authority Asserted Identity"}, names)
+	assert.Equal(t, []string{"finance-approver", "reader"}, roles)
+
+	// Only well-known SIDs are named without a mapping file
+	var ng *GroupMap
+	names, roles = ng.Map("", []string{"S-1-5-32-544", "S-1-5-21-2284869408-3503417140-1141177250-1110"})
+	assert.Equal(t, []string{"Administrators"}, names)
+	assert.Empty(t, roles)
+}
+
+func TestGroupMap_MapOtherDomain(t *testing.T) {
+	var g *GroupMap
+	// The admins of a trusted domain are not named as the admins of the user's domain
+	names, _ := g.Map("S-1-5-21-2284869408-3503417140-1141177250", []string{
+		"S-1-5-21-1111111111-2222222222-3333333333-512",
+		"S-1-5-21-2284869408-3503417140-1141177250-512",
+	})
+	assert.Equal(t, []string{"Domain Admins"}, names)
+
+	names, _ = g.Map("", []string{"S-1-5-21-2284869408-3503417140-1141177250-512"})
+	assert.Empty(t, names, "relative IDs should not be named without the user's domain")
+	names, _ = g.Map("S-1-5-21-2284869408-3503417140-1141177250", []string{"S-1-5-21-2284869408-3503417140-1141177250-5121"})
+	assert.Empty(t, names)
+}
+
+func TestGroupMap_Reload(t *testing.T) {
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-groupmap.json")
+	defer os.Remove(f.Name())
+	f.WriteString(testGroupMap)
+
+	g, err := LoadGroupMap(f.Name())
+	if err != nil {
+		t.Fatalf("could not load group mapping: %v", err)
+	}
+	ioutil.WriteFile(f.Name(), []byte(`{"S-1-5-21-2284869408-3503417140-1141177250-1110": {"Name": "Accounts"}}`), 0600)
+	err = g.Reload()
+	if err != nil {
+		t.Fatalf("could not reload group mapping: %v", err)
+	}
+	names, _ := g.Map("", []string{"S-1-5-21-2284869408-3503417140-1141177250-1110"})
+	assert.Equal(t, []string{"Accounts"}, names)
+
+	ioutil.WriteFile(f.Name(), []byte(`not json`), 0600)
+	err = g.Reload()
+	assert.Error(t, err, "reload of an invalid file should error")
+	names, _ = g.Map("", []string{"S-1-5-21-2284869408-3503417140-1141177250-1110"})
+	assert.Equal(t, []string{"Accounts"}, names, "existing mapping should be kept if reload fails")
+
+	_, err = LoadGroupMap("/does/not/exist")
+	assert.Error(t, err)
+}
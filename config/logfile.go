@@ -0,0 +1,351 @@
+package config
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffixFormat is the time format of the suffix added to the name of a rotated log file. It sorts in the order
+// the files were rotated.
+const rotatedSuffixFormat = "20060102T150405.000000000"
+
+// rotateRetryInterval is the period after a failed rotation before the file is rotated again, so that a rotation that
+// keeps failing is not attempted, and reported, for every line.
+const rotateRetryInterval = time.Minute
+
+// LogRotation configures when log files are rotated and how many rotated files are kept.
+type LogRotation struct {
+	// MaxSize is the size in bytes a log file can grow to before it is rotated. Zero disables.
+	MaxSize int64
+	// MaxAge is the period after which a log file is rotated. Zero disables.
+	MaxAge time.Duration
+	// Keep is the number of rotated files to keep. Zero keeps all of them.
+	Keep int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// LogFile is a log file that can be rotated and reopened.
+// Each Write is expected to be a whole line and is never split across files.
+type LogFile struct {
+	path     string
+	mux      sync.Mutex
+	f        *os.File
+	size     int64
+	opened   time.Time
+	closed   bool
+	rotation LogRotation
+	// retryRotation is the time before which the file is not rotated again after a failed rotation.
+	retryRotation time.Time
+	// rotateErr is the error of a failed rotation yet to be reported.
+	rotateErr error
+	// reportRotateErr is called with the errors of failed rotations. The lines being written are not lost.
+	reportRotateErr func(error)
+}
+
+// OpenLogFile opens the log file at the path provided for appending, creating it if necessary.
+func OpenLogFile(p string) (*LogFile, error) {
+	l := &LogFile{path: p}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Path returns the path of the log file.
+func (l *LogFile) Path() string {
+	return l.path
+}
+
+// SetRotation sets when the log file is rotated.
+func (l *LogFile) SetRotation(r LogRotation) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.rotation = r
+}
+
+// reportRotationErrors sets the function failed rotations are reported to. It is called in its own goroutine so that it
+// can write to this file, or to a log sink writing to it.
+func (l *LogFile) reportRotationErrors(f func(error)) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.reportRotateErr = f
+}
+
+// open opens the file at the path. The caller must hold the lock.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// Write writes the line to the file, first rotating the file if the line would take it over the maximum size or it
+// has reached the maximum age. A failed rotation does not lose the line unless no file could be opened at the path.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	n, err := l.write(p)
+	rerr, report := l.rotateErr, l.reportRotateErr
+	l.rotateErr = nil
+	l.mux.Unlock()
+	if rerr != nil && report != nil {
+		// The error may be reported to a log written by the caller, which cannot wait for it
+		go report(rerr)
+	}
+	return n, err
+}
+
+// write writes the line, rotating the file first if due. If the rotation fails but a file is open at the path the
+// line is still written and the rotation error kept to be reported. The caller must hold the lock.
+func (l *LogFile) write(p []byte) (int, error) {
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+	if l.f == nil {
+		// A previous rotation or reopen could not open the file
+		err := l.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if l.due(int64(len(p))) {
+		err := l.rotate()
+		if err != nil {
+			l.retryRotation = time.Now().Add(rotateRetryInterval)
+			err = fmt.Errorf("could not rotate log file %s: %v", l.path, err)
+			if l.f == nil {
+				return 0, err
+			}
+			l.rotateErr = err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// due indicates if the file should be rotated before writing n bytes. An empty file is never rotated so a line longer
+// than the maximum size is still written, nor is a file whose last rotation failed until the retry interval has
+// passed. The caller must hold the lock.
+func (l *LogFile) due(n int64) bool {
+	if l.size == 0 || time.Now().Before(l.retryRotation) {
+		return false
+	}
+	if l.rotation.MaxSize > 0 && l.size+n > l.rotation.MaxSize {
+		return true
+	}
+	return l.rotation.MaxAge > 0 && time.Since(l.opened) >= l.rotation.MaxAge
+}
+
+// rotate renames the current file with a time suffix, opens a new file at the path and removes the rotated files
+// beyond those to keep. The caller must hold the lock.
+func (l *LogFile) rotate() error {
+	// The file is closed before it is renamed, which is required on some platforms. A failure to close does not stop
+	// the rotation as the file is not written to again.
+	l.f.Close()
+	l.f = nil
+	rp := l.path + "." + time.Now().UTC().Format(rotatedSuffixFormat)
+	err := os.Rename(l.path, rp)
+	if err != nil {
+		// Carry on writing to the existing file rather than lose lines
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	if l.rotation.Compress {
+		err = compressFile(rp)
+		if err != nil {
+			return err
+		}
+	}
+	return l.prune()
+}
+
+// prune removes the oldest rotated files beyond the number to keep. The caller must hold the lock.
+func (l *LogFile) prune() error {
+	if l.rotation.Keep < 1 {
+		return nil
+	}
+	rotated, err := l.rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.rotation.Keep {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotated returns the paths of the rotated files, oldest first.
+func (l *LogFile) rotated() ([]string, error) {
+	m, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, p := range m {
+		s := strings.TrimSuffix(strings.TrimPrefix(p, l.path+"."), ".gz")
+		if _, err := time.Parse(rotatedSuffixFormat, s); err == nil {
+			rotated = append(rotated, p)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Reopen closes the file and opens the path again. External log rotators move the file and then signal for it to be
+// reopened so that lines are written to a new file at the path.
+func (l *LogFile) Reopen() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	var cerr error
+	if l.f != nil {
+		cerr = l.f.Close()
+		l.f = nil
+	}
+	err := l.open()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// check returns an error if lines cannot be written to the file because it is closed, it could not be opened again
+// after a rotation or reopen, or the path can no longer be opened for writing.
+func (l *LogFile) check() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	if l.f == nil {
+		return l.open()
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		// The file has been moved by an external rotator and is written to until it is reopened
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Close closes the file.
+func (l *LogFile) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// compressFile replaces the file with a gzipped copy.
+func compressFile(p string) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(p+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(p)
+}
+
+// SetLogRotation sets when the application, access and event log files are rotated.
+func (c *Config) SetLogRotation(r LogRotation) error {
+	switch {
+	case r.MaxSize < 0:
+		return errors.New("log-max-size: must not be negative")
+	case r.MaxAge < 0:
+		return errors.New("log-max-age: must not be negative")
+	case r.Keep < 0:
+		return errors.New("log-keep: must not be negative")
+	}
+	for _, f := range c.logFiles() {
+		f.SetRotation(r)
+		f.reportRotationErrors(func(err error) {
+			c.ApplicationLogf("%v", err)
+		})
+	}
+	return nil
+}
+
+// ReopenLogs reopens the application, access and event log files. Errors are returned for each file that could not
+// be reopened.
+func (c *Config) ReopenLogs() error {
+	var errs []string
+	for _, f := range c.logFiles() {
+		if err := f.Reopen(); err != nil {
+			errs = append(errs, fmt.Sprintf("could not reopen %s: %v", f.Path(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// logFiles returns the log files the logs are written to. Logs written to the standard output or error, or discarded,
+// have no file.
+func (c *Config) logFiles() []*LogFile {
+	var fs []*LogFile
+	for _, w := range []io.Writer{c.Loggers.applicationOut, c.Loggers.accessOut, c.Loggers.eventOut} {
+		if f, ok := w.(*LogFile); ok {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
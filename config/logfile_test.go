@@ -0,0 +1,217 @@
+package config
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readLines returns the lines of the log file and its rotated files, oldest first.
+func readLines(t *testing.T, l *LogFile) []string {
+	rotated, err := l.rotated()
+	if err != nil {
+		t.Fatalf("could not list rotated files: %v", err)
+	}
+	var lines []string
+	for _, p := range append(rotated, l.Path()) {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatalf("could not open %s: %v", p, err)
+		}
+		var r io.Reader = f
+		if filepath.Ext(p) == ".gz" {
+			r, err = gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("could not read %s: %v", p, err)
+			}
+		}
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		f.Close()
+	}
+	return lines
+}
+
+func TestLogFileRotateSize(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+			defer os.RemoveAll(dir)
+			l, err := OpenLogFile(filepath.Join(dir, EventLog))
+			if err != nil {
+				t.Fatalf("could not open log file: %v", err)
+			}
+			defer l.Close()
+			// Each line is 8 bytes so 3 fit in a file
+			l.SetRotation(LogRotation{MaxSize: 30, Compress: compress})
+			for i := 0; i < 10; i++ {
+				fmt.Fprintf(l, "line %02d\n", i)
+			}
+			rotated, _ := l.rotated()
+			assert.Len(t, rotated, 3)
+			for _, p := range rotated {
+				assert.Equal(t, compress, filepath.Ext(p) == ".gz", "rotated file %s", p)
+			}
+			lines := readLines(t, l)
+			assert.Len(t, lines, 10)
+			for i, line := range lines {
+				assert.Equal(t, fmt.Sprintf("line %02d", i), line, "lines should be whole and in order")
+			}
+		})
+	}
+}
+
+func TestLogFileRotateKeep(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	l, err := OpenLogFile(filepath.Join(dir, EventLog))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer l.Close()
+	l.SetRotation(LogRotation{MaxSize: 8, Keep: 2})
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(l, "line %02d\n", i)
+	}
+	assert.Equal(t, []string{"line 07", "line 08", "line 09"}, readLines(t, l), "only the files to keep should remain")
+
+	// A line longer than the maximum size is written to a file of its own
+	fmt.Fprintln(l, "a line longer than the maximum size")
+	lines := readLines(t, l)
+	assert.Equal(t, "a line longer than the maximum size", lines[len(lines)-1])
+}
+
+func TestLogFileRotateAge(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	l, err := OpenLogFile(filepath.Join(dir, EventLog))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer l.Close()
+	l.SetRotation(LogRotation{MaxAge: time.Hour})
+	fmt.Fprintln(l, "line 00")
+	fmt.Fprintln(l, "line 01")
+	rotated, _ := l.rotated()
+	assert.Len(t, rotated, 0, "file should not be rotated before the maximum age")
+
+	l.opened = l.opened.Add(-time.Hour)
+	fmt.Fprintln(l, "line 02")
+	rotated, _ = l.rotated()
+	assert.Len(t, rotated, 1, "file should be rotated at the maximum age")
+	assert.Equal(t, []string{"line 00", "line 01", "line 02"}, readLines(t, l))
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, AccessLog)
+	l, err := OpenLogFile(p)
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	fmt.Fprintln(l, "before")
+	// An external rotator moves the file, lines continue to be written to it until reopened
+	os.Rename(p, p+".1")
+	fmt.Fprintln(l, "moved")
+	assert.NoError(t, l.Reopen())
+	fmt.Fprintln(l, "after")
+	assert.NoError(t, l.Close())
+
+	b, _ := ioutil.ReadFile(p + ".1")
+	assert.Equal(t, "before\nmoved\n", string(b))
+	b, _ = ioutil.ReadFile(p)
+	assert.Equal(t, "after\n", string(b))
+
+	_, err = fmt.Fprintln(l, "closed")
+	assert.Equal(t, os.ErrClosed, err)
+	assert.Equal(t, os.ErrClosed, l.Reopen())
+}
+
+func TestConfigLogRotation(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	c, err := New(8020, cf.Name(), dir, "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	defer c.CloseLogs()
+	assert.Len(t, c.logFiles(), 3)
+	assert.Error(t, c.SetLogRotation(LogRotation{Keep: -1}))
+	assert.NoError(t, c.SetLogRotation(LogRotation{MaxSize: 1024, Keep: 3}))
+	for _, f := range c.logFiles() {
+		assert.Equal(t, LogRotation{MaxSize: 1024, Keep: 3}, f.rotation)
+	}
+
+	c.EventLog(map[string]string{"Event": "before"})
+	os.Rename(filepath.Join(dir, EventLog), filepath.Join(dir, EventLog+".1"))
+	assert.NoError(t, c.ReopenLogs())
+	c.EventLog(map[string]string{"Event": "after"})
+	b, _ := ioutil.ReadFile(filepath.Join(dir, EventLog))
+	assert.Equal(t, "{\"Event\":\"after\"}\n", string(b))
+
+	s, err := New(8020, cf.Name(), "stdout", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	assert.Len(t, s.logFiles(), 0, "standard output is not a log file")
+	assert.NoError(t, s.ReopenLogs())
+}
+
+func TestLogFileRotateError(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	l, err := OpenLogFile(filepath.Join(dir, EventLog))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer l.Close()
+	// A rotated file that cannot be removed makes pruning fail after the new file is opened
+	stuck := filepath.Join(dir, EventLog+".20000101T000000.000000000")
+	os.Mkdir(stuck, 0750)
+	ioutil.WriteFile(filepath.Join(stuck, "file"), []byte("x"), 0640)
+	reported := make(chan error, 2)
+	l.reportRotationErrors(func(err error) {
+		reported <- err
+	})
+	l.SetRotation(LogRotation{MaxSize: 10, Keep: 1})
+	for i := 0; i < 3; i++ {
+		_, err = fmt.Fprintf(l, "line %02d\n", i)
+		assert.NoError(t, err, "line should be written despite the rotation error")
+	}
+	select {
+	case err := <-reported:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("rotation error should be reported")
+	}
+	select {
+	case <-reported:
+		t.Fatal("rotation should not be retried before the retry interval")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rotated, _ := l.rotated()
+	var lines []string
+	for _, p := range append(rotated, l.Path()) {
+		if p == stuck {
+			continue
+		}
+		b, _ := ioutil.ReadFile(p)
+		lines = append(lines, string(b))
+	}
+	assert.Equal(t, "line 00\nline 01\nline 02\n", strings.Join(lines, ""), "no line should be lost")
+}
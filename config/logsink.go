@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies applied when the buffer of a log sink is full.
+const (
+	// OverflowBlock makes the caller wait for space in the buffer.
+	OverflowBlock = "block"
+	// OverflowDrop discards the line and counts it as dropped.
+	OverflowDrop = "drop"
+)
+
+// logDropReportInterval is the period at which counts of dropped log lines are reported in the application log.
+const logDropReportInterval = time.Minute
+
+// errSinkClosed is returned when writing to a log sink that has been closed.
+var errSinkClosed = errors.New("log sink closed")
+
+// LogSink writes log lines to its output from a single goroutine. Lines are queued in a bounded buffer so that
+// requests do not wait for the output. Each call to Write is one complete line so lines are never interleaved.
+type LogSink struct {
+	name    string
+	out     io.Writer
+	drop    bool
+	lines   chan []byte
+	done    chan struct{}
+	mux     sync.RWMutex
+	closed  bool
+	dropped uint64
+	// reported is the dropped count last reported in the application log.
+	reported    uint64
+	writeErrors uint64
+}
+
+// NewLogSink returns a LogSink that writes to the output with a buffer of the size given. If the overflow policy is
+// OverflowDrop lines are dropped when the buffer is full, otherwise writers wait.
+func NewLogSink(name string, out io.Writer, size int, overflow string) (*LogSink, error) {
+	if size < 1 {
+		return nil, errors.New("log-buffer: must be at least 1")
+	}
+	if overflow != OverflowBlock && overflow != OverflowDrop {
+		return nil, fmt.Errorf("log-overflow: must be %s or %s", OverflowBlock, OverflowDrop)
+	}
+	s := &LogSink{
+		name:  name,
+		out:   out,
+		drop:  overflow == OverflowDrop,
+		lines: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Name returns the name of the log the sink writes.
+func (s *LogSink) Name() string {
+	return s.name
+}
+
+func (s *LogSink) run() {
+	defer close(s.done)
+	for l := range s.lines {
+		if _, err := s.out.Write(l); err != nil {
+			atomic.AddUint64(&s.writeErrors, 1)
+		}
+	}
+}
+
+// Write queues a copy of the line to be written.
+func (s *LogSink) Write(p []byte) (int, error) {
+	l := make([]byte, len(p))
+	copy(l, p)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return 0, errSinkClosed
+	}
+	if !s.drop {
+		s.lines <- l
+		return len(p), nil
+	}
+	select {
+	case s.lines <- l:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of lines dropped because the buffer was full or the sink was closed.
+func (s *LogSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// WriteErrors returns the number of lines that could not be written to the output.
+func (s *LogSink) WriteErrors() uint64 {
+	return atomic.LoadUint64(&s.writeErrors)
+}
+
+// unreported returns the number of lines dropped since the last call.
+func (s *LogSink) unreported() uint64 {
+	d := s.Dropped()
+	r := atomic.SwapUint64(&s.reported, d)
+	return d - r
+}
+
+// check returns an error if the sink is closed or its output cannot be written to.
+func (s *LogSink) check() error {
+	s.mux.RLock()
+	closed := s.closed
+	s.mux.RUnlock()
+	if closed {
+		return errSinkClosed
+	}
+	if c, ok := s.out.(logChecker); ok {
+		return c.check()
+	}
+	return nil
+}
+
+// Close writes the lines remaining in the buffer and then closes the output if it is closable and not the standard
+// output or error.
+func (s *LogSink) Close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.lines)
+	s.mux.Unlock()
+	<-s.done
+	if c, ok := s.out.(io.Closer); ok && !isStdStream(s.out) {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter blocks writes until it is released.
+type blockingWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestLogSinkLinesNotInterleaved(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewLogSink("test", &buf, 16, OverflowBlock)
+	if err != nil {
+		t.Fatalf("could not create log sink: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				fmt.Fprintf(s, "writer %d line %d\n", i, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, s.Close())
+	assert.Equal(t, uint64(0), s.Dropped(), "no lines should be dropped when blocking")
+
+	next := make(map[int]int)
+	sc := bufio.NewScanner(&buf)
+	var n int
+	for sc.Scan() {
+		var i, j int
+		_, err := fmt.Sscanf(sc.Text(), "writer %d line %d", &i, &j)
+		if err != nil {
+			t.Fatalf("line interleaved: %q", sc.Text())
+		}
+		assert.Equal(t, next[i], j, "lines from a writer should be in order")
+		next[i] = j + 1
+		n++
+	}
+	assert.Equal(t, 1000, n, "all lines should be written")
+}
+
+func TestLogSinkDrop(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	s, err := NewLogSink("test", w, 2, OverflowDrop)
+	if err != nil {
+		t.Fatalf("could not create log sink: %v", err)
+	}
+	// The first line is taken by the writing goroutine, which blocks, and the next two fill the buffer
+	fmt.Fprintln(s, "line")
+	for len(s.lines) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 7; i++ {
+		n, err := fmt.Fprintln(s, "line")
+		assert.NoError(t, err, "dropping should not return an error")
+		assert.Equal(t, 5, n)
+	}
+	assert.Equal(t, uint64(5), s.Dropped())
+	assert.Equal(t, uint64(5), s.unreported())
+	assert.Equal(t, uint64(0), s.unreported(), "drops should only be reported once")
+	close(w.release)
+	assert.NoError(t, s.Close())
+	assert.Equal(t, "line\nline\nline\n", w.buf.String(), "buffered lines should be written on close")
+
+	_, err = fmt.Fprintln(s, "line")
+	assert.Equal(t, errSinkClosed, err)
+	assert.Equal(t, uint64(6), s.Dropped(), "lines written after close should be counted as dropped")
+}
+
+func TestNewLogSinkInvalid(t *testing.T) {
+	_, err := NewLogSink("test", ioutil.Discard, 0, OverflowBlock)
+	assert.Error(t, err)
+	_, err = NewLogSink("test", ioutil.Discard, 1, "discard")
+	assert.Error(t, err)
+}
+
+func TestSetLogBuffer(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-logs")
+	defer os.RemoveAll(dir)
+	c, err := New(8020, cf.Name(), dir, "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	assert.Error(t, c.SetLogBuffer(8, "discard"))
+	err = c.SetLogBuffer(8, OverflowBlock)
+	if err != nil {
+		t.Fatalf("could not set log buffer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		c.EventLog(map[string]int{"Event": i})
+		c.AccessLog(map[string]int{"Access": i})
+		c.ApplicationLogf("application line %d", i)
+	}
+	c.CloseLogs()
+
+	for _, l := range []string{EventLog, AccessLog} {
+		f, err := os.Open(filepath.Join(dir, l))
+		if err != nil {
+			t.Fatalf("could not open %s: %v", l, err)
+		}
+		var n int
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var m map[string]int
+			assert.NoError(t, json.Unmarshal(sc.Bytes(), &m), "%s line should be JSON", l)
+			n++
+		}
+		f.Close()
+		assert.Equal(t, 100, n, "all %s lines should be written on close", l)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, AppLog))
+	assert.Contains(t, string(b), "application line 99")
+}
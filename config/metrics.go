@@ -0,0 +1,174 @@
+package config
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of authentication attempts recorded in the metrics.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeRefused = "refused"
+	OutcomeError   = "error"
+)
+
+// Exchanges with the KDC whose latency is recorded in the metrics.
+const (
+	ExchangeAS  = "AS"
+	ExchangeTGS = "TGS"
+)
+
+// otherRealm is the realm label of metrics for realms that are not in the krb5.conf. Realms are given by callers so
+// only those configured are used as label values.
+const otherRealm = "other"
+
+// Metrics are the metrics of authenvoy. Its methods can be called on a nil Metrics, in which case nothing is recorded.
+type Metrics struct {
+	registry             *prometheus.Registry
+	authentications      *prometheus.CounterVec
+	kdcExchangeDuration  *prometheus.HistogramVec
+	requestDuration      *prometheus.HistogramVec
+	requestsInFlight     *prometheus.GaugeVec
+	kdcExchangesInFlight prometheus.Gauge
+	pacParseFailures     prometheus.Counter
+}
+
+// EnableMetrics records metrics, including the build information provided, the errors and dropped lines of the logs
+// and the Go runtime and process metrics. If the port is not zero the metrics are served on that port rather than with
+// the API.
+func (c *Config) EnableMetrics(buildHash string, buildTime time.Time, port int) {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	f := promauto.With(r)
+	m := &Metrics{
+		registry: r,
+		authentications: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "authenvoy_authentications_total",
+			Help: "Authentication attempts by realm, outcome and failure reason.",
+		}, []string{"realm", "outcome", "reason"}),
+		kdcExchangeDuration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "authenvoy_kdc_exchange_duration_seconds",
+			Help:    "Latency of exchanges with the KDC.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"exchange", "realm"}),
+		requestDuration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "authenvoy_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		requestsInFlight: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "authenvoy_http_requests_in_flight",
+			Help: "HTTP requests being handled.",
+		}, []string{"route"}),
+		kdcExchangesInFlight: f.NewGauge(prometheus.GaugeOpts{
+			Name: "authenvoy_kdc_exchanges_in_flight",
+			Help: "Requests exchanging with KDCs.",
+		}),
+		pacParseFailures: f.NewCounter(prometheus.CounterOpts{
+			Name: "authenvoy_pac_parse_failures_total",
+			Help: "PACs that could not be parsed.",
+		}),
+	}
+	r.MustRegister(
+		newLogCounters("authenvoy_log_write_errors_total", "Lines that could not be written to each log.",
+			c.LogWriteErrors),
+		newLogCounters("authenvoy_log_lines_dropped_total", "Lines dropped from each log as its buffer was full.",
+			c.LogDropped),
+	)
+	f.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "authenvoy_build_info",
+		Help: "Build information of authenvoy.",
+	}, []string{"hash", "build_time"}).WithLabelValues(buildHash, buildTime.UTC().Format(time.RFC3339)).Set(1)
+	c.Metrics = m
+	c.MetricsPort = port
+}
+
+// MetricRealm returns the realm to record in metrics for the realm given, which is the realm from the krb5.conf or
+// "other" if the realm is not configured.
+func (c *Config) MetricRealm(realm string) string {
+	if r, ok := c.Realm(realm); ok {
+		return r
+	}
+	return otherRealm
+}
+
+// Handler returns an HTTP handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Authentication records the outcome of an authentication attempt.
+func (m *Metrics) Authentication(realm, outcome, reason string) {
+	if m == nil {
+		return
+	}
+	m.authentications.WithLabelValues(realm, outcome, reason).Inc()
+}
+
+// KDCExchange records the latency of an exchange with a realm's KDC.
+func (m *Metrics) KDCExchange(exchange, realm string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.kdcExchangeDuration.WithLabelValues(exchange, realm).Observe(d.Seconds())
+}
+
+// Request records the duration of an HTTP request.
+func (m *Metrics) Request(route, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.WithLabelValues(route, method, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// RequestInFlight adds to the number of HTTP requests for the route being handled.
+func (m *Metrics) RequestInFlight(route string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.requestsInFlight.WithLabelValues(route).Add(delta)
+}
+
+// KDCExchangeInFlight adds to the number of requests exchanging with KDCs.
+func (m *Metrics) KDCExchangeInFlight(delta float64) {
+	if m == nil {
+		return
+	}
+	m.kdcExchangesInFlight.Add(delta)
+}
+
+// PACParseFailure records a PAC that could not be parsed.
+func (m *Metrics) PACParseFailure() {
+	if m == nil {
+		return
+	}
+	m.pacParseFailures.Inc()
+}
+
+// logCounters is a counter with a value for each log, taken from a function of the counts by log when the metrics are
+// gathered.
+type logCounters struct {
+	desc   *prometheus.Desc
+	counts func() map[string]uint64
+}
+
+func newLogCounters(name, help string, counts func() map[string]uint64) *logCounters {
+	return &logCounters{desc: prometheus.NewDesc(name, help, []string{"log"}, nil), counts: counts}
+}
+
+func (l *logCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.desc
+}
+
+func (l *logCounters) Collect(ch chan<- prometheus.Metric) {
+	for log, n := range l.counts() {
+		ch <- prometheus.MustNewConstMetric(l.desc, prometheus.CounterValue, float64(n), log)
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	// Recording on a nil Metrics does nothing
+	m.Authentication("TEST.GOKRB5", OutcomeSuccess, "")
+	m.KDCExchange(ExchangeAS, "TEST.GOKRB5", time.Second)
+	m.Request("authenticate", "POST", http.StatusOK, time.Second)
+	m.RequestInFlight("authenticate", 1)
+	m.KDCExchangeInFlight(1)
+	m.PACParseFailure()
+}
+
+func TestEnableMetrics(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.EnableMetrics("abc123", time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC), 9090)
+	assert.Equal(t, 9090, c.MetricsPort)
+
+	assert.Equal(t, "TEST.GOKRB5", c.MetricRealm("test.gokrb5"))
+	assert.Equal(t, otherRealm, c.MetricRealm("ATTACKER.CHOSEN"), "unconfigured realms should not be label values")
+
+	c.Metrics.Authentication(c.MetricRealm("TEST.GOKRB5"), OutcomeFailure, "InvalidCredentials")
+	c.Metrics.KDCExchange(ExchangeAS, "TEST.GOKRB5", 20*time.Millisecond)
+	c.Metrics.PACParseFailure()
+
+	// Lines that cannot be written are counted
+	c.SetEventLogWriter(json.NewEncoder(failingWriter{}))
+	c.EventLog(map[string]string{"EventID": "abc"})
+	assert.Equal(t, uint64(1), c.LogWriteErrors()["event"])
+	assert.Equal(t, uint64(0), c.LogWriteErrors()["access"])
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	c.Metrics.Handler().ServeHTTP(response, request)
+	body := response.Body.String()
+	for _, s := range []string{
+		`authenvoy_authentications_total{outcome="failure",realm="TEST.GOKRB5",reason="InvalidCredentials"} 1`,
+		`authenvoy_kdc_exchange_duration_seconds_count{exchange="AS",realm="TEST.GOKRB5"} 1`,
+		`authenvoy_pac_parse_failures_total 1`,
+		`authenvoy_log_write_errors_total{log="event"} 1`,
+		`authenvoy_build_info{build_time="2026-10-17T06:00:00Z",hash="abc123"} 1`,
+	} {
+		assert.Contains(t, body, s+"\n")
+	}
+	assert.Contains(t, body, "\ngo_goroutines ", "Go runtime metrics should be exposed")
+	assert.Contains(t, body, "\nprocess_start_time_seconds ", "process metrics should be exposed")
+}
+
+func TestLogDropped(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	assert.Len(t, c.LogDropped(), 0, "only logs written through a sink can drop lines")
+	err = c.SetLogBuffer(1, OverflowDrop)
+	if err != nil {
+		t.Fatalf("could not set log buffer: %v", err)
+	}
+	c.CloseLogs()
+	c.AccessLog(map[string]string{"Method": "GET"})
+	assert.Equal(t, uint64(1), c.LogDropped()["access"])
+	assert.Equal(t, uint64(0), c.LogDropped()["event"])
+	assert.Equal(t, uint64(0), c.LogWriteErrors()["access"], "lines dropped should not be counted as write errors")
+}
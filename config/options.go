@@ -0,0 +1,314 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EnvPrefix is the prefix of the environment variables that set options.
+const EnvPrefix = "AUTHENVOY_"
+
+// ConfigOption is the name of the option giving the path of the configuration file.
+const ConfigOption = "config"
+
+// redacted replaces the values of secret options when the configuration is printed.
+const redacted = "REDACTED"
+
+// Sources of option values, in order of precedence.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "environment"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// secretOptions are the options whose values locate secrets, the service's keys, and are not printed.
+var secretOptions = map[string]bool{
+	"keytab":  true,
+	"jwt-key": true,
+}
+
+// Options are the values of the command line options, which can also be set from the environment or a configuration
+// file.
+type Options struct {
+	// mux serialises reloads with reads of option values.
+	mux     sync.Mutex
+	fs      *flag.FlagSet
+	cmdOnly map[string]bool
+	sources map[string]string
+}
+
+// EffectiveOption is the value of an option and where it was set from.
+type EffectiveOption struct {
+	Value  string `json:"Value"`
+	Source string `json:"Source"`
+}
+
+// OptionChange is a change to the value of an option on reload.
+type OptionChange struct {
+	Option string
+	Old    string
+	New    string
+}
+
+// String returns the change with the values of secret options redacted.
+func (oc OptionChange) String() string {
+	if secret(oc.Option) {
+		return fmt.Sprintf("%s changed", oc.Option)
+	}
+	return fmt.Sprintf("%s changed from %q to %q", oc.Option, oc.Old, oc.New)
+}
+
+// EnvName returns the name of the environment variable that sets the option.
+func EnvName(option string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// LoadOptions sets the options of the parsed flag set that were not given on the command line. An option is taken
+// from its environment variable, named by EnvName, or otherwise from the configuration file given by the config
+// option. Options not set by any of these keep their defaults. The options named in cmdOnly can only be set on the
+// command line.
+//
+// The configuration file is a JSON object keyed by option name, for example:
+//
+// {"port": 8088, "krb5-conf": "/etc/krb5.conf", "kdc-cooldown": "1m", "tls": true}
+func LoadOptions(fs *flag.FlagSet, cmdOnly ...string) (*Options, error) {
+	o := &Options{
+		fs:      fs,
+		cmdOnly: make(map[string]bool),
+		sources: make(map[string]string),
+	}
+	for _, n := range cmdOnly {
+		o.cmdOnly[n] = true
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		o.sources[f.Name] = SourceDefault
+	})
+	fs.Visit(func(f *flag.Flag) {
+		o.sources[f.Name] = SourceFlag
+	})
+	err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reload takes the options not given on the command line from the environment and the configuration file again and
+// returns the changes. check is then called so the caller can apply and validate the new values. If the options
+// cannot be loaded, or check returns an error, the previous values are restored.
+func (o *Options) Reload(check func() error) ([]OptionChange, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	prev := make(map[string]string)
+	prevSources := make(map[string]string)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		prev[f.Name] = f.Value.String()
+		prevSources[f.Name] = o.sources[f.Name]
+	})
+	restore := func() {
+		o.fs.VisitAll(func(f *flag.Flag) {
+			f.Value.Set(prev[f.Name])
+		})
+		o.sources = prevSources
+	}
+	o.sources = make(map[string]string)
+	var errs []string
+	o.fs.VisitAll(func(f *flag.Flag) {
+		o.sources[f.Name] = prevSources[f.Name]
+		if prevSources[f.Name] == SourceFlag || o.cmdOnly[f.Name] {
+			return
+		}
+		// Options no longer set in the environment or file return to their defaults
+		if err := f.Value.Set(f.DefValue); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: could not reset to default: %v", f.Name, err))
+		}
+		o.sources[f.Name] = SourceDefault
+	})
+	err := o.load()
+	if err == nil && len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	var changes []OptionChange
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != prev[f.Name] {
+			changes = append(changes, OptionChange{Option: f.Name, Old: prev[f.Name], New: v})
+		}
+	})
+	return changes, nil
+}
+
+// load sets the options not given on the command line from the environment and the configuration file.
+func (o *Options) load() error {
+	skip := make(map[string]bool)
+	for n := range o.cmdOnly {
+		skip[n] = true
+	}
+	// The configuration file's path may itself come from the environment
+	if f := o.fs.Lookup(ConfigOption); f != nil {
+		skip[ConfigOption] = true
+		if err := o.setFromEnv(f); err != nil {
+			return err
+		}
+	}
+	file, err := o.file()
+	if err != nil {
+		return err
+	}
+	for k := range file {
+		if o.fs.Lookup(k) == nil || skip[k] {
+			return fmt.Errorf("configuration file key %s: unknown option", k)
+		}
+	}
+	var errs []string
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if skip[f.Name] || o.sources[f.Name] == SourceFlag {
+			return
+		}
+		err := o.setFromEnv(f)
+		if err == nil && o.sources[f.Name] == SourceDefault {
+			err = o.setFromFile(f, file)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (o *Options) setFromEnv(f *flag.Flag) error {
+	if o.sources[f.Name] == SourceFlag {
+		return nil
+	}
+	v, ok := os.LookupEnv(EnvName(f.Name))
+	if !ok {
+		return nil
+	}
+	if err := f.Value.Set(v); err != nil {
+		return fmt.Errorf("environment variable %s: invalid value %q: %v", EnvName(f.Name), v, err)
+	}
+	o.sources[f.Name] = SourceEnv
+	return nil
+}
+
+func (o *Options) setFromFile(f *flag.Flag, file map[string]json.RawMessage) error {
+	raw, ok := file[f.Name]
+	if !ok {
+		return nil
+	}
+	v, err := optionString(raw)
+	if err != nil {
+		return fmt.Errorf("configuration file key %s: %v", f.Name, err)
+	}
+	if err := f.Value.Set(v); err != nil {
+		return fmt.Errorf("configuration file key %s: invalid value %q: %v", f.Name, v, err)
+	}
+	o.sources[f.Name] = SourceFile
+	return nil
+}
+
+// file reads the configuration file if one has been given.
+func (o *Options) file() (map[string]json.RawMessage, error) {
+	f := o.fs.Lookup(ConfigOption)
+	if f == nil || f.Value.String() == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(f.Value.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration file: %v", err)
+	}
+	m := make(map[string]json.RawMessage)
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse configuration file %s: %v", f.Value.String(), err)
+	}
+	return m, nil
+}
+
+// optionString returns the string form of a JSON string, number or boolean.
+func optionString(raw json.RawMessage) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return fmt.Sprintf("%t", t), nil
+	}
+	return "", errors.New("value must be a string, number or boolean")
+}
+
+// Value returns the value of the option.
+func (o *Options) Value(option string) string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	f := o.fs.Lookup(option)
+	if f == nil {
+		return ""
+	}
+	return f.Value.String()
+}
+
+// Source returns where the value of the option was set from.
+func (o *Options) Source(option string) string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.sources[option]
+}
+
+// Effective returns the value and source of every option. The values of secret options are redacted.
+func (o *Options) Effective() map[string]EffectiveOption {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	m := make(map[string]EffectiveOption)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secret(f.Name) && v != "" {
+			v = redacted
+		}
+		m[f.Name] = EffectiveOption{
+			Value:  v,
+			Source: o.sources[f.Name],
+		}
+	})
+	return m
+}
+
+// Print writes the effective configuration as JSON with the values of secret options redacted.
+func (o *Options) Print(w io.Writer) error {
+	b, err := json.MarshalIndent(o.Effective(), "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// secret indicates if the option's value is a secret.
+func secret(option string) bool {
+	return secretOptions[option]
+}
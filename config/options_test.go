@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(ConfigOption, "", "")
+	fs.Bool("version", false, "")
+	fs.Int("port", 8088, "")
+	fs.String("krb5-conf", "./krb5.conf", "")
+	fs.Duration("kdc-cooldown", 30*time.Second, "")
+	fs.Bool("tls", false, "")
+	fs.String("jwt-key", "", "")
+	return fs
+}
+
+func testConfigFile(t *testing.T, s string) string {
+	f, err := ioutil.TempFile(os.TempDir(), "authenvoy-config")
+	if err != nil {
+		t.Fatalf("could not create configuration file: %v", err)
+	}
+	f.WriteString(s)
+	f.Close()
+	return f.Name()
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "AUTHENVOY_KDC_FAILURE_THRESHOLD", EnvName("kdc-failure-threshold"))
+	assert.Equal(t, "AUTHENVOY_PORT", EnvName("port"))
+}
+
+func TestLoadOptionsPrecedence(t *testing.T) {
+	p := testConfigFile(t, `{"port": 9000, "krb5-conf": "/etc/krb5.conf", "kdc-cooldown": "1m", "tls": true}`)
+	defer os.Remove(p)
+	os.Setenv("AUTHENVOY_CONFIG", p)
+	os.Setenv("AUTHENVOY_PORT", "9001")
+	os.Setenv("AUTHENVOY_KRB5_CONF", "/env/krb5.conf")
+	defer os.Unsetenv("AUTHENVOY_CONFIG")
+	defer os.Unsetenv("AUTHENVOY_PORT")
+	defer os.Unsetenv("AUTHENVOY_KRB5_CONF")
+
+	fs := testFlagSet()
+	fs.Parse([]string{"-port", "9002"})
+	o, err := LoadOptions(fs, "version")
+	if err != nil {
+		t.Fatalf("error loading options: %v", err)
+	}
+	var tests = []struct {
+		option string
+		value  string
+		source string
+	}{
+		{"port", "9002", SourceFlag},
+		{"krb5-conf", "/env/krb5.conf", SourceEnv},
+		{"kdc-cooldown", "1m0s", SourceFile},
+		{"tls", "true", SourceFile},
+		{"jwt-key", "", SourceDefault},
+		{ConfigOption, p, SourceEnv},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.value, fs.Lookup(test.option).Value.String(), "value of %s not as expected", test.option)
+		assert.Equal(t, test.source, o.Source(test.option), "source of %s not as expected", test.option)
+	}
+}
+
+func TestLoadOptionsErrors(t *testing.T) {
+	var tests = []struct {
+		file string
+		env  string
+		err  string
+	}{
+		{`{"prot": 9000}`, "", "configuration file key prot: unknown option"},
+		{`{"version": true}`, "", "configuration file key version: unknown option"},
+		{`{"port": "eighty"}`, "", `configuration file key port: invalid value "eighty"`},
+		{`{"kdc-cooldown": ["1m"]}`, "", "configuration file key kdc-cooldown: value must be a string, number or boolean"},
+		{`{"port": 9000}`, "x", `environment variable AUTHENVOY_PORT: invalid value "x"`},
+		{`{"port": 9000`, "", "could not parse configuration file"},
+	}
+	for _, test := range tests {
+		p := testConfigFile(t, test.file)
+		if test.env != "" {
+			os.Setenv("AUTHENVOY_PORT", test.env)
+		}
+		fs := testFlagSet()
+		fs.Parse([]string{"-config", p})
+		_, err := LoadOptions(fs, "version")
+		os.Unsetenv("AUTHENVOY_PORT")
+		os.Remove(p)
+		if assert.Error(t, err, "expected error for file %s", test.file) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestPrintOptions(t *testing.T) {
+	fs := testFlagSet()
+	fs.Parse([]string{"-jwt-key", "/etc/authenvoy/jwt.pem"})
+	o, err := LoadOptions(fs, "version")
+	if err != nil {
+		t.Fatalf("error loading options: %v", err)
+	}
+	var b bytes.Buffer
+	err = o.Print(&b)
+	if err != nil {
+		t.Fatalf("error printing options: %v", err)
+	}
+	assert.NotContains(t, b.String(), "/etc/authenvoy/jwt.pem", "secret should be redacted")
+	m := make(map[string]EffectiveOption)
+	err = json.Unmarshal(b.Bytes(), &m)
+	if err != nil {
+		t.Fatalf("could not unmarshal printed options: %v", err)
+	}
+	assert.Equal(t, EffectiveOption{Value: redacted, Source: SourceFlag}, m["jwt-key"])
+	assert.Equal(t, EffectiveOption{Value: "8088", Source: SourceDefault}, m["port"])
+}
+
+func TestValidate(t *testing.T) {
+	c := &Config{KDCFailureThreshold: 5, KDCCoolDown: time.Second}
+	assert.NoError(t, c.Validate())
+	c.RateLimitUser = -1
+	assert.EqualError(t, c.Validate(), "rate-limit-user: must not be negative")
+	c.RateLimitUser = 0
+	c.LockoutThreshold = 3
+	assert.EqualError(t, c.Validate(), "lockout-duration: must be set when lockout-threshold is enabled")
+	c.LockoutDuration = time.Minute
+	c.AuthTimeout = time.Minute
+	c.WriteTimeout = time.Second
+	assert.EqualError(t, c.Validate(), "auth-timeout: must not be longer than write-timeout")
+}
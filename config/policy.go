@@ -0,0 +1,200 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAudience is the name of the policy applied to requests that do not specify an audience.
+const DefaultAudience = "default"
+
+// Authorization policy rules. These are reported as the rule that decided the outcome of an evaluation.
+const (
+	RuleAllowed         = "Allowed"
+	RuleUnknownAudience = "UnknownAudience"
+	RuleAllowedRealms   = "AllowedRealms"
+	RuleAllowedHours    = "AllowedHours"
+	RuleForbiddenGroups = "ForbiddenGroups"
+	RuleRequiredGroups  = "RequiredGroups"
+)
+
+// Policy describes who is authorized to access an application.
+// Groups can be given either as SIDs or as names from the group mapping.
+type Policy struct {
+	// RequiredGroups the user must be a member of all of.
+	RequiredGroups []string `json:"RequiredGroups"`
+	// ForbiddenGroups the user must not be a member of any of.
+	ForbiddenGroups []string `json:"ForbiddenGroups"`
+	// AllowedRealms the user must belong to one of. Any realm is allowed if empty.
+	AllowedRealms []string `json:"AllowedRealms"`
+	// AllowedHours the user can authenticate within. Any time is allowed if not set.
+	AllowedHours *Hours `json:"AllowedHours"`
+}
+
+// Hours is a period of the day on certain days of the week.
+// Start and End are in the form 15:04. If End is before Start the period spans midnight.
+type Hours struct {
+	Days     []string `json:"Days"`
+	Start    string   `json:"Start"`
+	End      string   `json:"End"`
+	TimeZone string   `json:"TimeZone"`
+	start    time.Duration
+	end      time.Duration
+	loc      *time.Location
+}
+
+// Policies holds the authorization policies keyed by audience.
+// The policy file is a JSON object of policies keyed by audience, for example:
+//
+// {"payroll": {"RequiredGroups": ["Finance"], "AllowedRealms": ["USER.GOKRB5"]}}
+type Policies struct {
+	path     string
+	keytab   bool
+	mux      sync.RWMutex
+	policies map[string]Policy
+}
+
+// SetPolicies loads the authorization policy file at the path specified.
+// Group rules are only allowed if a service keytab has been set, as without one the groups of users cannot be verified.
+func (c *Config) SetPolicies(p string) error {
+	ps := &Policies{path: p, keytab: c.Keytab != nil}
+	err := ps.Reload()
+	if err != nil {
+		return err
+	}
+	c.Policies = ps
+	return nil
+}
+
+// Reload reads the policy file again. If the file cannot be loaded the existing policies are kept.
+func (ps *Policies) Reload() error {
+	b, err := ioutil.ReadFile(ps.path)
+	if err != nil {
+		return fmt.Errorf("could not read policy file: %v", err)
+	}
+	m := make(map[string]Policy)
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("could not parse policy file %s: %v", ps.path, err)
+	}
+	for a, p := range m {
+		if !ps.keytab && (len(p.RequiredGroups) > 0 || len(p.ForbiddenGroups) > 0) {
+			return fmt.Errorf("group rules in policy for audience %s need a keytab to verify the groups of users", a)
+		}
+		if p.AllowedHours != nil {
+			err = p.AllowedHours.parse()
+			if err != nil {
+				return fmt.Errorf("invalid AllowedHours in policy for audience %s: %v", a, err)
+			}
+		}
+	}
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	ps.policies = m
+	return nil
+}
+
+// Evaluate determines if a user of the realm, who is a member of the groups provided, is authorized for the audience
+// at the time provided. The rule that decided the outcome is returned.
+func (ps *Policies) Evaluate(audience, realm string, groups []string, t time.Time) (bool, string) {
+	if audience == "" {
+		audience = DefaultAudience
+	}
+	ps.mux.RLock()
+	p, ok := ps.policies[audience]
+	ps.mux.RUnlock()
+	if !ok {
+		return false, RuleUnknownAudience
+	}
+	if len(p.AllowedRealms) > 0 && !containsFold(p.AllowedRealms, realm) {
+		return false, RuleAllowedRealms
+	}
+	if p.AllowedHours != nil && !p.AllowedHours.contains(t) {
+		return false, RuleAllowedHours
+	}
+	for _, g := range p.ForbiddenGroups {
+		if containsFold(groups, g) {
+			return false, RuleForbiddenGroups
+		}
+	}
+	for _, g := range p.RequiredGroups {
+		if !containsFold(groups, g) {
+			return false, RuleRequiredGroups
+		}
+	}
+	return true, RuleAllowed
+}
+
+func (h *Hours) parse() error {
+	st, err := time.Parse("15:04", h.Start)
+	if err != nil {
+		return fmt.Errorf("invalid Start: %v", err)
+	}
+	et, err := time.Parse("15:04", h.End)
+	if err != nil {
+		return fmt.Errorf("invalid End: %v", err)
+	}
+	h.start = time.Duration(st.Hour())*time.Hour + time.Duration(st.Minute())*time.Minute
+	h.end = time.Duration(et.Hour())*time.Hour + time.Duration(et.Minute())*time.Minute
+	h.loc, err = time.LoadLocation(h.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid TimeZone: %v", err)
+	}
+	for _, d := range h.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %s", d)
+		}
+	}
+	return nil
+}
+
+// weekdays maps the abbreviated and full names of the days of the week.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// contains indicates if the time is within the hours. For periods spanning midnight the day is that on which the
+// period starts.
+func (h *Hours) contains(t time.Time) bool {
+	t = t.In(h.loc)
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+	if h.end <= h.start {
+		// The period spans midnight
+		if tod < h.end {
+			day = (day + 6) % 7
+		} else if tod < h.start {
+			return false
+		}
+	} else if tod < h.start || tod >= h.end {
+		return false
+	}
+	if len(h.Days) == 0 {
+		return true
+	}
+	for _, d := range h.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicies = `{
+  "default": {},
+  "payroll": {
+    "RequiredGroups": ["Finance", "S-1-5-21-2284869408-3503417140-1141177250-513"],
+    "ForbiddenGroups": ["Contractors"],
+    "AllowedRealms": ["USER.GOKRB5"],
+    "AllowedHours": {"Days": ["Mon", "Tue", "Wed", "Thu", "Fri"], "Start": "08:00", "End": "18:00", "TimeZone": "UTC"}
+  },
+  "night-shift": {
+    "AllowedHours": {"Days": ["Friday"], "Start": "22:00", "End": "06:00", "TimeZone": "UTC"}
+  }
+}`
+
+func testPolicyConfig(t *testing.T, p string) (*Config, error) {
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-policy.json")
+	defer os.Remove(f.Name())
+	f.WriteString(p)
+	c := &Config{Keytab: keytab.New()}
+	return c, c.SetPolicies(f.Name())
+}
+
+func TestPolicies_Evaluate(t *testing.T) {
+	c, err := testPolicyConfig(t, testPolicies)
+	if err != nil {
+		t.Fatalf("could not load policies: %v", err)
+	}
+	groups := []string{"S-1-5-21-2284869408-3503417140-1141177250-513", "finance"}
+	// Wednesday
+	wed := time.Date(2018, 11, 28, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		audience string
+		realm    string
+		groups   []string
+		t        time.Time
+		ok       bool
+		rule     string
+	}{
+		{"", "USER.GOKRB5", nil, wed, true, RuleAllowed},
+		{"unknown", "USER.GOKRB5", groups, wed, false, RuleUnknownAudience},
+		{"payroll", "USER.GOKRB5", groups, wed, true, RuleAllowed},
+		{"payroll", "RES.GOKRB5", groups, wed, false, RuleAllowedRealms},
+		{"payroll", "USER.GOKRB5", groups, wed.Add(time.Hour * 7), false, RuleAllowedHours},
+		{"payroll", "USER.GOKRB5", groups, wed.Add(time.Hour * 72), false, RuleAllowedHours},
+		{"payroll", "USER.GOKRB5", append(groups, "Contractors"), wed, false, RuleForbiddenGroups},
+		{"payroll", "USER.GOKRB5", groups[:1], wed, false, RuleRequiredGroups},
+		// Friday 23:00 and Saturday 05:00 are within the Friday night shift, Saturday 23:00 is not
+		{"night-shift", "USER.GOKRB5", nil, wed.Add(time.Hour * 59), true, RuleAllowed},
+		{"night-shift", "USER.GOKRB5", nil, wed.Add(time.Hour * 65), true, RuleAllowed},
+		{"night-shift", "USER.GOKRB5", nil, wed.Add(time.Hour * 83), false, RuleAllowedHours},
+		{"night-shift", "USER.GOKRB5", nil, wed.Add(time.Hour * 48), false, RuleAllowedHours},
+	}
+	for _, test := range tests {
+		ok, rule := c.Policies.Evaluate(test.audience, test.realm, test.groups, test.t)
+		assert.Equal(t, test.ok, ok, "authorization outcome not as expected for %s at %v", test.audience, test.t)
+		assert.Equal(t, test.rule, rule, "rule not as expected for %s at %v", test.audience, test.t)
+	}
+}
+
+func TestConfig_SetPolicies(t *testing.T) {
+	_, err := testPolicyConfig(t, `not json`)
+	assert.Error(t, err, "invalid policy file should error")
+	_, err = testPolicyConfig(t, `{"default": {"AllowedHours": {"Start": "8am", "End": "18:00"}}}`)
+	assert.Error(t, err, "invalid hours should error")
+	_, err = testPolicyConfig(t, `{"default": {"AllowedHours": {"Days": ["Someday"], "Start": "08:00", "End": "18:00"}}}`)
+	assert.Error(t, err, "invalid day should error")
+	c := new(Config)
+	err = c.SetPolicies("/does/not/exist")
+	assert.Error(t, err, "policy file that does not exist should error")
+	assert.Nil(t, c.Policies)
+
+	// Without a keytab the groups of users are never verified
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-policy.json")
+	defer os.Remove(f.Name())
+	f.WriteString(testPolicies)
+	err = c.SetPolicies(f.Name())
+	assert.Error(t, err, "group rules without a keytab should error")
+	ioutil.WriteFile(f.Name(), []byte(`{"default": {"AllowedRealms": ["USER.GOKRB5"]}}`), 0600)
+	err = c.SetPolicies(f.Name())
+	assert.NoError(t, err, "policies without group rules do not need a keytab")
+}
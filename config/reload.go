@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/jcmturner/gokrb5/v8/config"
+)
+
+// Current returns the configuration in use. If the configuration has been reloaded this is the configuration that
+// replaced c. Each request should use the configuration current when it started throughout.
+func (c *Config) Current() *Config {
+	if c.current == nil {
+		return c
+	}
+	return c.current.Load().(*Config)
+}
+
+// Replace makes next the configuration in use. Requests already in progress finish with the configuration they
+// started with. next should be a copy of the current configuration.
+func (c *Config) Replace(next *Config) {
+	if c.current == nil {
+		return
+	}
+	next.current = c.current
+	c.current.Store(next)
+}
+
+// ReloadKRB5Conf loads the krb5.conf again and returns a summary of the changes. If the file cannot be loaded the
+// existing krb5.conf is kept. This should be called on a copy of the current configuration which then replaces it.
+func (c *Config) ReloadKRB5Conf() ([]string, error) {
+	k, err := config.Load(c.KRB5ConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load krb5.conf: %v", err)
+	}
+	changes := krb5ConfChanges(c.KRB5Conf, k)
+	c.KRB5Conf = k
+	return changes, nil
+}
+
+// ReloadGroupMap loads the group mapping file at the path given, which may have changed, or removes the mapping if the
+// path is empty. If the file cannot be loaded the existing mapping is kept. This should be called on a copy of the
+// current configuration which then replaces it.
+func (c *Config) ReloadGroupMap(p string) error {
+	if p == "" {
+		c.GroupMap = nil
+		return nil
+	}
+	g, err := LoadGroupMap(p)
+	if err != nil {
+		return err
+	}
+	c.GroupMap = g
+	return nil
+}
+
+// ReloadPolicies loads the authorization policy file at the path given, which may have changed, or removes the
+// policies if the path is empty. If the file cannot be loaded the existing policies are kept. This should be called on
+// a copy of the current configuration which then replaces it.
+func (c *Config) ReloadPolicies(p string) error {
+	if p == "" {
+		c.Policies = nil
+		return nil
+	}
+	return c.SetPolicies(p)
+}
+
+// krb5ConfChanges summarises the differences between two krb5.conf configurations.
+func krb5ConfChanges(old, new *config.Config) []string {
+	var changes []string
+	if old == nil {
+		old = config.New()
+	}
+	if !reflect.DeepEqual(old.LibDefaults, new.LibDefaults) {
+		changes = append(changes, "libdefaults changed")
+	}
+	or := make(map[string]config.Realm)
+	for _, r := range old.Realms {
+		or[r.Realm] = r
+	}
+	nr := make(map[string]config.Realm)
+	for _, r := range new.Realms {
+		nr[r.Realm] = r
+		o, ok := or[r.Realm]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("realm %s added with KDCs %v", r.Realm, r.KDC))
+			continue
+		}
+		if !reflect.DeepEqual(o.KDC, r.KDC) {
+			changes = append(changes, fmt.Sprintf("realm %s KDCs changed from %v to %v", r.Realm, o.KDC, r.KDC))
+		}
+		if !reflect.DeepEqual(o.AdminServer, r.AdminServer) || !reflect.DeepEqual(o.KPasswdServer, r.KPasswdServer) ||
+			!reflect.DeepEqual(o.MasterKDC, r.MasterKDC) || o.DefaultDomain != r.DefaultDomain {
+			changes = append(changes, fmt.Sprintf("realm %s servers or domain changed", r.Realm))
+		}
+	}
+	for _, r := range old.Realms {
+		if _, ok := nr[r.Realm]; !ok {
+			changes = append(changes, fmt.Sprintf("realm %s removed", r.Realm))
+		}
+	}
+	if !reflect.DeepEqual(old.DomainRealm, new.DomainRealm) {
+		changes = append(changes, "domain_realm mappings changed")
+	}
+	sort.Strings(changes)
+	return changes
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReplace(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	assert.True(t, c == c.Current(), "new config should be current")
+
+	next := *c.Current()
+	next.RateLimitUser = 10
+	c.Replace(&next)
+	assert.Equal(t, 10, c.Current().RateLimitUser)
+	assert.Equal(t, 0, c.RateLimitUser, "requests holding the old config should be unaffected")
+	assert.True(t, next.Current() == &next, "copies should share the current config")
+
+	// A config without a holder is its own current config
+	u := &Config{}
+	assert.True(t, u == u.Current())
+}
+
+func TestReloadKRB5Conf(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	cf.Close()
+	c, err := New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+
+	changed := strings.Replace(krb5Conf, "kdc = 10.80.88.88:188", "kdc = 10.80.88.89:88", 1)
+	changed = strings.Replace(changed, `  RES.GOKRB5 = {
+  kdc = 10.80.88.49:88
+  admin_server = 10.80.88.49:464
+  default_domain = res.gokrb5
+ }`, ` NEW.GOKRB5 = {
+  kdc = 10.80.88.50:88
+ }`, 1)
+	ioutil.WriteFile(cf.Name(), []byte(changed), 0600)
+	next := *c
+	changes, err := next.ReloadKRB5Conf()
+	if err != nil {
+		t.Fatalf("error reloading krb5.conf: %v", err)
+	}
+	assert.Equal(t, []string{
+		"realm NEW.GOKRB5 added with KDCs [10.80.88.50:88]",
+		"realm RES.GOKRB5 removed",
+		"realm RESDOM.GOKRB5 KDCs changed from [10.80.88.88:188] to [10.80.88.89:88]",
+	}, changes)
+	_, kdcs, _ := next.KRB5Conf.GetKDCs("RESDOM.GOKRB5", false)
+	assert.Equal(t, "10.80.88.89:88", kdcs[1])
+	_, kdcs, _ = c.KRB5Conf.GetKDCs("RESDOM.GOKRB5", false)
+	assert.Equal(t, "10.80.88.88:188", kdcs[1], "original config should be unaffected")
+
+	changes, err = next.ReloadKRB5Conf()
+	assert.NoError(t, err)
+	assert.Empty(t, changes, "reloading an unchanged file should report no changes")
+
+	ioutil.WriteFile(cf.Name(), []byte("[libdefaults]\n  ticket_lifetime = notaduration\n"), 0600)
+	k := next.KRB5Conf
+	_, err = next.ReloadKRB5Conf()
+	assert.Error(t, err, "invalid krb5.conf should not load")
+	assert.True(t, k == next.KRB5Conf, "existing krb5.conf should be kept")
+}
+
+func TestReloadGroupMapAndPolicies(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	gf, _ := ioutil.TempFile(os.TempDir(), "TEST-groupmap.json")
+	defer os.Remove(gf.Name())
+	gf.WriteString(testGroupMap)
+	pf, _ := ioutil.TempFile(os.TempDir(), "TEST-policy.json")
+	defer os.Remove(pf.Name())
+	pf.WriteString(`{"payroll": {"AllowedRealms": ["USER.GOKRB5"]}}`)
+	c, err := New(8020, cf.Name(), "null", gf.Name())
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+
+	nf, _ := ioutil.TempFile(os.TempDir(), "TEST-groupmap.json")
+	defer os.Remove(nf.Name())
+	nf.WriteString(`{"S-1-5-21-2284869408-3503417140-1141177250-1110": {"Name": "Accounts"}}`)
+	next := *c.Current()
+	assert.NoError(t, next.ReloadGroupMap(nf.Name()))
+	assert.NoError(t, next.ReloadPolicies(pf.Name()))
+	c.Replace(&next)
+	names, _ := c.Current().GroupMap.Map("", []string{"S-1-5-21-2284869408-3503417140-1141177250-1110"})
+	assert.Equal(t, []string{"Accounts"}, names, "group mapping should be loaded from the new path")
+	ok, _ := c.Current().Policies.Evaluate("payroll", "RES.GOKRB5", nil, time.Now())
+	assert.False(t, ok, "policies should be loaded")
+	names, _ = c.GroupMap.Map("", []string{"S-1-5-21-2284869408-3503417140-1141177250-1110"})
+	assert.Equal(t, []string{"Finance"}, names, "requests holding the old config should be unaffected")
+	assert.Nil(t, c.Policies)
+
+	next = *c.Current()
+	assert.Error(t, next.ReloadGroupMap("/does/not/exist"))
+	assert.Error(t, next.ReloadPolicies("/does/not/exist"))
+	assert.True(t, next.GroupMap == c.Current().GroupMap, "existing group mapping should be kept")
+	assert.True(t, next.Policies == c.Current().Policies, "existing policies should be kept")
+
+	assert.NoError(t, next.ReloadGroupMap(""))
+	assert.NoError(t, next.ReloadPolicies(""))
+	assert.Nil(t, next.GroupMap)
+	assert.Nil(t, next.Policies)
+}
+
+func TestOptionsReload(t *testing.T) {
+	p := testConfigFile(t, `{"port": 9000, "kdc-cooldown": "1m"}`)
+	defer os.Remove(p)
+	fs := testFlagSet()
+	fs.Parse([]string{"-config", p, "-tls"})
+	o, err := LoadOptions(fs, "version")
+	if err != nil {
+		t.Fatalf("error loading options: %v", err)
+	}
+
+	ioutil.WriteFile(p, []byte(`{"kdc-cooldown": "2m", "tls": false}`), 0600)
+	changes, err := o.Reload(nil)
+	if err != nil {
+		t.Fatalf("error reloading options: %v", err)
+	}
+	assert.ElementsMatch(t, []OptionChange{
+		{Option: "port", Old: "9000", New: "8088"},
+		{Option: "kdc-cooldown", Old: "1m0s", New: "2m0s"},
+	}, changes, "options removed from the file should return to their defaults and flags should take precedence")
+	assert.Equal(t, SourceDefault, o.Source("port"))
+	assert.Equal(t, "true", o.Value("tls"))
+	assert.Equal(t, `kdc-cooldown changed from "1m0s" to "2m0s"`, OptionChange{Option: "kdc-cooldown", Old: "1m0s", New: "2m0s"}.String())
+
+	ioutil.WriteFile(p, []byte(`{"kdc-cooldown": "3m", "port": "x"}`), 0600)
+	_, err = o.Reload(nil)
+	assert.Error(t, err)
+	assert.Equal(t, "2m0s", o.Value("kdc-cooldown"), "options should be restored when the file is invalid")
+	assert.Equal(t, SourceFile, o.Source("kdc-cooldown"))
+
+	ioutil.WriteFile(p, []byte(`{"kdc-cooldown": "3m"}`), 0600)
+	_, err = o.Reload(func() error {
+		return errors.New("rejected")
+	})
+	assert.EqualError(t, err, "rejected")
+	assert.Equal(t, "2m0s", o.Value("kdc-cooldown"), "options should be restored when the check fails")
+
+	ioutil.WriteFile(p, []byte(`{"jwt-key": "/etc/authenvoy/jwt.pem"}`), 0600)
+	changes, err = o.Reload(nil)
+	assert.NoError(t, err)
+	for _, ch := range changes {
+		assert.NotContains(t, ch.String(), "/etc/authenvoy/jwt.pem", "secret values should not be reported")
+	}
+	assert.Equal(t, "jwt-key changed", changes[0].String())
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// DefaultSocketMode is the file mode of the Unix domain socket, which allows its owner and group to connect.
+const DefaultSocketMode = "0660"
+
+// SetSocket sets the API to be served on a Unix domain socket at the path instead of the loopback port. The owner and
+// group of the socket can be names or numeric IDs and are left as those of the process if empty. The mode is given in
+// octal.
+func (c *Config) SetSocket(p, owner, group, mode string) error {
+	if p == "" {
+		return errors.New("socket: must be a path")
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return fmt.Errorf("socket-mode: must be an octal file mode such as %s", DefaultSocketMode)
+	}
+	uid, gid := -1, -1
+	if owner != "" {
+		id, err := lookupUID(owner)
+		if err != nil {
+			return fmt.Errorf("socket-owner: %v", err)
+		}
+		uid = int(id)
+	}
+	if group != "" {
+		id, err := lookupGID(group)
+		if err != nil {
+			return fmt.Errorf("socket-group: %v", err)
+		}
+		gid = int(id)
+	}
+	c.Socket = p
+	c.SocketUID = uid
+	c.SocketGID = gid
+	c.SocketMode = os.FileMode(m)
+	return nil
+}
+
+// SetPeerAllowlist restricts the callers over the Unix domain socket to processes running as one of the users or with
+// one of the primary groups. Each is a comma separated list of names or numeric IDs and either can be empty. If both
+// are empty any process able to connect to the socket is allowed.
+func (c *Config) SetPeerAllowlist(users, groups string) error {
+	uids, err := idList(users, lookupUID)
+	if err != nil {
+		return fmt.Errorf("allow-uids: %v", err)
+	}
+	gids, err := idList(groups, lookupGID)
+	if err != nil {
+		return fmt.Errorf("allow-gids: %v", err)
+	}
+	if (len(uids) > 0 || len(gids) > 0) && c.Socket == "" {
+		return errors.New("allow-uids: peer credentials can only be checked when listening on a socket")
+	}
+	c.AllowUIDs = uids
+	c.AllowGIDs = gids
+	return nil
+}
+
+// PeerRestricted indicates if callers over the Unix domain socket are restricted to an allowlist.
+func (c *Config) PeerRestricted() bool {
+	return len(c.AllowUIDs) > 0 || len(c.AllowGIDs) > 0
+}
+
+// PeerAllowed indicates if a process with the user and primary group IDs is allowed to call.
+func (c *Config) PeerAllowed(uid, gid uint32) bool {
+	if !c.PeerRestricted() {
+		return true
+	}
+	for _, id := range c.AllowUIDs {
+		if id == uid {
+			return true
+		}
+	}
+	for _, id := range c.AllowGIDs {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// idList parses a comma separated list of names or numeric IDs.
+func idList(s string, lookup func(string) (uint32, error)) ([]uint32, error) {
+	var ids []uint32
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		id, err := lookup(n)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// lookupUID returns the user ID of the user name, or the ID itself if numeric.
+func lookupUID(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("user %s has a non-numeric ID %s", s, u.Uid)
+	}
+	return uint32(id), nil
+}
+
+// lookupGID returns the group ID of the group name, or the ID itself if numeric.
+func lookupGID(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %s has a non-numeric ID %s", s, g.Gid)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSocket(t *testing.T) {
+	c := &Config{}
+	err := c.SetSocket("/run/authenvoy.sock", "", "", DefaultSocketMode)
+	if err != nil {
+		t.Fatalf("could not set socket: %v", err)
+	}
+	assert.Equal(t, "/run/authenvoy.sock", c.Socket)
+	assert.Equal(t, -1, c.SocketUID, "owner should be left as the process's")
+	assert.Equal(t, -1, c.SocketGID, "group should be left as the process's")
+	assert.Equal(t, os.FileMode(0660), c.SocketMode)
+
+	err = c.SetSocket("/run/authenvoy.sock", "root", "1234", "600")
+	if err != nil {
+		t.Fatalf("could not set socket: %v", err)
+	}
+	assert.Equal(t, 0, c.SocketUID)
+	assert.Equal(t, 1234, c.SocketGID)
+	assert.Equal(t, os.FileMode(0600), c.SocketMode)
+
+	assert.EqualError(t, c.SetSocket("/run/authenvoy.sock", "", "", "rw-rw----"), "socket-mode: must be an octal file mode such as 0660")
+	assert.EqualError(t, c.SetSocket("/run/authenvoy.sock", "", "", "1777"), "socket-mode: must be an octal file mode such as 0660")
+	assert.Error(t, c.SetSocket("/run/authenvoy.sock", "no-such-user-authenvoy", "", DefaultSocketMode))
+}
+
+func TestSetPeerAllowlist(t *testing.T) {
+	c := &Config{}
+	assert.NoError(t, c.SetPeerAllowlist("", ""))
+	assert.False(t, c.PeerRestricted())
+	assert.True(t, c.PeerAllowed(1000, 1000), "any caller should be allowed without an allowlist")
+	assert.EqualError(t, c.SetPeerAllowlist("1000", ""), "allow-uids: peer credentials can only be checked when listening on a socket")
+
+	c.Socket = "/run/authenvoy.sock"
+	err := c.SetPeerAllowlist("root, 1000", "2000")
+	if err != nil {
+		t.Fatalf("could not set allowlist: %v", err)
+	}
+	assert.Equal(t, []uint32{0, 1000}, c.AllowUIDs)
+	assert.Equal(t, []uint32{2000}, c.AllowGIDs)
+	assert.True(t, c.PeerRestricted())
+	assert.True(t, c.PeerAllowed(1000, 1), "caller should be allowed by user")
+	assert.True(t, c.PeerAllowed(1001, 2000), "caller should be allowed by group")
+	assert.False(t, c.PeerAllowed(1001, 1))
+	assert.Error(t, c.SetPeerAllowlist("", "no-such-group-authenvoy"))
+}
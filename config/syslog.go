@@ -0,0 +1,337 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the syslog facility and app-name.
+const (
+	DefaultSyslogFacility = "daemon"
+	DefaultSyslogAppName  = "authenvoy"
+)
+
+const (
+	// journalSocket is the socket of the systemd journal's native protocol.
+	journalSocket = "/run/systemd/journal/socket"
+	// syslogSDID is the ID of the structured data element of syslog messages. 32473 is the private enterprise number
+	// reserved for documentation and examples by RFC 5612.
+	syslogSDID = "authenvoy@32473"
+	// syslogSeverity is the severity of log lines sent to syslog and the journal, which is informational.
+	syslogSeverity = 6
+	// syslogTimeFormat is the RFC 5424 timestamp format, which allows at most microsecond precision.
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// syslogFacilities are the syslog facility codes keyed by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21,
+	"local6": 22, "local7": 23,
+}
+
+// logNames are the names of the logs, which identify the log of each message sent to syslog or the journal.
+var logNames = map[string]string{
+	AppLog:    "application",
+	AccessLog: "access",
+	EventLog:  "event",
+}
+
+// syslogDestination is a log output that sends lines to syslog or the journal.
+type syslogDestination interface {
+	setSyslog(facility int, appName string)
+}
+
+// isSyslog indicates if the log path is a syslog or journald destination.
+func isSyslog(p string) bool {
+	p = strings.ToLower(p)
+	return strings.HasPrefix(p, "syslog:") || strings.HasPrefix(p, "syslog+") || strings.HasPrefix(p, "journald")
+}
+
+// openSyslog returns a writer sending the lines of the named log to the syslog or journald destination, which is one
+// of:
+//
+// syslog://unix/dev/log - the local syslog daemon's Unix datagram socket at the path
+//
+// syslog://host:port or syslog+udp://host:port - a syslog server over UDP
+//
+// syslog+tcp://host:port - a syslog server over TCP
+//
+// journald - the systemd journal, or journald:///path for a journal socket at another path
+func openSyslog(p, name string) (io.Writer, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog destination %s: %v", p, err)
+	}
+	facility := syslogFacilities[DefaultSyslogFacility]
+	var w io.Writer
+	switch strings.ToLower(u.Scheme) {
+	case "":
+		if strings.ToLower(p) != "journald" {
+			return nil, fmt.Errorf("invalid syslog destination %s", p)
+		}
+		w, err = newJournalWriter(journalSocket, name, facility, DefaultSyslogAppName)
+	case "journald":
+		w, err = newJournalWriter(u.Path, name, facility, DefaultSyslogAppName)
+	case "syslog":
+		if strings.ToLower(u.Host) == "unix" {
+			w, err = newSyslogWriter("unixgram", u.Path, name, facility, DefaultSyslogAppName)
+		} else {
+			w, err = newSyslogWriter("udp", u.Host, name, facility, DefaultSyslogAppName)
+		}
+	case "syslog+udp":
+		w, err = newSyslogWriter("udp", u.Host, name, facility, DefaultSyslogAppName)
+	case "syslog+tcp":
+		w, err = newSyslogWriter("tcp", u.Host, name, facility, DefaultSyslogAppName)
+	default:
+		return nil, fmt.Errorf("unsupported syslog destination %s", p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", p, err)
+	}
+	return w, nil
+}
+
+// SyslogWriter sends each line written to it to syslog as an RFC 5424 message. The line is the message and the
+// structured data names the log it is from. Over TCP messages are framed by octet counting as described in RFC 6587.
+type SyslogWriter struct {
+	network  string
+	addr     string
+	log      string
+	hostname string
+	mux      sync.Mutex
+	conn     net.Conn
+	closed   bool
+	facility int
+	appName  string
+}
+
+func newSyslogWriter(network, addr, log string, facility int, appName string) (*SyslogWriter, error) {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		h = "-"
+	}
+	w := &SyslogWriter{
+		network:  network,
+		addr:     addr,
+		log:      log,
+		hostname: h,
+		facility: facility,
+		appName:  appName,
+	}
+	w.conn, err = net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *SyslogWriter) setSyslog(facility int, appName string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.facility = facility
+	w.appName = appName
+}
+
+// Write sends the line as a syslog message. If sending fails the connection is made again and the message resent once.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	m := w.message(p)
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			w.conn, err = net.Dial(w.network, w.addr)
+			if err != nil {
+				continue
+			}
+		}
+		_, err = w.conn.Write(m)
+		if err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, err
+}
+
+// message formats the line as an RFC 5424 message. The caller must hold the lock.
+func (w *SyslogWriter) message(p []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s log=\"%s\"] ",
+		w.facility*8+syslogSeverity,
+		time.Now().UTC().Format(syslogTimeFormat),
+		w.hostname,
+		w.appName,
+		os.Getpid(),
+		w.log,
+		syslogSDID,
+		w.log,
+	)
+	b.Write(bytes.TrimRight(p, "\n"))
+	if w.network != "tcp" {
+		return b.Bytes()
+	}
+	return append([]byte(fmt.Sprintf("%d ", b.Len())), b.Bytes()...)
+}
+
+// check returns an error if the writer is closed or, after a failed write, cannot connect to syslog again.
+func (w *SyslogWriter) check() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.conn == nil {
+		var err error
+		w.conn, err = net.Dial(w.network, w.addr)
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to syslog.
+func (w *SyslogWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.closed = true
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// JournalWriter sends each line written to it to the systemd journal using its native protocol. The line is the
+// MESSAGE field and the AUTHENVOY_LOG field names the log it is from.
+type JournalWriter struct {
+	socket   string
+	log      string
+	mux      sync.Mutex
+	conn     net.Conn
+	closed   bool
+	facility int
+	appName  string
+}
+
+func newJournalWriter(socket, log string, facility int, appName string) (*JournalWriter, error) {
+	w := &JournalWriter{
+		socket:   socket,
+		log:      log,
+		facility: facility,
+		appName:  appName,
+	}
+	var err error
+	w.conn, err = net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *JournalWriter) setSyslog(facility int, appName string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.facility = facility
+	w.appName = appName
+}
+
+// Write sends the line to the journal. Lines must fit in a single datagram.
+func (w *JournalWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", bytes.TrimRight(p, "\n"))
+	journalField(&b, "PRIORITY", []byte(fmt.Sprint(syslogSeverity)))
+	journalField(&b, "SYSLOG_FACILITY", []byte(fmt.Sprint(w.facility)))
+	journalField(&b, "SYSLOG_IDENTIFIER", []byte(w.appName))
+	journalField(&b, "AUTHENVOY_LOG", []byte(w.log))
+	var err error
+	if w.conn == nil {
+		w.conn, err = net.Dial("unixgram", w.socket)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = w.conn.Write(b.Bytes())
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journalField writes a field in the journal's native format. Values containing a newline are written with their
+// length as a little endian 64 bit integer.
+func journalField(b *bytes.Buffer, k string, v []byte) {
+	if !bytes.ContainsRune(v, '\n') {
+		fmt.Fprintf(b, "%s=%s\n", k, v)
+		return
+	}
+	b.WriteString(k + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(v)))
+	b.Write(v)
+	b.WriteByte('\n')
+}
+
+// check returns an error if the writer is closed or, after a failed write, cannot connect to the journal again.
+func (w *JournalWriter) check() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.conn == nil {
+		var err error
+		w.conn, err = net.Dial("unixgram", w.socket)
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the journal.
+func (w *JournalWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.closed = true
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// SetSyslog sets the facility and app-name of the logs sent to syslog or the journal.
+func (c *Config) SetSyslog(facility, appName string) error {
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("syslog-facility: unknown facility %s", facility)
+	}
+	if appName == "" || len(appName) > 48 || strings.ContainsAny(appName, " \t\n") {
+		return fmt.Errorf("syslog-app-name: must be 1 to 48 characters without spaces")
+	}
+	for _, w := range []interface{}{c.Loggers.applicationOut, c.Loggers.accessOut, c.Loggers.eventOut} {
+		if s, ok := w.(syslogDestination); ok {
+			s.setSyslog(f, appName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc5424 matches the header and structured data of the messages sent to syslog.
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{6}Z \S+ (\S+) \d+ (\S+) \[authenvoy@32473 log="(\w+)"\] (.*)$`)
+
+func listenUnixgram(t *testing.T) (*net.UnixConn, string, func()) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-syslog")
+	p := filepath.Join(dir, "log.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen on %s: %v", p, err)
+	}
+	return l, p, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readDatagram(t *testing.T, c net.PacketConn) string {
+	b := make([]byte, 65536)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestSyslogWriterUnix(t *testing.T) {
+	l, p, cleanup := listenUnixgram(t)
+	defer cleanup()
+	w, err := openSyslog("syslog://unix"+p, logNames[EventLog])
+	if err != nil {
+		t.Fatalf("could not open syslog: %v", err)
+	}
+	defer w.(*SyslogWriter).Close()
+
+	_, err = w.Write([]byte(`{"EventID":"abc"}` + "\n"))
+	assert.NoError(t, err)
+	m := rfc5424.FindStringSubmatch(readDatagram(t, l))
+	if m == nil {
+		t.Fatal("message not in RFC 5424 format")
+	}
+	assert.Equal(t, "30", m[1], "priority should be daemon.info")
+	assert.Equal(t, DefaultSyslogAppName, m[2])
+	assert.Equal(t, "event", m[3])
+	assert.Equal(t, "event", m[4])
+	assert.Equal(t, `{"EventID":"abc"}`, m[5], "JSON payload should be preserved")
+
+	w.(*SyslogWriter).setSyslog(syslogFacilities["local3"], "envoy")
+	w.Write([]byte("line\n"))
+	m = rfc5424.FindStringSubmatch(readDatagram(t, l))
+	if m == nil {
+		t.Fatal("message not in RFC 5424 format")
+	}
+	assert.Equal(t, "158", m[1], "priority should be local3.info")
+	assert.Equal(t, "envoy", m[2])
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	w, err := openSyslog("syslog+tcp://"+l.Addr().String(), logNames[AccessLog])
+	if err != nil {
+		t.Fatalf("could not open syslog: %v", err)
+	}
+	defer w.(*SyslogWriter).Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	defer conn.Close()
+
+	lines := []string{`{"Method":"POST"}`, `{"Method":"GET"}`}
+	for _, line := range lines {
+		_, err = fmt.Fprintln(w, line)
+		assert.NoError(t, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, line := range lines {
+		// Messages are framed by octet counting
+		ls, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatalf("could not read message length: %v", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(ls))
+		if err != nil {
+			t.Fatalf("invalid message length %q", ls)
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		m := rfc5424.FindStringSubmatch(string(b))
+		if m == nil {
+			t.Fatalf("message not in RFC 5424 format: %s", b)
+		}
+		assert.Equal(t, "access", m[4])
+		assert.Equal(t, line, m[5])
+	}
+}
+
+func TestSyslogWriterUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	w, err := openSyslog("syslog+udp://"+l.LocalAddr().String(), logNames[AppLog])
+	if err != nil {
+		t.Fatalf("could not open syslog: %v", err)
+	}
+	defer w.(*SyslogWriter).Close()
+	fmt.Fprintln(w, "started")
+	m := rfc5424.FindStringSubmatch(readDatagram(t, l))
+	if m == nil {
+		t.Fatal("message not in RFC 5424 format")
+	}
+	assert.Equal(t, "application", m[4])
+	assert.Equal(t, "started", m[5])
+}
+
+func TestJournalWriter(t *testing.T) {
+	l, p, cleanup := listenUnixgram(t)
+	defer cleanup()
+	w, err := openSyslog("journald://"+p, logNames[EventLog])
+	if err != nil {
+		t.Fatalf("could not open journal: %v", err)
+	}
+	defer w.(*JournalWriter).Close()
+
+	fmt.Fprintln(w, `{"EventID":"abc"}`)
+	assert.Equal(t, "MESSAGE={\"EventID\":\"abc\"}\nPRIORITY=6\nSYSLOG_FACILITY=3\nSYSLOG_IDENTIFIER=authenvoy\n"+
+		"AUTHENVOY_LOG=event\n", readDatagram(t, l))
+
+	// Values containing a newline are length prefixed
+	fmt.Fprintln(w, "two\nlines")
+	d := []byte(readDatagram(t, l))
+	assert.True(t, bytes.HasPrefix(d, []byte("MESSAGE\n")))
+	n := binary.LittleEndian.Uint64(d[8:16])
+	assert.Equal(t, "two\nlines", string(d[16:16+n]))
+}
+
+func TestOpenSyslogInvalid(t *testing.T) {
+	for _, p := range []string{"journaldx", "syslog+sctp://127.0.0.1:514", "syslog://unix/does/not/exist"} {
+		_, err := openSyslog(p, "event")
+		assert.Error(t, err, "destination %s", p)
+	}
+}
+
+func TestSetSyslog(t *testing.T) {
+	l, p, cleanup := listenUnixgram(t)
+	defer cleanup()
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	c, err := New(8020, cf.Name(), "syslog://unix"+p, "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	defer c.CloseLogs()
+	assert.Error(t, c.SetSyslog("nosuch", DefaultSyslogAppName))
+	assert.Error(t, c.SetSyslog("auth", "app name"))
+	assert.NoError(t, c.SetSyslog("AUTH", "envoy"))
+
+	c.EventLog(map[string]string{"EventID": "abc"})
+	m := rfc5424.FindStringSubmatch(readDatagram(t, l))
+	if m == nil {
+		t.Fatal("message not in RFC 5424 format")
+	}
+	assert.Equal(t, "38", m[1], "priority should be auth.info")
+	assert.Equal(t, "envoy", m[2])
+	assert.Equal(t, "event", m[4])
+	assert.Equal(t, `{"EventID":"abc"}`, m[5])
+}
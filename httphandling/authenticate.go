@@ -1,6 +1,7 @@
 package httphandling
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,22 +13,29 @@ import (
 	"github.com/jcmturner/authenvoy/identity"
 	"github.com/jcmturner/gokrb5/v8/client"
 	"github.com/jcmturner/gokrb5/v8/crypto"
-	"github.com/jcmturner/gokrb5/v8/iana/adtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
 	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
 	"github.com/jcmturner/gokrb5/v8/messages"
-	"github.com/jcmturner/gokrb5/v8/pac"
 	"github.com/jcmturner/gokrb5/v8/types"
 )
 
-func authenticate(c *config.Config) http.HandlerFunc {
+// lrTypePasswordExpiration is the last request type for the time at which the password expires.
+const lrTypePasswordExpiration = 6
+
+// errKDCUnavailable is returned when no KDC for the realm can be contacted.
+var errKDCUnavailable = errors.New("KDC unavailable")
+
+func authenticate(c *config.Config, b *kdcBreaker, x *kdcLimiter, s *sessionStore, l *rateLimiter, n *negativeCache) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests finish with the configuration current when they started, even if it is reloaded
+		c := c.Current()
 		creds, err := credsFromPost(c, r)
 		if err != nil {
 			c.ApplicationLogf("bad request: %v", err)
 			respondGeneric(w, http.StatusBadRequest, "posted data invalid")
 			return
 		}
-		event, err := newEvent(creds.LoginName, creds.Domain)
+		event, err := newEvent(r, actionAuthenticate, creds.LoginName, creds.Domain)
 		if err != nil {
 			c.ApplicationLogf("error generating new event: %v", err)
 			respondGeneric(w, http.StatusInternalServerError, "Error processing request")
@@ -35,10 +43,50 @@ func authenticate(c *config.Config) http.HandlerFunc {
 		}
 		event.Message = "new authentication request"
 		c.EventLog(event)
-		id := krbValidate(c, creds, event)
+		if ok, limit, retry := l.allow(creds, callerSource(r)); !ok {
+			rateLimitEvent(c, &event, limit, retry)
+			authenticationMetric(c, creds.Domain, config.OutcomeRefused, event.FailureReason)
+			respondRateLimited(w, c, event, limit, retry)
+			return
+		}
+		ctx, cancel := x.context(r)
+		defer cancel()
+		var id identity.Identity
+		var k messages.ASRep
+		var reason identity.FailureReason
+		var verr error
+		// A change of an expired password is waited for once it has been sent so that the caller learns if the password
+		// was changed
+		err = x.exchangeCommit(ctx, func(commit func() bool) {
+			id, k, reason, verr = krbValidate(ctx, commit, c, b, l, n, creds, event)
+		})
+		if err != nil {
+			exchangeErrEvent(c, event, err)
+			authenticationMetric(c, creds.Domain, config.OutcomeError, identity.FailureReason(exchangeErrReasons[err]))
+			respondExchangeErr(w, err)
+			return
+		}
+		if verr == errKDCUnavailable {
+			authenticationMetric(c, creds.Domain, config.OutcomeError, identity.ReasonKDCUnreachable)
+			respondKDCUnavailable(w, b, id)
+			return
+		}
+		if id.Valid {
+			authenticationMetric(c, creds.Domain, config.OutcomeSuccess, "")
+		} else {
+			authenticationMetric(c, creds.Domain, config.OutcomeFailure, reason)
+		}
+		authorize(c, &id, creds.Audience, event)
+		issueToken(c, &id, creds.Audience)
+		if id.Valid && id.Authorized {
+			s.add(id, creds.Audience, k, event.Peer)
+		}
 		code := http.StatusUnauthorized
 		if id.Valid {
 			code = http.StatusAccepted
+			if !id.Authorized {
+				code = http.StatusForbidden
+			}
 		}
 		respondWithJSON(w, code, id)
 		return
@@ -47,12 +95,15 @@ func authenticate(c *config.Config) http.HandlerFunc {
 
 func credsFromPost(c *config.Config, r *http.Request) (creds identity.Credentials, err error) {
 	switch r.Header.Get("Content-Type") {
-	case "application/json":
-		return credsJSON(c, r)
 	case "application/x-www-form-urlencoded":
-		return credsForm(c, r)
+		creds, err = credsForm(c, r)
+	default:
+		creds, err = credsJSON(c, r)
 	}
-	return credsJSON(c, r)
+	// The domain is given as the realm of the krb5.conf so that it is recorded and limited the same way however the
+	// caller capitalised it
+	creds.Domain, _ = c.Realm(creds.Domain)
+	return
 }
 
 func credsJSON(c *config.Config, r *http.Request) (creds identity.Credentials, err error) {
@@ -88,10 +139,18 @@ func credsForm(c *config.Config, r *http.Request) (creds identity.Credentials, e
 	creds.LoginName = l
 	creds.Domain = d
 	creds.Password = p
+	creds.NewPassword = r.FormValue("new-password")
+	creds.Audience = r.FormValue("audience")
+	creds.ClientIP = r.FormValue("client-ip")
 	return
 }
 
-func krbValidate(c *config.Config, creds identity.Credentials, event eventLog) identity.Identity {
+// krbValidate validates the credentials with the KDC. The AS_REP of a successful login is returned so the TGT can be
+// kept for the session. The outcome of the login is recorded with the rate limiter for the soft lockout. A password
+// recently rejected by the KDC is answered from the negative cache without contacting the KDC. No further exchanges
+// are started once the context is done. An expired password is only changed if commit, which makes the caller wait for
+// the outcome, returns true. The reason for a failure is returned even if it is hidden from the caller.
+func krbValidate(ctx context.Context, commit func() bool, c *config.Config, b *kdcBreaker, l *rateLimiter, n *negativeCache, creds identity.Credentials, event eventLog) (identity.Identity, messages.ASRep, identity.FailureReason, error) {
 	id := identity.Identity{
 		Domain:      creds.Domain,
 		LoginName:   creds.LoginName,
@@ -99,51 +158,160 @@ func krbValidate(c *config.Config, creds identity.Credentials, event eventLog) i
 		SessionID:   event.EventID,
 	}
 
+	if !c.KnownRealm(creds.Domain) {
+		// Not passed to the KDC or the circuit breaker as no KDC of the realm can be found
+		event.FailureReason = identity.ReasonUnknownRealm
+		if !c.HideFailureReason {
+			id.FailureReason = event.FailureReason
+		}
+		validationErrEvent(c, &event, fmt.Errorf("validation of credentials not attempted - unknown realm %s", creds.Domain))
+		return id, messages.ASRep{}, event.FailureReason, nil
+	}
+
+	if e, ok := n.lookup(creds); ok {
+		event.FailureReason, event.KRBErrorCode = e.reason, e.krbErrorCode
+		event.NegativeCache = true
+		if !c.HideFailureReason {
+			id.FailureReason = event.FailureReason
+		}
+		validationErrEvent(c, &event, errors.New("validation of credentials failed - password recently rejected by the KDC, answered from negative cache"))
+		return id, messages.ASRep{}, event.FailureReason, nil
+	}
+
+	if ctx.Err() != nil {
+		return id, messages.ASRep{}, event.FailureReason, contextErr(ctx)
+	}
+	if !b.allow(creds.Domain) {
+		event.FailureReason = identity.ReasonKDCUnreachable
+		validationErrEvent(c, &event, fmt.Errorf("validation of credentials not attempted - KDC circuit breaker open for realm %s", creds.Domain))
+		return id, messages.ASRep{}, event.FailureReason, errKDCUnavailable
+	}
+
 	//Set up krb client
 	cl := client.NewWithPassword(creds.LoginName, creds.Domain, creds.Password, c.KRB5Conf, client.DisablePAFXFAST(true))
 	defer cl.Destroy() // Client no longer needed so destroy it.
 
 	//Login the client
-	k, err := login(cl)
+	k, err := login(c, cl)
+	if err != nil {
+		if r, _ := failureReason(err); r == identity.ReasonPasswordExpired && creds.NewPassword != "" {
+			// The KDC will issue a kadmin/changepw ticket using the expired password.
+			// The outcome for the circuit breaker is recorded by the password change
+			if !commit() {
+				return id, k, event.FailureReason, contextErr(ctx)
+			}
+			pc, perr := changePasswd(c, b, l, cl, creds, event)
+			if perr == errKDCUnavailable {
+				return id, k, event.FailureReason, perr
+			}
+			id.PasswordChange = &pc
+			if pc.Changed {
+				// The client now holds the new password
+				k, err = login(c, cl)
+			}
+		}
+	}
 	if err != nil {
+		event.FailureReason, event.KRBErrorCode = failureReason(err)
+		if !c.HideFailureReason {
+			id.FailureReason = event.FailureReason
+			id.PasswordExpired = event.FailureReason == identity.ReasonPasswordExpired
+		}
 		err = fmt.Errorf("validation of credentials failed - login error: %v", err)
 		validationErrEvent(c, &event, err)
-		return id
+		if event.FailureReason == identity.ReasonKDCUnreachable {
+			b.failure(creds.Domain)
+			return id, k, event.FailureReason, errKDCUnavailable
+		}
+		b.success(creds.Domain)
+		if event.FailureReason == identity.ReasonInvalidCredentials {
+			n.add(creds, event.FailureReason, event.KRBErrorCode)
+		}
+		if l.result(creds, event.FailureReason) {
+			lockoutEvent(c, event)
+		}
+		return id, k, event.FailureReason, nil
+	}
+	b.success(creds.Domain)
+	l.result(creds, "")
+	n.purge(creds)
+	if ctx.Err() != nil {
+		return id, k, event.FailureReason, contextErr(ctx)
+	}
+	//Protect against a spoofed KDC by proving it knows the service's key
+	var svcTkt messages.Ticket
+	if c.VerifyKDC {
+		svcTkt, err = verifiedServiceTicket(c, cl, k)
+		if err != nil {
+			event.FailureReason = identity.ReasonKDCNotVerified
+			if !c.HideFailureReason {
+				id.FailureReason = event.FailureReason
+			}
+			err = fmt.Errorf("validation of credentials failed - KDC could not be verified: %v", err)
+			validationErrEvent(c, &event, err)
+			return id, k, event.FailureReason, nil
+		}
 	}
 	//Login completed without error so user is valid
 	id.Valid = true
 	id.AuthTime = k.DecryptedEncPart.AuthTime
 	id.Expiry = k.DecryptedEncPart.EndTime
+	id.RenewTill = k.DecryptedEncPart.RenewTill
+	id.PasswordExpiry = passwordExpiry(k.DecryptedEncPart)
 	event.Time = k.DecryptedEncPart.AuthTime
 	validationSuccessEvent(c, &event)
 
+	if c.Keytab != nil && c.ServicePrincipal != "" {
+		//Get additional identity info from a ticket issued to the service so the PAC can be verified with its key
+		if !c.VerifyKDC {
+			svcTkt, err = verifiedServiceTicket(c, cl, k)
+			if err != nil {
+				err = fmt.Errorf("getting identity info failed - %v", err)
+				validationErrEvent(c, &event, err)
+				return id, k, event.FailureReason, nil
+			}
+		}
+		err = addVerifiedIdentityInfo(&id, creds, svcTkt, c)
+		if err != nil {
+			err = fmt.Errorf("getting identity info failed - could not get identity information: %v", err)
+			validationErrEvent(c, &event, err)
+			return id, k, event.FailureReason, nil
+		}
+		pacEvent(c, &event, id.PACStatus)
+		return id, k, event.FailureReason, nil
+	}
+
 	//Get a service ticket to itself
+	if ctx.Err() != nil {
+		return id, k, event.FailureReason, contextErr(ctx)
+	}
 	tgsReq, err := messages.NewUser2UserTGSReq(k.CName, k.CRealm, cl.Config, k.Ticket, k.DecryptedEncPart.Key, k.CName, false, k.Ticket)
 	if err != nil {
 		err = fmt.Errorf("getting identity info failed - error generating TGS_REQ: %v", err)
 		validationErrEvent(c, &event, err)
-		return id
+		return id, k, event.FailureReason, nil
 	}
-	_, tgsRep, err := cl.TGSExchange(tgsReq, k.CRealm, k.Ticket, k.DecryptedEncPart.Key, 0)
+	tgsRep, err := tgsExchange(c, cl, tgsReq, k.CRealm, k.Ticket, k.DecryptedEncPart.Key)
 	if err != nil {
 		err = fmt.Errorf("getting identity info failed - service ticket error: %v", err)
 		validationErrEvent(c, &event, err)
-		return id
+		return id, k, event.FailureReason, nil
 	}
 	err = ticketDecrypt(&tgsRep.Ticket, k.DecryptedEncPart.Key)
 	if err != nil {
 		err = fmt.Errorf("getting identity info failed - could decrypt service ticket: %v", err)
 		validationErrEvent(c, &event, err)
-		return id
+		return id, k, event.FailureReason, nil
 	}
 	//Get additional identity info from service ticket
 	err = addIdentityInfo(&id, creds, tgsRep.Ticket, k.DecryptedEncPart.Key, c)
 	if err != nil {
 		err = fmt.Errorf("getting identity info failed - could not get identity information: %v", err)
 		validationErrEvent(c, &event, err)
-		return id
+		return id, k, event.FailureReason, nil
 	}
-	return id
+	pacEvent(c, &event, id.PACStatus)
+	return id, k, event.FailureReason, nil
 }
 
 func validationErrEvent(c *config.Config, event *eventLog, err error) {
@@ -161,7 +329,15 @@ func validationSuccessEvent(c *config.Config, event *eventLog) {
 	c.EventLog(*event)
 }
 
-func login(cl *client.Client) (messages.ASRep, error) {
+func pacEvent(c *config.Config, event *eventLog, status identity.PACStatus) {
+	event.Message = fmt.Sprintf("identity information added - PAC status: %s", status)
+	event.PACStatus = status
+	event.Time = time.Now().UTC()
+	c.EventLog(*event)
+}
+
+// login performs the AS exchange for a TGT. If a renew lifetime is configured a renewable TGT is requested.
+func login(c *config.Config, cl *client.Client) (messages.ASRep, error) {
 	if ok, err := cl.IsConfigured(); !ok {
 		return messages.ASRep{}, err
 	}
@@ -169,7 +345,48 @@ func login(cl *client.Client) (messages.ASRep, error) {
 	if err != nil {
 		return messages.ASRep{}, fmt.Errorf("error generating new AS_REQ: %v", err)
 	}
-	return cl.ASExchange(cl.Credentials.Domain(), ASReq, 0)
+	if c.RenewLifetime > 0 {
+		types.SetFlag(&ASReq.ReqBody.KDCOptions, flags.Renewable)
+		ASReq.ReqBody.RTime = time.Now().UTC().Add(c.RenewLifetime)
+	}
+	return asExchange(c, cl, cl.Credentials.Domain(), ASReq)
+}
+
+// passwordExpiry returns the password expiration time from the AS_REP's last request information, falling back to
+// the deprecated key-expiration field. A zero time is returned if the KDC did not provide one.
+func passwordExpiry(ep messages.EncKDCRepPart) time.Time {
+	for _, lr := range ep.LastReqs {
+		// RFC 4120 5.4.2: a negative lr-type indicates the information pertains only to the responding server.
+		if lr.LRType == lrTypePasswordExpiration || lr.LRType == -lrTypePasswordExpiration {
+			return lr.LRValue
+		}
+	}
+	return ep.KeyExpiration
+}
+
+// verifiedServiceTicket obtains a service ticket for the configured service principal using the TGT from the login and
+// decrypts it with the key from the service's keytab. Only the genuine KDC knows this key so a successful decryption
+// proves that the AS exchange was not with a spoofed KDC.
+func verifiedServiceTicket(c *config.Config, cl *client.Client, k messages.ASRep) (messages.Ticket, error) {
+	spn, _ := types.ParseSPNString(c.ServicePrincipal)
+	tgsReq, err := messages.NewTGSReq(k.CName, k.CRealm, cl.Config, k.Ticket, k.DecryptedEncPart.Key, spn, false)
+	if err != nil {
+		return messages.Ticket{}, fmt.Errorf("error generating TGS_REQ: %v", err)
+	}
+	tgsRep, err := tgsExchange(c, cl, tgsReq, k.CRealm, k.Ticket, k.DecryptedEncPart.Key)
+	if err != nil {
+		return messages.Ticket{}, fmt.Errorf("service ticket error: %v", err)
+	}
+	tkt := tgsRep.Ticket
+	err = tkt.DecryptEncPart(c.Keytab, &spn)
+	if err != nil {
+		return tkt, fmt.Errorf("could not decrypt service ticket with keytab: %v", err)
+	}
+	if !tkt.DecryptedEncPart.CName.Equal(k.CName) || tkt.DecryptedEncPart.CRealm != k.CRealm {
+		return tkt, fmt.Errorf("service ticket issued to %s@%s not %s@%s", tkt.DecryptedEncPart.CName.PrincipalNameString(),
+			tkt.DecryptedEncPart.CRealm, k.CName.PrincipalNameString(), k.CRealm)
+	}
+	return tkt, nil
 }
 
 func ticketDecrypt(tkt *messages.Ticket, key types.EncryptionKey) error {
@@ -185,47 +402,3 @@ func ticketDecrypt(tkt *messages.Ticket, key types.EncryptionKey) error {
 	tkt.DecryptedEncPart = denc
 	return nil
 }
-
-func addIdentityInfo(id *identity.Identity, creds identity.Credentials, tkt messages.Ticket, key types.EncryptionKey, c *config.Config) error {
-	isPAC, pacInfo, err := getPAC(tkt, key, c)
-	if isPAC && err != nil {
-		return err
-	}
-	if isPAC {
-		// There is a valid PAC. Adding attributes to creds
-		dn := creds.LoginName
-		if pacInfo.KerbValidationInfo.FullName.String() != "" {
-			dn = pacInfo.KerbValidationInfo.FullName.String()
-		}
-		id.DisplayName = dn
-		id.Groups = pacInfo.KerbValidationInfo.GetGroupMembershipSIDs()
-	}
-	return nil
-}
-
-func getPAC(tkt messages.Ticket, key types.EncryptionKey, c *config.Config) (bool, pac.PACType, error) {
-	var isPAC bool
-	for _, ad := range tkt.DecryptedEncPart.AuthorizationData {
-		if ad.ADType == adtype.ADIfRelevant {
-			var ad2 types.AuthorizationData
-			err := ad2.Unmarshal(ad.ADData)
-			if err != nil {
-				continue
-			}
-			if ad2 == nil || len(ad2) < 1 {
-				continue
-			}
-			if ad2[0].ADType == adtype.ADWin2KPAC {
-				isPAC = true
-				var p pac.PACType
-				err = p.Unmarshal(ad2[0].ADData)
-				if err != nil {
-					return isPAC, p, fmt.Errorf("error unmarshaling PAC: %v", err)
-				}
-				err = p.ProcessPACInfoBuffers(key, c.Loggers.ApplicationWriter)
-				return isPAC, p, err
-			}
-		}
-	}
-	return isPAC, pac.PACType{}, nil
-}
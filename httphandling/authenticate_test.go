@@ -8,10 +8,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jcmturner/authenvoy/config"
 	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,7 +51,7 @@ func TestAuthenticateSuccess(t *testing.T) {
 	defer os.Remove(cf.Name())
 	cf.WriteString(krb5Conf)
 
-	c, err := config.New(8020, cf.Name(), "stdout")
+	c, err := config.New(8020, cf.Name(), "stdout", "")
 	if err != nil {
 		t.Fatalf("could not create new config: %v", err)
 	}
@@ -94,7 +97,7 @@ func TestAuthenticateFailure(t *testing.T) {
 	defer os.Remove(cf.Name())
 	cf.WriteString(krb5Conf)
 
-	c, err := config.New(8020, cf.Name(), "stdout")
+	c, err := config.New(8020, cf.Name(), "stdout", "")
 	if err != nil {
 		t.Fatalf("could not create new config: %v", err)
 	}
@@ -130,3 +133,103 @@ func TestAuthenticateFailure(t *testing.T) {
 	assert.Equal(t, "TEST.GOKRB5", i.Domain)
 	assert.NotEqual(t, "", i.SessionID)
 }
+
+func TestAuthenticateKDCUnavailable(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	// Point the realm at a port nothing is listening on
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.KDCFailureThreshold = 2
+	c.KDCCoolDown = time.Minute
+	rt := NewRouter(c)
+
+	cred := identity.Credentials{
+		LoginName: "testuser1",
+		Domain:    "TEST.GOKRB5",
+		Password:  "passwordvalue",
+	}
+	pb, _ := json.Marshal(cred)
+	url := fmt.Sprintf("/%s/authenticate", APIVersion)
+	for i := 0; i < 3; i++ {
+		request, err := http.NewRequest("POST", url, bytes.NewReader(pb))
+		if err != nil {
+			t.Fatalf("error building request: %v", err)
+		}
+		response := httptest.NewRecorder()
+		rt.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Expected 503 Service Unavailable")
+		var r JSONKDCUnavailableResponse
+		err = json.Unmarshal(response.Body.Bytes(), &r)
+		if err != nil {
+			t.Fatalf("Response cannot be unmarshaled: %v", err)
+		}
+		assert.Equal(t, "TEST.GOKRB5", r.Domain)
+		assert.Equal(t, "testuser1", r.LoginName)
+		// The second failure opens the circuit so the third request fails fast
+		assert.Equal(t, i > 0, r.CircuitOpen)
+		assert.Equal(t, i > 0, response.Header().Get("Retry-After") != "")
+	}
+}
+
+func TestAuthenticateUnknownRealm(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.KDCFailureThreshold = 1
+	c.KDCCoolDown = time.Minute
+	b := newKDCBreaker(c)
+	h := authenticate(c, b, newKDCLimiter(c), newSessionStore(c), newRateLimiter(c), newNegativeCache(c))
+
+	for _, test := range []struct {
+		domain string
+		code   int
+		realm  string
+		reason identity.FailureReason
+	}{
+		{"NOT.A.REALM", http.StatusUnauthorized, "NOT.A.REALM", identity.ReasonUnknownRealm},
+		// Domains are matched to the krb5.conf realms ignoring case
+		{"test.gokrb5", http.StatusServiceUnavailable, "TEST.GOKRB5", ""},
+	} {
+		pb, _ := json.Marshal(identity.Credentials{
+			LoginName: "testuser1",
+			Domain:    test.domain,
+			Password:  "passwordvalue",
+		})
+		request, _ := http.NewRequest("POST", "/"+APIVersion+"/authenticate", bytes.NewReader(pb))
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		assert.Equal(t, test.code, response.Code, "domain %s", test.domain)
+		var i identity.Identity
+		json.Unmarshal(response.Body.Bytes(), &i)
+		assert.Equal(t, test.realm, i.Domain)
+		assert.Equal(t, test.reason, i.FailureReason)
+	}
+
+	// Only the configured realm has a circuit breaker
+	st := b.status()
+	assert.Len(t, st, 1)
+	assert.Equal(t, BreakerOpen, st["TEST.GOKRB5"].State)
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	ke := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	pe := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	ep := messages.EncKDCRepPart{KeyExpiration: ke}
+	assert.Equal(t, ke, passwordExpiry(ep), "key expiration should be used when there are no last requests")
+
+	ep.LastReqs = []messages.LastReq{
+		{LRType: 7, LRValue: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{LRType: -lrTypePasswordExpiration, LRValue: pe},
+	}
+	assert.Equal(t, pe, passwordExpiry(ep), "password expiration last request should be used")
+}
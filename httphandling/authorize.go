@@ -0,0 +1,39 @@
+package httphandling
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+)
+
+// authorize evaluates the authorization policy for the audience against a validated identity.
+// If no policies are configured every valid identity is authorized.
+func authorize(c *config.Config, id *identity.Identity, audience string, event eventLog) {
+	if !id.Valid {
+		return
+	}
+	if c.Policies == nil {
+		id.Authorized = true
+		return
+	}
+	// Policies can refer to groups by SID or by mapped name
+	groups := append(append([]string{}, id.Groups...), id.GroupNames...)
+	id.Authorized, id.AuthorizationRule = c.Policies.Evaluate(audience, id.Domain, groups, time.Now().UTC())
+	if audience == "" {
+		audience = config.DefaultAudience
+	}
+	event.Audience = audience
+	event.AuthorizationRule = id.AuthorizationRule
+	event.AuthorizationDenied = !id.Authorized
+	event.Validated = true
+	event.ValidationSuccessful = true
+	event.Time = time.Now().UTC()
+	if id.Authorized {
+		event.Message = fmt.Sprintf("authorized for audience %s", audience)
+	} else {
+		event.Message = fmt.Sprintf("authorization denied for audience %s by rule %s", audience, id.AuthorizationRule)
+	}
+	c.EventLog(event)
+}
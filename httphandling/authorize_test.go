@@ -0,0 +1,59 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	c := &config.Config{Keytab: keytab.New()}
+	c.SetApplicationLog("null")
+	b := new(bytes.Buffer)
+	c.SetEventLogWriter(json.NewEncoder(b))
+	event, _ := newEvent(httptest.NewRequest("POST", "/v1/authenticate", nil), actionAuthenticate, "testuser1", "USER.GOKRB5")
+
+	// Without policies valid identities are authorized
+	id := identity.Identity{Valid: true, Domain: "USER.GOKRB5"}
+	authorize(c, &id, "", event)
+	assert.True(t, id.Authorized)
+	id = identity.Identity{Domain: "USER.GOKRB5"}
+	authorize(c, &id, "", event)
+	assert.False(t, id.Authorized, "invalid identity should not be authorized")
+
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-policy.json")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"payroll": {"RequiredGroups": ["Finance"]}}`)
+	err := c.SetPolicies(f.Name())
+	if err != nil {
+		t.Fatalf("could not load policies: %v", err)
+	}
+
+	id = identity.Identity{Valid: true, Domain: "USER.GOKRB5", GroupNames: []string{"Finance"}}
+	authorize(c, &id, "payroll", event)
+	assert.True(t, id.Authorized)
+	assert.Equal(t, config.RuleAllowed, id.AuthorizationRule)
+
+	b.Reset()
+	id = identity.Identity{Valid: true, Domain: "USER.GOKRB5", UnverifiedGroups: []string{"Finance"}}
+	authorize(c, &id, "payroll", event)
+	assert.False(t, id.Authorized, "unverified groups should not authorize")
+	assert.Equal(t, config.RuleRequiredGroups, id.AuthorizationRule)
+	var e eventLog
+	err = json.NewDecoder(b).Decode(&e)
+	if err != nil {
+		t.Fatalf("could not decode event: %v", err)
+	}
+	assert.True(t, e.AuthorizationDenied, "denial should be recorded in the event")
+	assert.True(t, e.ValidationSuccessful)
+	assert.Equal(t, "payroll", e.Audience)
+	assert.Equal(t, config.RuleRequiredGroups, e.AuthorizationRule)
+}
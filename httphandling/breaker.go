@@ -0,0 +1,131 @@
+package httphandling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerStatus reports the state of the KDC circuit breaker for a realm.
+type BreakerStatus struct {
+	State     string    `json:"State"`
+	Failures  int       `json:"Failures"`
+	OpenedAt  time.Time `json:"OpenedAt"`
+	RetryTime time.Time `json:"RetryTime"`
+}
+
+// kdcBreaker is a circuit breaker per realm that fails fast for a cool down period after repeated failures to
+// contact a KDC of the realm.
+type kdcBreaker struct {
+	c      *config.Config
+	mux    sync.Mutex
+	realms map[string]*BreakerStatus
+}
+
+func newKDCBreaker(c *config.Config) *kdcBreaker {
+	return &kdcBreaker{
+		c:      c,
+		realms: make(map[string]*BreakerStatus),
+	}
+}
+
+// enabled indicates if the circuit breaker has been configured.
+func (b *kdcBreaker) enabled() bool {
+	return b.c.Current().KDCFailureThreshold > 0
+}
+
+// allow indicates if a request to the realm's KDC should be attempted.
+// When the cool down period of an open breaker has passed a single trial request is allowed.
+func (b *kdcBreaker) allow(realm string) bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	s, ok := b.realms[realm]
+	if !ok {
+		return true
+	}
+	switch s.State {
+	case BreakerOpen:
+		if time.Now().UTC().Before(s.RetryTime) {
+			return false
+		}
+		s.State = BreakerHalfOpen
+		b.c.ApplicationLogf("KDC circuit breaker for realm %s half-open: trying KDC", realm)
+		return true
+	case BreakerHalfOpen:
+		// A trial request is already in progress.
+		return false
+	}
+	return true
+}
+
+// retryTime returns the time after which requests to the realm's KDC will be attempted again.
+func (b *kdcBreaker) retryTime(realm string) time.Time {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if s, ok := b.realms[realm]; ok {
+		return s.RetryTime
+	}
+	return time.Time{}
+}
+
+// success records that the realm's KDC answered.
+func (b *kdcBreaker) success(realm string) {
+	if !b.enabled() {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	s, ok := b.realms[realm]
+	if !ok {
+		return
+	}
+	if s.State != BreakerClosed {
+		b.c.ApplicationLogf("KDC circuit breaker for realm %s closed: KDC reachable", realm)
+	}
+	delete(b.realms, realm)
+}
+
+// failure records that no KDC of the realm could be contacted.
+func (b *kdcBreaker) failure(realm string) {
+	if !b.enabled() {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	s, ok := b.realms[realm]
+	if !ok {
+		s = &BreakerStatus{State: BreakerClosed}
+		b.realms[realm] = s
+	}
+	s.Failures++
+	if s.State == BreakerHalfOpen || s.Failures >= b.c.Current().KDCFailureThreshold {
+		if s.State != BreakerOpen {
+			b.c.ApplicationLogf("KDC circuit breaker for realm %s open after %d failures: failing fast for %v", realm, s.Failures, b.c.Current().KDCCoolDown)
+		}
+		s.State = BreakerOpen
+		s.OpenedAt = time.Now().UTC()
+		s.RetryTime = s.OpenedAt.Add(b.c.Current().KDCCoolDown)
+	}
+}
+
+// status returns the state of the circuit breaker for each realm that has recorded KDC failures.
+func (b *kdcBreaker) status() map[string]BreakerStatus {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	m := make(map[string]BreakerStatus)
+	for r, s := range b.realms {
+		m[r] = *s
+	}
+	return m
+}
@@ -0,0 +1,53 @@
+package httphandling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKDCBreaker(t *testing.T) {
+	c := &config.Config{
+		KDCFailureThreshold: 2,
+		KDCCoolDown:         time.Millisecond * 100,
+	}
+	c.SetApplicationLog("null")
+	b := newKDCBreaker(c)
+	realm := "TEST.GOKRB5"
+
+	assert.True(t, b.allow(realm), "breaker should allow initially")
+	b.failure(realm)
+	assert.True(t, b.allow(realm), "breaker should allow below the threshold")
+	b.failure(realm)
+	assert.False(t, b.allow(realm), "breaker should be open at the threshold")
+	assert.Equal(t, BreakerOpen, b.status()[realm].State)
+	assert.True(t, b.allow("OTHER.GOKRB5"), "breaker should be per realm")
+
+	// After the cool down a single trial is allowed
+	time.Sleep(c.KDCCoolDown)
+	assert.True(t, b.allow(realm), "breaker should allow a trial after the cool down")
+	assert.Equal(t, BreakerHalfOpen, b.status()[realm].State)
+	assert.False(t, b.allow(realm), "breaker should only allow one trial")
+
+	// A failed trial reopens the breaker
+	b.failure(realm)
+	assert.False(t, b.allow(realm), "breaker should reopen after a failed trial")
+
+	// A successful trial closes the breaker
+	time.Sleep(c.KDCCoolDown)
+	assert.True(t, b.allow(realm))
+	b.success(realm)
+	assert.True(t, b.allow(realm), "breaker should close after a successful trial")
+	assert.Empty(t, b.status())
+}
+
+func TestKDCBreakerDisabled(t *testing.T) {
+	c := &config.Config{}
+	b := newKDCBreaker(c)
+	for i := 0; i < 10; i++ {
+		b.failure("TEST.GOKRB5")
+	}
+	assert.True(t, b.allow("TEST.GOKRB5"), "disabled breaker should always allow")
+}
@@ -0,0 +1,67 @@
+package httphandling
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+)
+
+// krbErrorCodeRegexp matches the error code in the string form of a messages.KRBError.
+// gokrb5 wraps the KRBError returned by the KDC in a krberror.Krberror which only retains its text.
+var krbErrorCodeRegexp = regexp.MustCompile(`KRB Error: \((\d+)\)`)
+
+// krbErrorCode returns the error code of the KRB_ERROR returned by the KDC if the error contains one.
+func krbErrorCode(err error) (int32, bool) {
+	var e messages.KRBError
+	if errors.As(err, &e) {
+		return e.ErrorCode, true
+	}
+	m := krbErrorCodeRegexp.FindStringSubmatch(err.Error())
+	if len(m) != 2 {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(m[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(i), true
+}
+
+// failureReason maps an error from a kerberos exchange to a machine readable failure reason.
+// The KRB_ERROR code is also returned if the KDC provided one, otherwise it is zero.
+func failureReason(err error) (identity.FailureReason, int32) {
+	if code, ok := krbErrorCode(err); ok {
+		switch code {
+		case errorcode.KDC_ERR_PREAUTH_FAILED:
+			return identity.ReasonInvalidCredentials, code
+		case errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN:
+			return identity.ReasonUnknownPrincipal, code
+		case errorcode.KDC_ERR_CLIENT_REVOKED:
+			return identity.ReasonAccountRevoked, code
+		case errorcode.KDC_ERR_KEY_EXPIRED:
+			return identity.ReasonPasswordExpired, code
+		case errorcode.KRB_AP_ERR_SKEW:
+			return identity.ReasonClockSkew, code
+		case errorcode.KDC_ERR_ETYPE_NOSUPP:
+			return identity.ReasonUnsupportedEType, code
+		}
+		return identity.ReasonUnknown, code
+	}
+	var ke krberror.Krberror
+	if errors.As(err, &ke) {
+		// Without pre-authentication a wrong password is only detected when the AS_REP cannot be decrypted.
+		if strings.Contains(ke.Error(), "password/keytab incorrect") {
+			return identity.ReasonInvalidCredentials, 0
+		}
+		if ke.RootCause == krberror.NetworkingError {
+			return identity.ReasonKDCUnreachable, 0
+		}
+	}
+	return identity.ReasonUnknown, 0
+}
@@ -0,0 +1,52 @@
+package httphandling
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureReason(t *testing.T) {
+	var tests = []struct {
+		code   int32
+		reason identity.FailureReason
+	}{
+		{errorcode.KDC_ERR_PREAUTH_FAILED, identity.ReasonInvalidCredentials},
+		{errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, identity.ReasonUnknownPrincipal},
+		{errorcode.KDC_ERR_CLIENT_REVOKED, identity.ReasonAccountRevoked},
+		{errorcode.KDC_ERR_KEY_EXPIRED, identity.ReasonPasswordExpired},
+		{errorcode.KRB_AP_ERR_SKEW, identity.ReasonClockSkew},
+		{errorcode.KDC_ERR_ETYPE_NOSUPP, identity.ReasonUnsupportedEType},
+		{errorcode.KDC_ERR_POLICY, identity.ReasonUnknown},
+	}
+	for _, test := range tests {
+		krbErr := messages.NewKRBError(types.PrincipalName{}, "TEST.GOKRB5", test.code, "")
+		// Unwrapped KRBError
+		r, code := failureReason(krbErr)
+		assert.Equal(t, test.reason, r, "reason not as expected for unwrapped error code %d", test.code)
+		assert.Equal(t, test.code, code)
+		// KRBError wrapped as gokrb5 does in the AS exchange
+		err := krberror.Errorf(krbErr, krberror.KDCError, "AS Exchange Error: kerberos error response from KDC")
+		r, code = failureReason(err)
+		assert.Equal(t, test.reason, r, "reason not as expected for wrapped error code %d", test.code)
+		assert.Equal(t, test.code, code)
+	}
+
+	err := krberror.Errorf(errors.New("failed to communicate with KDC"), krberror.NetworkingError, "AS Exchange Error: failed sending AS_REQ to KDC")
+	r, code := failureReason(err)
+	assert.Equal(t, identity.ReasonKDCUnreachable, r)
+	assert.Equal(t, int32(0), code)
+
+	err = krberror.Errorf(krberror.New(krberror.DecryptingError, "integrity verification failed"), krberror.KRBMsgError, "AS Exchange Error: AS_REP is not valid or client password/keytab incorrect")
+	r, _ = failureReason(err)
+	assert.Equal(t, identity.ReasonInvalidCredentials, r)
+
+	r, _ = failureReason(errors.New("something else"))
+	assert.Equal(t, identity.ReasonUnknown, r)
+}
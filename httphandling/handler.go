@@ -3,13 +3,22 @@ package httphandling
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
 )
 
-// WrapCommonHandler wraps the handler in the authentication handler if required
-// and the accessLogger wrapper.
+// WrapCommonHandler wraps the handler in the authentication handler if required, the check of the caller's peer
+// credentials and the accessLogger wrapper.
 func WrapCommonHandler(inner http.Handler, c *config.Config) http.Handler {
+	return WrapAdminHandler(checkPeer(inner, c), c)
+}
+
+// WrapAdminHandler wraps the handler of a route served on the admin port in the accessLogger wrapper. The caller's peer
+// credentials are not checked as the admin port is a loopback TCP port whose connections carry none.
+func WrapAdminHandler(inner http.Handler, c *config.Config) http.Handler {
 	//Wrap with access logger
 	inner = accessLogger(inner, c)
 
@@ -48,3 +57,33 @@ func respondWithJSON(w http.ResponseWriter, httpCode int, payload interface{}) {
 	w.WriteHeader(httpCode)
 	w.Write(response)
 }
+
+// JSONKDCUnavailableResponse is the JSON response when the credentials could not be validated as no KDC for the
+// domain could be contacted.
+type JSONKDCUnavailableResponse struct {
+	Message     string
+	HTTPCode    int
+	Domain      string
+	LoginName   string
+	SessionID   string
+	CircuitOpen bool
+}
+
+func respondKDCUnavailable(w http.ResponseWriter, b *kdcBreaker, id identity.Identity) {
+	e := JSONKDCUnavailableResponse{
+		Message:   "KDC unavailable",
+		HTTPCode:  http.StatusServiceUnavailable,
+		Domain:    id.Domain,
+		LoginName: id.LoginName,
+		SessionID: id.SessionID,
+	}
+	if rt := b.retryTime(id.Domain); !rt.IsZero() {
+		e.CircuitOpen = true
+		secs := int(time.Until(rt).Seconds()) + 1
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	respondWithJSON(w, http.StatusServiceUnavailable, e)
+}
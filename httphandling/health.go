@@ -0,0 +1,290 @@
+package httphandling
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	// probePrincipal is the client principal of the AS-REQ sent to probe a KDC. It is not expected to exist so the
+	// KDC answers with a KRB-ERROR, which shows it is alive, without any password being tried.
+	probePrincipal = "authenvoy-readiness-probe"
+	// defaultKDCProbeTimeout is the period to wait for a KDC to answer a probe if no timeout is configured.
+	defaultKDCProbeTimeout = 2 * time.Second
+	// maxKDCReplySize is the largest reply read from a KDC over TCP. A reply to a probe is much smaller.
+	maxKDCReplySize = 64 * 1024
+)
+
+// KDCReadiness is the result of probing a KDC.
+type KDCReadiness struct {
+	Address   string
+	Reachable bool
+	Latency   string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// RealmReadiness is the result of probing the KDCs of a realm. A realm is ready if any of its KDCs answered.
+type RealmReadiness struct {
+	Ready bool
+	KDCs  []KDCReadiness
+	// Error is the reason the KDCs of the realm could not be resolved.
+	Error string `json:",omitempty"`
+	// Circuit is the state of the realm's KDC circuit breaker if it is not closed.
+	Circuit string `json:",omitempty"`
+}
+
+// JSONHealthResponse is the JSON response to a liveness check.
+type JSONHealthResponse struct {
+	Status   string
+	HTTPCode int
+}
+
+// JSONReadinessResponse is the JSON response to a readiness check. It is ready if a KDC of every realm answered and
+// all logs can be written to.
+type JSONReadinessResponse struct {
+	Ready    bool
+	HTTPCode int
+	// CheckedAt is the time the KDCs were probed, which is earlier than the request if the results were cached.
+	CheckedAt time.Time
+	Realms    map[string]RealmReadiness
+	// Logs are the logs that cannot be written to and the reason.
+	Logs map[string]string `json:",omitempty"`
+}
+
+// healthz responds when the process is able to serve requests.
+func healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, JSONHealthResponse{
+			Status:   "alive",
+			HTTPCode: http.StatusOK,
+		})
+	}
+}
+
+// readyz responds with whether the KDCs of the configured realms can be reached and the logs written to.
+func readyz(c *config.Config, b *kdcBreaker, p *kdcProber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := c.Current()
+		realms, checked := p.results()
+		e := JSONReadinessResponse{
+			Ready:     true,
+			CheckedAt: checked,
+			Realms:    make(map[string]RealmReadiness),
+		}
+		breakers := b.status()
+		for realm, rr := range realms {
+			for d, s := range breakers {
+				if strings.EqualFold(d, realm) && s.State != BreakerClosed {
+					rr.Circuit = s.State
+				}
+			}
+			e.Realms[realm] = rr
+			e.Ready = e.Ready && rr.Ready
+		}
+		if errs := c.CheckLogs(); len(errs) > 0 {
+			e.Ready = false
+			e.Logs = make(map[string]string)
+			for l, err := range errs {
+				e.Logs[l] = err.Error()
+			}
+		}
+		e.HTTPCode = http.StatusOK
+		if !e.Ready {
+			e.HTTPCode = http.StatusServiceUnavailable
+		}
+		respondWithJSON(w, e.HTTPCode, e)
+	}
+}
+
+// kdcProber probes the KDCs of the realms in the krb5.conf and caches the results for the readiness cache TTL.
+type kdcProber struct {
+	c       *config.Config
+	mux     sync.Mutex
+	krb5    *krb5config.Config
+	checked time.Time
+	realms  map[string]RealmReadiness
+}
+
+func newKDCProber(c *config.Config) *kdcProber {
+	return &kdcProber{c: c}
+}
+
+// results returns the readiness of each realm and the time its KDCs were probed. The KDCs are probed again if the
+// cached results have expired or the krb5.conf has been reloaded. Concurrent checks wait for a single probe.
+func (p *kdcProber) results() (map[string]RealmReadiness, time.Time) {
+	c := p.c.Current()
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.realms != nil && p.krb5 == c.KRB5Conf && time.Since(p.checked) < c.ReadinessCacheTTL {
+		return p.realms, p.checked
+	}
+	realms := probeRealms(c)
+	for realm, rr := range realms {
+		if prev, ok := p.realms[realm]; (ok && prev.Ready != rr.Ready) || (!ok && !rr.Ready) {
+			if rr.Ready {
+				c.ApplicationLogf("readiness: KDC of realm %s reachable", realm)
+			} else {
+				c.ApplicationLogf("readiness: no KDC of realm %s reachable", realm)
+			}
+		}
+	}
+	p.realms = realms
+	p.krb5 = c.KRB5Conf
+	p.checked = time.Now().UTC()
+	return p.realms, p.checked
+}
+
+// probeRealms probes the KDCs of each realm in the krb5.conf, and of the default realm, concurrently.
+func probeRealms(c *config.Config) map[string]RealmReadiness {
+	names := make(map[string]bool)
+	for _, r := range c.KRB5Conf.Realms {
+		names[r.Realm] = true
+	}
+	if c.KRB5Conf.LibDefaults.DefaultRealm != "" {
+		names[c.KRB5Conf.LibDefaults.DefaultRealm] = true
+	}
+	realms := make(map[string]RealmReadiness)
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for realm := range names {
+		wg.Add(1)
+		go func(realm string) {
+			defer wg.Done()
+			rr := probeRealm(c, realm)
+			mux.Lock()
+			realms[realm] = rr
+			mux.Unlock()
+		}(realm)
+	}
+	wg.Wait()
+	return realms
+}
+
+// probeRealm resolves the KDCs of the realm and probes each of them concurrently. TCP is used if the krb5.conf
+// prefers it for a request of the probe's size.
+func probeRealm(c *config.Config, realm string) RealmReadiness {
+	var rr RealmReadiness
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, probePrincipal)
+	req, err := messages.NewASReqForTGT(realm, c.KRB5Conf, cname)
+	if err != nil {
+		rr.Error = fmt.Sprintf("could not create probe: %v", err)
+		return rr
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		rr.Error = fmt.Sprintf("could not create probe: %v", err)
+		return rr
+	}
+	limit := c.KRB5Conf.LibDefaults.UDPPreferenceLimit
+	tcp := limit == 1 || len(b) > limit
+	_, kdcs, err := c.KRB5Conf.GetKDCs(realm, tcp)
+	if err != nil {
+		rr.Error = err.Error()
+		return rr
+	}
+	timeout := c.KDCProbeTimeout
+	if timeout == 0 {
+		timeout = defaultKDCProbeTimeout
+	}
+	rr.KDCs = make([]KDCReadiness, 0, len(kdcs))
+	for _, addr := range kdcs {
+		rr.KDCs = append(rr.KDCs, KDCReadiness{Address: addr})
+	}
+	// Report the KDCs in a consistent order as GetKDCs orders them randomly
+	sort.Slice(rr.KDCs, func(i, j int) bool { return rr.KDCs[i].Address < rr.KDCs[j].Address })
+	var wg sync.WaitGroup
+	for i := range rr.KDCs {
+		wg.Add(1)
+		go func(k *KDCReadiness) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeKDC(k.Address, tcp, b, timeout)
+			if err != nil {
+				k.Error = err.Error()
+				return
+			}
+			k.Reachable = true
+			k.Latency = time.Since(start).String()
+		}(&rr.KDCs[i])
+	}
+	wg.Wait()
+	for _, k := range rr.KDCs {
+		rr.Ready = rr.Ready || k.Reachable
+	}
+	return rr
+}
+
+// probeKDC sends the AS-REQ to the KDC at the address and returns an error unless it answers with a Kerberos message
+// within the timeout.
+func probeKDC(addr string, tcp bool, req []byte, timeout time.Duration) error {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	var rb []byte
+	if tcp {
+		// RFC 4120 7.2.2: messages over TCP are preceded by their length as a 4 byte big endian integer
+		hb := make([]byte, 4)
+		binary.BigEndian.PutUint32(hb, uint32(len(req)))
+		_, err = conn.Write(append(hb, req...))
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, hb)
+		if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(hb)
+		if n > maxKDCReplySize {
+			return fmt.Errorf("reply of %d bytes is too large", n)
+		}
+		rb = make([]byte, n)
+		_, err = io.ReadFull(conn, rb)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+		rb = make([]byte, 4096)
+		n, err := conn.Read(rb)
+		if err != nil {
+			return err
+		}
+		rb = rb[:n]
+	}
+	var krberr messages.KRBError
+	if krberr.Unmarshal(rb) == nil {
+		return nil
+	}
+	var rep messages.ASRep
+	if rep.Unmarshal(rb) == nil {
+		return nil
+	}
+	return errors.New("reply is not a Kerberos message")
+}
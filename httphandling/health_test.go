@@ -0,0 +1,142 @@
+package httphandling
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKDC answers every request received over UDP with a KRB-ERROR with the error code and counts them. The error
+// gives the etype to use for pre-authentication so that clients send their password with the next request.
+func fakeKDC(t *testing.T, code int32) (string, *int32, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	krberr := messages.NewKRBError(types.PrincipalName{}, "UP.GOKRB5", code, "")
+	ei, _ := asn1.Marshal(types.ETypeInfo2{{EType: etypeID.AES256_CTS_HMAC_SHA1_96, Salt: "UP.GOKRB5testuser1"}})
+	krberr.EData, _ = asn1.Marshal(types.PADataSequence{{PADataType: patype.PA_ETYPE_INFO2, PADataValue: ei}})
+	rb, err := krberr.Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal KRB-ERROR: %v", err)
+	}
+	var n int32
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			_, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1)
+			conn.WriteTo(rb, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &n, func() { conn.Close() }
+}
+
+func readinessConfig(t *testing.T, realms string) *config.Config {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(fmt.Sprintf("[libdefaults]\n  default_realm = UP.GOKRB5\n  dns_lookup_kdc = false\n\n[realms]\n%s", realms))
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.ReadinessCacheTTL = time.Minute
+	c.KDCProbeTimeout = time.Second
+	return c
+}
+
+func TestHealthz(t *testing.T) {
+	c := readinessConfig(t, " UP.GOKRB5 = {\n  kdc = 127.0.0.1:88\n }\n")
+	request, _ := http.NewRequest("GET", "/healthz", nil)
+	response := httptest.NewRecorder()
+	NewRouter(c).ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var r JSONHealthResponse
+	json.Unmarshal(response.Body.Bytes(), &r)
+	assert.Equal(t, "alive", r.Status)
+}
+
+func TestReadyz(t *testing.T) {
+	addr, probes, stop := fakeKDC(t, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN)
+	defer stop()
+	c := readinessConfig(t, fmt.Sprintf(" UP.GOKRB5 = {\n  kdc = %s\n  kdc = 127.0.0.1:1\n }\n", addr))
+	rt := NewRouter(c)
+
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "a realm with any KDC answering should be ready")
+	var r JSONReadinessResponse
+	err := json.Unmarshal(response.Body.Bytes(), &r)
+	if err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	assert.True(t, r.Ready)
+	up := r.Realms["UP.GOKRB5"]
+	assert.True(t, up.Ready)
+	if assert.Len(t, up.KDCs, 2) {
+		assert.Equal(t, "127.0.0.1:1", up.KDCs[0].Address)
+		assert.False(t, up.KDCs[0].Reachable)
+		assert.NotEmpty(t, up.KDCs[0].Error)
+		assert.Equal(t, addr, up.KDCs[1].Address)
+		assert.True(t, up.KDCs[1].Reachable)
+	}
+
+	// The results are cached
+	response = httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(probes), "KDC should only be probed once within the cache TTL")
+
+	// Logs that cannot be written make it unready
+	c.SetLogBuffer(1, config.OverflowDrop)
+	c.CloseLogs()
+	response = httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	r = JSONReadinessResponse{}
+	json.Unmarshal(response.Body.Bytes(), &r)
+	assert.False(t, r.Ready)
+	assert.Len(t, r.Logs, 3)
+}
+
+func TestReadyzRealmDown(t *testing.T) {
+	addr, _, stop := fakeKDC(t, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN)
+	defer stop()
+	c := readinessConfig(t, fmt.Sprintf(" UP.GOKRB5 = {\n  kdc = %s\n }\n DOWN.GOKRB5 = {\n  kdc = 127.0.0.1:1\n }\n", addr))
+	c.KDCFailureThreshold = 1
+	c.KDCCoolDown = time.Minute
+	b := newKDCBreaker(c)
+	b.failure("down.gokrb5")
+
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	readyz(c, b, newKDCProber(c)).ServeHTTP(response, request)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "every realm should have a KDC answering")
+	var r JSONReadinessResponse
+	json.Unmarshal(response.Body.Bytes(), &r)
+	assert.False(t, r.Ready)
+	assert.True(t, r.Realms["UP.GOKRB5"].Ready)
+	assert.False(t, r.Realms["DOWN.GOKRB5"].Ready)
+	assert.Equal(t, BreakerOpen, r.Realms["DOWN.GOKRB5"].Circuit)
+	assert.Empty(t, r.Realms["UP.GOKRB5"].Circuit)
+}
@@ -0,0 +1,185 @@
+package httphandling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+)
+
+// kdcBusyRetryAfter is the Retry-After, in seconds, of responses refused as the KDC exchange capacity is reached.
+const kdcBusyRetryAfter = "1"
+
+// Errors returned when the KDC exchanges of a request cannot be completed.
+var (
+	errKDCBusy     = errors.New("KDC exchange capacity reached")
+	errAuthTimeout = errors.New("deadline for KDC exchanges exceeded")
+	errCallerGone  = errors.New("caller disconnected")
+)
+
+// exchanges counts the KDC exchanges in progress, including those that continue after their request has ended, so that
+// shutdown can wait for them.
+var exchanges sync.WaitGroup
+
+// kdcLimiter caps the number of requests exchanging with KDCs at once and applies the deadline to their exchanges.
+type kdcLimiter struct {
+	c     *config.Config
+	slots chan struct{}
+}
+
+func newKDCLimiter(c *config.Config) *kdcLimiter {
+	k := &kdcLimiter{c: c}
+	if c.MaxKDCExchanges > 0 {
+		k.slots = make(chan struct{}, c.MaxKDCExchanges)
+	}
+	return k
+}
+
+// context returns the context for the KDC exchanges of the request, with the configured deadline if there is one.
+func (k *kdcLimiter) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if k.c.Current().AuthTimeout > 0 {
+		return context.WithTimeout(r.Context(), k.c.Current().AuthTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// acquire waits for capacity to exchange with a KDC. If none becomes available within the queue timeout errKDCBusy
+// is returned.
+func (k *kdcLimiter) acquire(ctx context.Context) error {
+	if k.slots == nil {
+		return nil
+	}
+	if k.c.Current().KDCQueueTimeout <= 0 {
+		select {
+		case k.slots <- struct{}{}:
+			return nil
+		default:
+			return errKDCBusy
+		}
+	}
+	t := time.NewTimer(k.c.Current().KDCQueueTimeout)
+	defer t.Stop()
+	select {
+	case k.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return contextErr(ctx)
+	case <-t.C:
+		return errKDCBusy
+	}
+}
+
+func (k *kdcLimiter) release() {
+	if k.slots != nil {
+		<-k.slots
+	}
+}
+
+// exchange runs f, which exchanges with KDCs, within the capacity limit and the deadline of the context.
+// The gokrb5 client cannot be interrupted so if the deadline passes, or the caller disconnects, the error is returned
+// without waiting for f. f must then not respond to the caller and should check the context before each exchange so
+// that it stops as soon as it can. Capacity is only released when f returns.
+func (k *kdcLimiter) exchange(ctx context.Context, f func()) error {
+	return k.exchangeCommit(ctx, func(func() bool) { f() })
+}
+
+// exchangeCommit runs f like exchange but, once f has called commit, waits for it to return like exchangeAll. It is for
+// exchanges that may go on to change the account, such as the change of an expired password during authentication.
+// commit returns false, and f must not start the change, if the context is already done.
+func (k *kdcLimiter) exchangeCommit(ctx context.Context, f func(commit func() bool)) error {
+	err := k.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	var mux sync.Mutex
+	var committed, abandoned bool
+	commit := func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		if abandoned || ctx.Err() != nil {
+			return false
+		}
+		committed = true
+		return true
+	}
+	done := k.start(func() { f(commit) })
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mux.Lock()
+		abandoned = !committed
+		mux.Unlock()
+		if abandoned {
+			return contextErr(ctx)
+		}
+		<-done
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if !committed && ctx.Err() != nil {
+		// f may have stopped early as the context is done
+		return contextErr(ctx)
+	}
+	return nil
+}
+
+// exchangeAll runs f within the capacity limit like exchange but, once f has started, waits for it to return even if
+// the deadline passes or the caller disconnects. It is for exchanges that change the account, such as a password
+// change, whose outcome must be reported to the caller. f should check the context before it starts the change and
+// return the error from contextErr if it is done.
+func (k *kdcLimiter) exchangeAll(ctx context.Context, f func()) error {
+	err := k.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	<-k.start(f)
+	return nil
+}
+
+// start runs f in its own goroutine, counting it as an exchange in progress, and returns a channel closed when f
+// returns. The capacity acquired for f is released when it returns.
+func (k *kdcLimiter) start(f func()) <-chan struct{} {
+	done := make(chan struct{})
+	k.c.Metrics.KDCExchangeInFlight(1)
+	exchanges.Add(1)
+	go func() {
+		defer exchanges.Done()
+		defer k.release()
+		defer k.c.Metrics.KDCExchangeInFlight(-1)
+		defer close(done)
+		f()
+	}()
+	return done
+}
+
+// contextErr translates the error of a done context.
+func contextErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errAuthTimeout
+	}
+	return errCallerGone
+}
+
+// exchangeErrEvent records that the KDC exchanges of a request could not be completed.
+func exchangeErrEvent(c *config.Config, event eventLog, err error) {
+	event.Message = fmt.Sprintf("KDC exchange not completed: %v", err)
+	event.Time = time.Now().UTC()
+	c.EventLog(event)
+}
+
+// respondExchangeErr responds to a request whose KDC exchanges could not be completed.
+func respondExchangeErr(w http.ResponseWriter, err error) {
+	switch err {
+	case errKDCBusy:
+		w.Header().Set("Retry-After", kdcBusyRetryAfter)
+		respondGeneric(w, http.StatusServiceUnavailable, err.Error())
+	case errAuthTimeout:
+		respondGeneric(w, http.StatusGatewayTimeout, err.Error())
+	case errCallerGone:
+		// There is no one to respond to
+	}
+}
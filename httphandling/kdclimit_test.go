@@ -0,0 +1,151 @@
+package httphandling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKDCLimiterCapacity(t *testing.T) {
+	c := &config.Config{MaxKDCExchanges: 1}
+	x := newKDCLimiter(c)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go x.exchange(ctx, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	err := x.exchange(ctx, func() {})
+	assert.Equal(t, errKDCBusy, err, "exchange should be refused at capacity without a queue timeout")
+
+	c.KDCQueueTimeout = time.Second
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		close(release)
+	}()
+	var ran bool
+	err = x.exchange(ctx, func() { ran = true })
+	assert.NoError(t, err, "queued exchange should run when capacity is released")
+	assert.True(t, ran)
+
+	err = x.exchange(ctx, func() {})
+	assert.NoError(t, err, "capacity should be released after each exchange")
+}
+
+func TestKDCLimiterDeadline(t *testing.T) {
+	c := &config.Config{
+		MaxKDCExchanges: 1,
+		AuthTimeout:     time.Millisecond * 10,
+	}
+	x := newKDCLimiter(c)
+	r := httptest.NewRequest(http.MethodPost, "/"+APIVersion+"/authenticate", nil)
+	ctx, cancel := x.context(r)
+	defer cancel()
+
+	finished := make(chan struct{})
+	err := x.exchange(ctx, func() {
+		time.Sleep(time.Millisecond * 50)
+		close(finished)
+	})
+	assert.Equal(t, errAuthTimeout, err)
+	assert.Equal(t, errKDCBusy, x.exchange(context.Background(), func() {}),
+		"capacity should be held until the abandoned exchange finishes")
+	<-finished
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, x.exchange(context.Background(), func() {}))
+}
+
+func TestKDCLimiterCallerGone(t *testing.T) {
+	x := newKDCLimiter(&config.Config{})
+	pctx, pcancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/"+APIVersion+"/authenticate", nil).WithContext(pctx)
+	ctx, cancel := x.context(r)
+	defer cancel()
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		pcancel()
+	}()
+	err := x.exchange(ctx, func() {
+		<-ctx.Done()
+	})
+	assert.Equal(t, errCallerGone, err)
+
+	w := httptest.NewRecorder()
+	respondExchangeErr(w, errAuthTimeout)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	w = httptest.NewRecorder()
+	respondExchangeErr(w, errKDCBusy)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, kdcBusyRetryAfter, w.Header().Get("Retry-After"))
+}
+
+func TestKDCLimiterExchangeAll(t *testing.T) {
+	c := &config.Config{
+		MaxKDCExchanges: 1,
+		AuthTimeout:     time.Millisecond * 10,
+	}
+	x := newKDCLimiter(c)
+	r := httptest.NewRequest(http.MethodPost, "/"+APIVersion+"/password", nil)
+	ctx, cancel := x.context(r)
+	defer cancel()
+
+	var changed bool
+	err := x.exchangeAll(ctx, func() {
+		time.Sleep(time.Millisecond * 50)
+		changed = true
+	})
+	assert.NoError(t, err, "a change should be waited for beyond the deadline")
+	assert.True(t, changed)
+	assert.NoError(t, x.exchange(context.Background(), func() {}), "capacity should be released after the change")
+
+	// Capacity not becoming available before the deadline still refuses the change
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go x.exchange(context.Background(), func() {
+		close(started)
+		<-release
+	})
+	<-started
+	c.KDCQueueTimeout = time.Second
+	ctx, cancel = x.context(r)
+	defer cancel()
+	err = x.exchangeAll(ctx, func() { t.Error("change should not start") })
+	assert.Equal(t, errAuthTimeout, err)
+	close(release)
+}
+
+func TestKDCLimiterExchangeCommit(t *testing.T) {
+	c := &config.Config{AuthTimeout: time.Millisecond * 10}
+	x := newKDCLimiter(c)
+	r := httptest.NewRequest(http.MethodPost, "/"+APIVersion+"/authenticate", nil)
+	ctx, cancel := x.context(r)
+	defer cancel()
+
+	var changed bool
+	err := x.exchangeCommit(ctx, func(commit func() bool) {
+		if commit() {
+			time.Sleep(time.Millisecond * 50)
+			changed = true
+		}
+	})
+	assert.NoError(t, err, "a committed change should be waited for beyond the deadline")
+	assert.True(t, changed)
+
+	ctx, cancel = x.context(r)
+	defer cancel()
+	finished := make(chan bool)
+	err = x.exchangeCommit(ctx, func(commit func() bool) {
+		time.Sleep(time.Millisecond * 50)
+		finished <- commit()
+	})
+	assert.Equal(t, errAuthTimeout, err, "an exchange not committed should be abandoned at the deadline")
+	assert.False(t, <-finished, "commit should be refused once the exchange is abandoned")
+}
@@ -4,8 +4,10 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-uuid"
 	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
 )
 
 type accessLog struct {
@@ -17,47 +19,92 @@ type accessLog struct {
 	QueryString string        `json:"QueryString"`
 	Time        time.Time     `json:"Time"`
 	Duration    time.Duration `json:"Duration"`
+	// Peer identifies the calling process if the request was made over the Unix domain socket.
+	Peer *PeerCred `json:"Peer,omitempty"`
 }
 
 func accessLogger(inner http.Handler, c *config.Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now().UTC()
+		route := routeName(r)
+		c.Metrics.RequestInFlight(route, 1)
+		defer c.Metrics.RequestInFlight(route, -1)
 		ww := NewResponseWriterWrapper(w)
 		inner.ServeHTTP(ww, r)
+		c.Metrics.Request(route, r.Method, ww.Status(), time.Since(start))
 		l := accessLog{
 			SourceIP:    r.RemoteAddr,
 			StatusCode:  ww.Status(),
 			Method:      r.Method,
 			ServerHost:  r.Host,
-			Path:        r.URL.Path,
+			Path:        logPath(r),
 			QueryString: r.URL.RawQuery,
 			Time:        start,
 			Duration:    time.Since(start),
+			Peer:        peerCred(r),
 		}
 		c.AccessLog(l)
 	})
 }
 
+// logPath returns the path of the request to record in the access log. A session ID in the path is replaced by the
+// route's placeholder as anyone holding it can use the session.
+func logPath(r *http.Request) string {
+	if _, ok := mux.Vars(r)["id"]; ok {
+		if t, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			return t
+		}
+	}
+	return r.URL.Path
+}
+
+// Actions recorded in the event log.
+const (
+	actionAuthenticate   = "authenticate"
+	actionPasswordChange = "password-change"
+	actionNegotiate      = "negotiate"
+	actionSessionCreate  = "session-create"
+	actionSessionRefresh = "session-refresh"
+	actionSessionLogout  = "session-logout"
+	actionSessionExpire  = "session-expire"
+	actionSessionRenew   = "session-renew"
+)
+
 type eventLog struct {
-	EventID              string    `json:"EventID"`
-	Time                 time.Time `json:"Time"`
-	LoginName            string    `json:"LoginName"`
-	Domain               string    `json:"Domain"`
-	Validated            bool      `json:"Validated"`
-	ValidationSuccessful bool      `json:"ValidationSuccessful"`
-	Message              string    `json:"Message"`
+	EventID              string                 `json:"EventID"`
+	Action               string                 `json:"Action"`
+	Time                 time.Time              `json:"Time"`
+	LoginName            string                 `json:"LoginName"`
+	Domain               string                 `json:"Domain"`
+	Validated            bool                   `json:"Validated"`
+	ValidationSuccessful bool                   `json:"ValidationSuccessful"`
+	FailureReason        identity.FailureReason `json:"FailureReason,omitempty"`
+	KRBErrorCode         int32                  `json:"KRBErrorCode,omitempty"`
+	PasswordChanged      bool                   `json:"PasswordChanged,omitempty"`
+	KPasswdResultCode    int                    `json:"KPasswdResultCode,omitempty"`
+	PACStatus            identity.PACStatus     `json:"PACStatus,omitempty"`
+	Audience             string                 `json:"Audience,omitempty"`
+	AuthorizationRule    string                 `json:"AuthorizationRule,omitempty"`
+	AuthorizationDenied  bool                   `json:"AuthorizationDenied,omitempty"`
+	RateLimit            string                 `json:"RateLimit,omitempty"`
+	NegativeCache        bool                   `json:"NegativeCache,omitempty"`
+	Peer                 *PeerCred              `json:"Peer,omitempty"`
+	Message              string                 `json:"Message"`
 }
 
-// newEvent creates a new event log item
-func newEvent(loginName, domain string) (eventLog, error) {
+// newEvent creates a new event log item for the request, recording the calling process if it was made over the Unix
+// domain socket.
+func newEvent(r *http.Request, action, loginName, domain string) (eventLog, error) {
 	eid, err := uuid.GenerateUUID()
 	if err != nil {
 		return eventLog{}, err
 	}
 	return eventLog{
 		EventID:   eid,
+		Action:    action,
 		Time:      time.Now().UTC(),
 		LoginName: loginName,
 		Domain:    domain,
+		Peer:      peerCred(r),
 	}, nil
 }
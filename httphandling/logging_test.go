@@ -26,7 +26,7 @@ func TestAccessLogger(t *testing.T) {
 	cf.WriteString(krb5Conf)
 
 	// Set the config to have a byte buffer for the access encoder
-	c, err := config.New(8088, cf.Name(), os.TempDir())
+	c, err := config.New(8088, cf.Name(), os.TempDir(), "")
 	defer os.Remove(os.TempDir() + "/" + config.AccessLog)
 	defer os.Remove(os.TempDir() + "/" + config.EventLog)
 	defer os.Remove(os.TempDir() + "/" + config.AppLog)
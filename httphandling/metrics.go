@@ -0,0 +1,51 @@
+package httphandling
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// unknownRoute is the route label of metrics for requests that did not match a route.
+const unknownRoute = "unknown"
+
+// exchangeErrReasons are the reasons recorded in the metrics for requests whose KDC exchanges were not completed.
+var exchangeErrReasons = map[error]string{
+	errKDCBusy:     "KDCBusy",
+	errAuthTimeout: "Timeout",
+	errCallerGone:  "CallerGone",
+}
+
+// routeName returns the name of the route the request matched.
+func routeName(r *http.Request) string {
+	if rt := mux.CurrentRoute(r); rt != nil && rt.GetName() != "" {
+		return rt.GetName()
+	}
+	return unknownRoute
+}
+
+// authenticationMetric records the outcome of an authentication attempt.
+func authenticationMetric(c *config.Config, realm, outcome string, reason identity.FailureReason) {
+	c.Metrics.Authentication(c.MetricRealm(realm), outcome, string(reason))
+}
+
+// asExchange performs the AS exchange with the realm's KDC and records its latency.
+func asExchange(c *config.Config, cl *client.Client, realm string, req messages.ASReq) (messages.ASRep, error) {
+	start := time.Now()
+	defer func() { c.Metrics.KDCExchange(config.ExchangeAS, c.MetricRealm(realm), time.Since(start)) }()
+	return cl.ASExchange(realm, req, 0)
+}
+
+// tgsExchange performs a TGS exchange with the realm's KDC and records its latency.
+func tgsExchange(c *config.Config, cl *client.Client, req messages.TGSReq, realm string, tgt messages.Ticket, key types.EncryptionKey) (messages.TGSRep, error) {
+	start := time.Now()
+	defer func() { c.Metrics.KDCExchange(config.ExchangeTGS, c.MetricRealm(realm), time.Since(start)) }()
+	_, rep, err := cl.TGSExchange(req, realm, tgt, key, 0)
+	return rep, err
+}
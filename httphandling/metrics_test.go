@@ -0,0 +1,86 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	// Point the realm at a port nothing is listening on
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.KDCFailureThreshold = 2
+	c.KDCCoolDown = time.Minute
+	c.RateLimitUser = 3
+	c.EnableMetrics("abc123", time.Now(), 0)
+	rt := NewRouter(c)
+
+	url := fmt.Sprintf("/%s/authenticate", APIVersion)
+	for _, domain := range []string{"TEST.GOKRB5", "TEST.GOKRB5", "TEST.GOKRB5", "TEST.GOKRB5", "UNKNOWN.REALM"} {
+		pb, _ := json.Marshal(identity.Credentials{
+			LoginName: "testuser1",
+			Domain:    domain,
+			Password:  "passwordvalue",
+		})
+		request, _ := http.NewRequest("POST", url, bytes.NewReader(pb))
+		rt.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	body := response.Body.String()
+	for _, s := range []string{
+		// The second failure opens the circuit so only two AS exchanges are attempted
+		`authenvoy_authentications_total{outcome="error",realm="TEST.GOKRB5",reason="KDCUnreachable"} 3`,
+		`authenvoy_kdc_exchange_duration_seconds_count{exchange="AS",realm="TEST.GOKRB5"} 2`,
+		// The rate limit for the login name is reached on the fourth attempt
+		`authenvoy_authentications_total{outcome="refused",realm="TEST.GOKRB5",reason="RateLimited"} 1`,
+		// Realms not in the krb5.conf are not used as label values
+		`authenvoy_authentications_total{outcome="failure",realm="other",reason="UnknownRealm"} 1`,
+		`authenvoy_http_request_duration_seconds_count{code="503",method="POST",route="authenticate"} 3`,
+		`authenvoy_http_request_duration_seconds_count{code="401",method="POST",route="authenticate"} 1`,
+		`authenvoy_http_request_duration_seconds_count{code="429",method="POST",route="authenticate"} 1`,
+		// The scrape itself is in flight
+		`authenvoy_http_requests_in_flight{route="authenticate"} 0`,
+		`authenvoy_http_requests_in_flight{route="metrics"} 1`,
+		`authenvoy_kdc_exchanges_in_flight 0`,
+	} {
+		assert.Contains(t, body, s+"\n")
+	}
+}
+
+func TestMetricsSeparatePort(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.EnableMetrics("abc123", time.Now(), 9090)
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	NewRouter(c).ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code, "metrics should not be served with the API")
+}
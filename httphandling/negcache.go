@@ -0,0 +1,150 @@
+package httphandling
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+)
+
+// negativeEntry is a cached rejection of a password.
+type negativeEntry struct {
+	reason       identity.FailureReason
+	krbErrorCode int32
+	expires      time.Time
+}
+
+// negativeCache holds recently rejected passwords so that repeats of the same wrong password are answered without
+// sending another AS_REQ to the KDC. Passwords are only held as salted hashes. Entries are grouped by login name so
+// that they can be dropped when the user's password changes.
+type negativeCache struct {
+	c    *config.Config
+	mux  sync.Mutex
+	salt []byte
+	// users maps the login name to the entries keyed by password hash.
+	users map[string]map[string]negativeEntry
+	size  int
+}
+
+func newNegativeCache(c *config.Config) *negativeCache {
+	n := &negativeCache{
+		c:     c,
+		salt:  make([]byte, 32),
+		users: make(map[string]map[string]negativeEntry),
+	}
+	if _, err := rand.Read(n.salt); err != nil {
+		c.ApplicationLogf("could not generate negative cache salt, negative cache disabled: %v", err)
+		n.salt = nil
+	}
+	return n
+}
+
+// enabled indicates if the negative cache has been configured.
+func (n *negativeCache) enabled() bool {
+	return n.c.Current().NegativeCacheTTL > 0 && n.c.Current().NegativeCacheSize > 0 && n.salt != nil
+}
+
+// hash returns the salted hash of the user's password.
+func (n *negativeCache) hash(user, password string) string {
+	h := sha256.New()
+	h.Write(n.salt)
+	h.Write([]byte(user))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookup returns the cached rejection of the credentials' password if there is one.
+func (n *negativeCache) lookup(creds identity.Credentials) (negativeEntry, bool) {
+	if !n.enabled() {
+		return negativeEntry{}, false
+	}
+	user := userKey(creds.LoginName, creds.Domain)
+	h := n.hash(user, creds.Password)
+	now := time.Now().UTC()
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	e, ok := n.users[user][h]
+	if !ok {
+		return negativeEntry{}, false
+	}
+	if !now.Before(e.expires) {
+		n.remove(user, h)
+		return negativeEntry{}, false
+	}
+	return e, true
+}
+
+// add caches the rejection of the credentials' password. If the cache is full expired entries are removed and, if it
+// is still full, the entries closest to expiry.
+func (n *negativeCache) add(creds identity.Credentials, reason identity.FailureReason, krbErrorCode int32) {
+	if !n.enabled() {
+		return
+	}
+	user := userKey(creds.LoginName, creds.Domain)
+	h := n.hash(user, creds.Password)
+	now := time.Now().UTC()
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.users[user][h]; !ok {
+		for n.size >= n.c.Current().NegativeCacheSize {
+			n.evict(now)
+		}
+		if n.users[user] == nil {
+			n.users[user] = make(map[string]negativeEntry)
+		}
+		n.size++
+	}
+	n.users[user][h] = negativeEntry{
+		reason:       reason,
+		krbErrorCode: krbErrorCode,
+		expires:      now.Add(n.c.Current().NegativeCacheTTL),
+	}
+}
+
+// purge removes the cached rejections for a login name, for example when its password has changed.
+func (n *negativeCache) purge(creds identity.Credentials) {
+	if !n.enabled() {
+		return
+	}
+	user := userKey(creds.LoginName, creds.Domain)
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.size -= len(n.users[user])
+	delete(n.users, user)
+}
+
+// evict removes the expired entries or, if there are none, the entry closest to expiry. The caller must hold the lock.
+func (n *negativeCache) evict(now time.Time) {
+	var oldUser, oldHash string
+	var oldest time.Time
+	removed := false
+	for u, es := range n.users {
+		for h, e := range es {
+			if !now.Before(e.expires) {
+				n.remove(u, h)
+				removed = true
+				continue
+			}
+			if oldest.IsZero() || e.expires.Before(oldest) {
+				oldUser, oldHash, oldest = u, h, e.expires
+			}
+		}
+	}
+	if !removed && !oldest.IsZero() {
+		n.remove(oldUser, oldHash)
+	}
+}
+
+// remove deletes an entry. The caller must hold the lock.
+func (n *negativeCache) remove(user, h string) {
+	delete(n.users[user], h)
+	n.size--
+	if len(n.users[user]) == 0 {
+		delete(n.users, user)
+	}
+}
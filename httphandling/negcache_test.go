@@ -0,0 +1,109 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegativeCache(t *testing.T) {
+	c := &config.Config{
+		NegativeCacheTTL:  time.Millisecond * 100,
+		NegativeCacheSize: 3,
+	}
+	n := newNegativeCache(c)
+	creds := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "wrong"}
+
+	_, ok := n.lookup(creds)
+	assert.False(t, ok)
+	n.add(creds, identity.ReasonInvalidCredentials, 24)
+	e, ok := n.lookup(identity.Credentials{LoginName: "TestUser1", Domain: "test.gokrb5", Password: "wrong"})
+	assert.True(t, ok, "rejection should be cached regardless of login name case")
+	assert.Equal(t, identity.ReasonInvalidCredentials, e.reason)
+	assert.Equal(t, int32(24), e.krbErrorCode)
+	_, ok = n.lookup(identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "other"})
+	assert.False(t, ok, "other passwords should not be answered from the cache")
+	_, ok = n.lookup(identity.Credentials{LoginName: "testuser2", Domain: "TEST.GOKRB5", Password: "wrong"})
+	assert.False(t, ok, "other users should not be answered from the cache")
+	for _, es := range n.users {
+		for h := range es {
+			assert.NotContains(t, h, fmt.Sprintf("%x", "wrong"), "password should only be held hashed")
+		}
+	}
+
+	// Expiry
+	time.Sleep(c.NegativeCacheTTL)
+	_, ok = n.lookup(creds)
+	assert.False(t, ok, "entry should expire after the TTL")
+	assert.Equal(t, 0, n.size)
+
+	// Size is bounded with the entry closest to expiry evicted
+	for i := 0; i < 4; i++ {
+		n.add(identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: fmt.Sprintf("wrong%d", i)},
+			identity.ReasonInvalidCredentials, 24)
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 3, n.size)
+	_, ok = n.lookup(identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "wrong0"})
+	assert.False(t, ok, "oldest entry should have been evicted")
+	_, ok = n.lookup(identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "wrong3"})
+	assert.True(t, ok)
+
+	// A password change drops the user's entries
+	n.purge(creds)
+	assert.Equal(t, 0, n.size)
+	assert.Empty(t, n.users)
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	n := newNegativeCache(&config.Config{NegativeCacheSize: 10})
+	creds := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "wrong"}
+	n.add(creds, identity.ReasonInvalidCredentials, 24)
+	_, ok := n.lookup(creds)
+	assert.False(t, ok, "disabled cache should not answer")
+}
+
+func TestAuthenticateNegativeCache(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	// Point the realm at a port nothing is listening on so that only a cached answer can be a 401
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.NegativeCacheTTL = time.Minute
+	c.NegativeCacheSize = 10
+	n := newNegativeCache(c)
+	creds := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "wrong"}
+	n.add(creds, identity.ReasonInvalidCredentials, 24)
+	h := authenticate(c, newKDCBreaker(c), newKDCLimiter(c), newSessionStore(c), newRateLimiter(c), n)
+
+	pb, _ := json.Marshal(creds)
+	request, _ := http.NewRequest("POST", "/"+APIVersion+"/authenticate", bytes.NewReader(pb))
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "cached rejection should be answered without the KDC")
+	var id identity.Identity
+	json.Unmarshal(response.Body.Bytes(), &id)
+	assert.False(t, id.Valid)
+	assert.Equal(t, identity.ReasonInvalidCredentials, id.FailureReason)
+
+	creds.Password = "other"
+	pb, _ = json.Marshal(creds)
+	request, _ = http.NewRequest("POST", "/"+APIVersion+"/authenticate", bytes.NewReader(pb))
+	response = httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "other passwords should be sent to the KDC")
+}
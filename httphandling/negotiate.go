@@ -0,0 +1,218 @@
+package httphandling
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// tokIDAPRep is the GSS-API KRB5 mech token ID for an AP_REP.
+var tokIDAPRep = []byte{0x02, 0x00}
+
+// NegotiateToken is the SPNEGO token posted for validation
+type NegotiateToken struct {
+	Token string `json:"Token"`
+}
+
+func negotiate(c *config.Config) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := c.Current()
+		b, err := tokenFromPost(c, r)
+		if err != nil {
+			c.ApplicationLogf("bad request: %v", err)
+			respondGeneric(w, http.StatusBadRequest, "posted data invalid")
+			return
+		}
+		event, err := newEvent(r, actionNegotiate, "", "")
+		if err != nil {
+			c.ApplicationLogf("error generating new event: %v", err)
+			respondGeneric(w, http.StatusInternalServerError, "Error processing request")
+			return
+		}
+		event.Message = "new negotiate request"
+		c.EventLog(event)
+		id := spnegoValidate(c, b, event)
+		code := http.StatusUnauthorized
+		if id.Valid {
+			code = http.StatusAccepted
+		}
+		respondWithJSON(w, code, id)
+		return
+	})
+}
+
+// tokenFromPost returns the SPNEGO token from the JSON or form data posted, or from a relayed Authorization header.
+func tokenFromPost(c *config.Config, r *http.Request) ([]byte, error) {
+	var t NegotiateToken
+	switch r.Header.Get("Content-Type") {
+	case "application/x-www-form-urlencoded":
+		t.Token = r.FormValue("token")
+	default:
+		if s := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(s) == 2 && s[0] == "Negotiate" {
+			t.Token = s[1]
+			break
+		}
+		reader := io.LimitReader(r.Body, 65536)
+		defer r.Body.Close()
+		err := json.NewDecoder(reader).Decode(&t)
+		if err != nil {
+			c.ApplicationLogf("error decoding provided JSON into negotiate token: %v", err)
+			return nil, err
+		}
+	}
+	if t.Token == "" {
+		return nil, errors.New("no negotiate token provided")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimPrefix(t.Token, "Negotiate "))
+}
+
+func spnegoValidate(c *config.Config, b []byte, event eventLog) identity.Identity {
+	id := identity.Identity{
+		SessionID: event.EventID,
+	}
+	k5t, err := krb5MechToken(b)
+	if err != nil {
+		validationErrEvent(c, &event, fmt.Errorf("validation of negotiate token failed - %v", err))
+		return id
+	}
+	ok, creds, err := service.VerifyAPREQ(&k5t.APReq, serviceSettings(c))
+	if creds != nil {
+		id.LoginName = creds.UserName()
+		id.DisplayName = creds.UserName()
+		id.Domain = creds.Domain()
+		event.LoginName = id.LoginName
+		event.Domain = id.Domain
+	}
+	if err != nil || !ok {
+		if err == nil {
+			err = errors.New("AP_REQ not valid")
+		}
+		event.FailureReason, event.KRBErrorCode = failureReason(err)
+		validationErrEvent(c, &event, fmt.Errorf("validation of negotiate token failed - AP_REQ not valid: %v", err))
+		return id
+	}
+	id.Valid = true
+	id.AuthTime = k5t.APReq.Ticket.DecryptedEncPart.AuthTime
+	id.Expiry = creds.ValidUntil()
+	event.Time = creds.AuthTime()
+	err = addVerifiedIdentityInfo(&id, identity.Credentials{LoginName: id.LoginName, Domain: id.Domain}, k5t.APReq.Ticket, c)
+	if err != nil {
+		c.ApplicationLogf("could not get identity information for %s: %v", event.EventID, err)
+	}
+	event.PACStatus = id.PACStatus
+	if mutualRequired(k5t.APReq) {
+		rt, err := spnegoMutualToken(k5t.APReq)
+		if err != nil {
+			c.ApplicationLogf("could not generate mutual authentication token for %s: %v", event.EventID, err)
+		} else {
+			id.ResponseToken = base64.StdEncoding.EncodeToString(rt)
+		}
+	}
+	validationSuccessEvent(c, &event)
+	return id
+}
+
+func serviceSettings(c *config.Config) *service.Settings {
+	o := []func(*service.Settings){service.Logger(c.Loggers.ApplicationWriter)}
+	if c.ServicePrincipal != "" {
+		o = append(o, service.KeytabPrincipal(c.ServicePrincipal))
+	}
+	return service.NewSettings(c.Keytab, o...)
+}
+
+// krb5MechToken extracts the KRB5 mech token carrying the AP_REQ from an SPNEGO NegTokenInit.
+// Raw KRB5 tokens, which some clients send without the SPNEGO wrapper, are also accepted.
+func krb5MechToken(b []byte) (spnego.KRB5Token, error) {
+	var k5t spnego.KRB5Token
+	var st spnego.SPNEGOToken
+	if err := st.Unmarshal(b); err == nil {
+		if !st.Init || len(st.NegTokenInit.MechTypes) < 1 {
+			return k5t, errors.New("SPNEGO token is not a NegTokenInit")
+		}
+		oid := st.NegTokenInit.MechTypes[0]
+		if !(oid.Equal(gssapi.OIDKRB5.OID()) || oid.Equal(gssapi.OIDMSLegacyKRB5.OID())) {
+			return k5t, errors.New("SPNEGO OID of MechToken is not of type KRB5")
+		}
+		b = st.NegTokenInit.MechTokenBytes
+	}
+	if err := k5t.Unmarshal(b); err != nil {
+		return k5t, fmt.Errorf("could not unmarshal KRB5 mech token: %v", err)
+	}
+	if !k5t.IsAPReq() {
+		return k5t, errors.New("KRB5 mech token does not contain an AP_REQ")
+	}
+	return k5t, nil
+}
+
+// mutualRequired indicates if the client has requested mutual authentication either in the AP options or in the
+// GSS-API flags of the authenticator checksum.
+func mutualRequired(apReq messages.APReq) bool {
+	if types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		return true
+	}
+	ck := apReq.Authenticator.Cksum.Checksum
+	if len(ck) >= 24 {
+		return binary.LittleEndian.Uint32(ck[20:24])&gssapi.ContextFlagMutual != 0
+	}
+	return false
+}
+
+// spnegoMutualToken creates the SPNEGO NegTokenResp containing the AP_REP that completes mutual authentication.
+func spnegoMutualToken(apReq messages.APReq) ([]byte, error) {
+	ep := messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		SequenceNumber: apReq.Authenticator.SeqNumber,
+	}
+	epb, err := asn1.Marshal(ep)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling AP_REP encrypted part: %v", err)
+	}
+	epb = asn1tools.AddASNAppTag(epb, asnAppTag.EncAPRepPart)
+	ed, err := crypto.GetEncryptedData(epb, apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting AP_REP encrypted part: %v", err)
+	}
+	apRep := messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: ed,
+	}
+	arb, err := asn1.Marshal(apRep)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling AP_REP: %v", err)
+	}
+	arb = asn1tools.AddASNAppTag(arb, asnAppTag.APREP)
+	// GSS-API KRB5 mech token framing as per RFC 4121 section 4.1
+	mt, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	mt = append(mt, tokIDAPRep...)
+	mt = append(mt, arb...)
+	mt = asn1tools.AddASNAppTag(mt, 0)
+	nt := spnego.NegTokenResp{
+		NegState:      asn1.Enumerated(spnego.NegStateAcceptCompleted),
+		SupportedMech: gssapi.OIDKRB5.OID(),
+		ResponseToken: mt,
+	}
+	return nt.Marshal()
+}
@@ -0,0 +1,158 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNegotiateConfig returns a config with the HTTP/host.test.gokrb5 service keytab.
+func testNegotiateConfig(t *testing.T) (*config.Config, *keytab.Keytab) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	b, _ := hex.DecodeString(testdata.HTTP_KEYTAB)
+	kf, _ := ioutil.TempFile(os.TempDir(), "TEST-http.keytab")
+	defer os.Remove(kf.Name())
+	kf.Write(b)
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	err = c.SetServiceKeytab(kf.Name(), "HTTP/host.test.gokrb5")
+	if err != nil {
+		t.Fatalf("could not load keytab: %v", err)
+	}
+	return c, c.Keytab
+}
+
+// testNegotiateToken returns an SPNEGO token for testuser1 to the HTTP/host.test.gokrb5 service and the session key.
+func testNegotiateToken(t *testing.T, c *config.Config, kt *keytab.Keytab) (string, types.EncryptionKey) {
+	cname := types.PrincipalName{NameType: nametype.KRB_NT_PRINCIPAL, NameString: []string{"testuser1"}}
+	sname := types.PrincipalName{NameType: nametype.KRB_NT_PRINCIPAL, NameString: []string{"HTTP", "host.test.gokrb5"}}
+	st := time.Now().UTC()
+	tkt, sessionKey, err := messages.NewTicket(cname, "TEST.GOKRB5", sname, "TEST.GOKRB5",
+		types.NewKrbFlags(), kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, st, st, st.Add(time.Hour), st.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error creating ticket: %v", err)
+	}
+	cl := client.NewWithPassword("testuser1", "TEST.GOKRB5", "passwordvalue", c.KRB5Conf)
+	k5t, err := spnego.NewKRB5TokenAPREQ(cl, tkt, sessionKey, []int{gssapi.ContextFlagInteg, gssapi.ContextFlagMutual}, []int{flags.APOptionMutualRequired})
+	if err != nil {
+		t.Fatalf("error creating KRB5 token: %v", err)
+	}
+	mt, err := k5t.Marshal()
+	if err != nil {
+		t.Fatalf("error marshaling KRB5 token: %v", err)
+	}
+	nt := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mt,
+		},
+	}
+	b, err := nt.Marshal()
+	if err != nil {
+		t.Fatalf("error marshaling SPNEGO token: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), sessionKey
+}
+
+func TestNegotiate(t *testing.T) {
+	c, kt := testNegotiateConfig(t)
+	rt := NewRouter(c)
+	tok, sessionKey := testNegotiateToken(t, c, kt)
+
+	pb, _ := json.Marshal(NegotiateToken{Token: tok})
+	request, err := http.NewRequest("POST", fmt.Sprintf("/%s/negotiate", APIVersion), bytes.NewReader(pb))
+	if err != nil {
+		t.Fatalf("error building request: %v", err)
+	}
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusAccepted, response.Code, "Expected 202 Accepted")
+
+	i := new(identity.Identity)
+	err = json.Unmarshal(response.Body.Bytes(), i)
+	if err != nil {
+		t.Fatalf("Response cannot be unmarshaled into a identity struct: %v", err)
+	}
+	assert.True(t, i.Valid)
+	assert.Equal(t, "testuser1", i.LoginName)
+	assert.Equal(t, "TEST.GOKRB5", i.Domain)
+	assert.NotEqual(t, "", i.SessionID)
+
+	// The response token should be an accept-completed NegTokenResp carrying an AP_REP encrypted with the session key
+	rb, err := base64.StdEncoding.DecodeString(i.ResponseToken)
+	if err != nil {
+		t.Fatalf("response token not base64: %v", err)
+	}
+	var nt spnego.NegTokenResp
+	err = nt.Unmarshal(rb)
+	if err != nil {
+		t.Fatalf("response token not a NegTokenResp: %v", err)
+	}
+	assert.Equal(t, spnego.NegStateAcceptCompleted, spnego.NegState(nt.NegState))
+	var k5t spnego.KRB5Token
+	err = k5t.Unmarshal(nt.ResponseToken)
+	if err != nil {
+		t.Fatalf("response token does not contain a KRB5 token: %v", err)
+	}
+	assert.True(t, k5t.IsAPRep())
+	b, err := crypto.DecryptEncPart(k5t.APRep.EncPart, sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		t.Fatalf("could not decrypt AP_REP: %v", err)
+	}
+	var ep messages.EncAPRepPart
+	assert.NoError(t, ep.Unmarshal(b))
+
+	// Replaying the same token should be rejected
+	request, _ = http.NewRequest("POST", fmt.Sprintf("/%s/negotiate", APIVersion), nil)
+	request.Header.Set("Authorization", "Negotiate "+tok)
+	response = httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Expected 401 Unauthorized for replay")
+}
+
+func TestNegotiateBadToken(t *testing.T) {
+	c, _ := testNegotiateConfig(t)
+	rt := NewRouter(c)
+
+	pb, _ := json.Marshal(NegotiateToken{Token: base64.StdEncoding.EncodeToString([]byte("not a token"))})
+	request, _ := http.NewRequest("POST", fmt.Sprintf("/%s/negotiate", APIVersion), bytes.NewReader(pb))
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Expected 401 Unauthorized")
+
+	request, _ = http.NewRequest("POST", fmt.Sprintf("/%s/negotiate", APIVersion), bytes.NewReader([]byte("{}")))
+	response = httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Expected 400 Bad Request")
+}
@@ -0,0 +1,169 @@
+package httphandling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/adtype"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/pac"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/jcmturner/rpc/v2/mstypes"
+)
+
+// fileTimeNever is the FILETIME value the PAC uses to indicate an event will never happen.
+const fileTimeNever = 0x7fffffffffffffff
+
+// addIdentityInfo adds the information in the PAC of a user to user ticket to the identity.
+// The PAC is only checked against the session key from the user's TGT so it is marked as not verified.
+func addIdentityInfo(id *identity.Identity, creds identity.Credentials, tkt messages.Ticket, key types.EncryptionKey, c *config.Config) error {
+	isPAC, pacInfo, err := getPAC(tkt, key, c)
+	if isPAC && err != nil {
+		return err
+	}
+	if isPAC {
+		setPACIdentity(id, creds, pacInfo, c, identity.PACNotVerified)
+		return nil
+	}
+	id.PACStatus = identity.PACNotPresent
+	return nil
+}
+
+// addVerifiedIdentityInfo adds the information in the PAC of a ticket issued to the service to the identity.
+// The PAC's server checksum is verified with the service's key from the keytab. The KDC checksum is also verified if
+// the keytab holds the realm's krbtgt key.
+func addVerifiedIdentityInfo(id *identity.Identity, creds identity.Credentials, tkt messages.Ticket, c *config.Config) error {
+	spn := tkt.SName
+	if c.ServicePrincipal != "" {
+		spn, _ = types.ParseSPNString(c.ServicePrincipal)
+	}
+	key, _, err := c.Keytab.GetEncryptionKey(spn, tkt.Realm, tkt.EncPart.KVNO, tkt.EncPart.EType)
+	if err != nil {
+		return fmt.Errorf("could not get service key from keytab: %v", err)
+	}
+	isPAC, pacInfo, err := getPAC(tkt, key, c)
+	if !isPAC {
+		id.PACStatus = identity.PACNotPresent
+		return nil
+	}
+	if err != nil {
+		if pacInfo.KerbValidationInfo == nil {
+			return err
+		}
+		// The PAC could be decoded but the server checksum did not verify.
+		c.ApplicationLogf("PAC for %s@%s not verified: %v", creds.LoginName, creds.Domain, err)
+		setPACIdentity(id, creds, pacInfo, c, identity.PACNotVerified)
+		return nil
+	}
+	status, err := verifyKDCChecksum(pacInfo, tkt.Realm, c)
+	if err != nil {
+		c.ApplicationLogf("PAC KDC checksum for %s@%s not verified: %v", creds.LoginName, creds.Domain, err)
+	}
+	setPACIdentity(id, creds, pacInfo, c, status)
+	return nil
+}
+
+// setPACIdentity adds the PAC information to the identity. Group SIDs from a PAC that has not been verified are
+// only provided as UnverifiedGroups so they cannot be mistaken for verified group membership, and are not mapped to
+// names or roles.
+func setPACIdentity(id *identity.Identity, creds identity.Credentials, pacInfo pac.PACType, c *config.Config, status identity.PACStatus) {
+	dn := creds.LoginName
+	if pacInfo.KerbValidationInfo.FullName.String() != "" {
+		dn = pacInfo.KerbValidationInfo.FullName.String()
+	}
+	id.DisplayName = dn
+	id.PACStatus = status
+	kvi := pacInfo.KerbValidationInfo
+	id.DomainSID = kvi.LogonDomainID.String()
+	id.UserSID = fmt.Sprintf("%s-%d", id.DomainSID, kvi.UserID)
+	id.PrimaryGroupSID = fmt.Sprintf("%s-%d", id.DomainSID, kvi.PrimaryGroupID)
+	id.LogonDomainName = kvi.LogonDomainName.String()
+	id.LogonServer = kvi.LogonServer.String()
+	id.BadPasswordCount = int(kvi.BadPasswordCount)
+	id.LastSuccessfulLogon = fileTime(kvi.LastSuccessfulILogon)
+	id.PasswordLastSet = fileTime(kvi.PasswordLastSet)
+	id.PasswordCanChange = fileTime(kvi.PasswordCanChange)
+	id.PasswordMustChange = fileTime(kvi.PasswordMustChange)
+	id.UserAccountControl = kvi.UserAccountControl
+	if pacInfo.UPNDNSInfo != nil {
+		id.UPN = pacInfo.UPNDNSInfo.UPN
+		id.DNSDomain = pacInfo.UPNDNSInfo.DNSDomain
+	}
+	if status == identity.PACVerified || status == identity.PACServerVerified {
+		id.Groups = pacInfo.KerbValidationInfo.GetGroupMembershipSIDs()
+		id.GroupNames, id.Roles = c.GroupMap.Map(id.DomainSID, id.Groups)
+		return
+	}
+	id.UnverifiedGroups = pacInfo.KerbValidationInfo.GetGroupMembershipSIDs()
+}
+
+// fileTime converts a PAC FILETIME to a time. The zero time is returned for FILETIMEs that are not set or that
+// represent "never".
+func fileTime(ft mstypes.FileTime) time.Time {
+	if ft.MSEpoch() == 0 || ft.MSEpoch() == fileTimeNever {
+		return time.Time{}
+	}
+	return ft.Time()
+}
+
+// verifyKDCChecksum verifies the KDC checksum over the server checksum of a PAC whose server checksum has been
+// verified, and returns the resulting status of the PAC. This requires the realm's krbtgt key which is only available
+// if it has been included in the service's keytab. If the krbtgt key is not available the checksum cannot be checked
+// and the PAC is only ServerVerified.
+func verifyKDCChecksum(pacInfo pac.PACType, realm string, c *config.Config) (identity.PACStatus, error) {
+	if pacInfo.KDCChecksum == nil || pacInfo.ServerChecksum == nil {
+		return identity.PACNotVerified, errors.New("PAC does not contain a KDC checksum")
+	}
+	et, err := crypto.GetChksumEtype(int32(pacInfo.KDCChecksum.SignatureType))
+	if err != nil {
+		return identity.PACNotVerified, err
+	}
+	krbtgt := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm)
+	key, _, err := c.Keytab.GetEncryptionKey(krbtgt, realm, 0, et.GetETypeID())
+	if err != nil {
+		// The KDC checksum can only be verified by the KDC
+		return identity.PACServerVerified, nil
+	}
+	if !et.VerifyChecksum(key.KeyValue, pacInfo.ServerChecksum.Signature, pacInfo.KDCChecksum.Signature, keyusage.KERB_NON_KERB_CKSUM_SALT) {
+		return identity.PACNotVerified, errors.New("PAC KDC checksum verification failed")
+	}
+	return identity.PACVerified, nil
+}
+
+func getPAC(tkt messages.Ticket, key types.EncryptionKey, c *config.Config) (bool, pac.PACType, error) {
+	var isPAC bool
+	for _, ad := range tkt.DecryptedEncPart.AuthorizationData {
+		if ad.ADType == adtype.ADIfRelevant {
+			var ad2 types.AuthorizationData
+			err := ad2.Unmarshal(ad.ADData)
+			if err != nil {
+				continue
+			}
+			if ad2 == nil || len(ad2) < 1 {
+				continue
+			}
+			if ad2[0].ADType == adtype.ADWin2KPAC {
+				isPAC = true
+				var p pac.PACType
+				err = p.Unmarshal(ad2[0].ADData)
+				if err != nil {
+					c.Metrics.PACParseFailure()
+					return isPAC, p, fmt.Errorf("error unmarshaling PAC: %v", err)
+				}
+				err = p.ProcessPACInfoBuffers(key, c.Loggers.ApplicationWriter)
+				if err != nil && p.KerbValidationInfo == nil {
+					// The PAC's buffers could not be decoded, rather than its checksum not verifying
+					c.Metrics.PACParseFailure()
+				}
+				return isPAC, p, err
+			}
+		}
+	}
+	return isPAC, pac.PACType{}, nil
+}
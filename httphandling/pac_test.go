@@ -0,0 +1,99 @@
+package httphandling
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/pac"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPAC returns the reference PAC with its server checksum verified using the sysHTTP key.
+func testPAC(t *testing.T, c *config.Config) pac.PACType {
+	b, _ := hex.DecodeString(testdata.MarshaledPAC_AD_WIN2K_PAC)
+	var p pac.PACType
+	err := p.Unmarshal(b)
+	if err != nil {
+		t.Fatalf("error unmarshaling test PAC: %v", err)
+	}
+	b, _ = hex.DecodeString(testdata.KEYTAB_SYSHTTP_TEST_GOKRB5)
+	kt := keytab.New()
+	kt.Unmarshal(b)
+	pn, _ := types.ParseSPNString("sysHTTP")
+	key, _, err := kt.GetEncryptionKey(pn, "TEST.GOKRB5", 2, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatalf("error getting key: %v", err)
+	}
+	err = p.ProcessPACInfoBuffers(key, c.Loggers.ApplicationWriter)
+	if err != nil {
+		t.Fatalf("error processing test PAC: %v", err)
+	}
+	return p
+}
+
+func TestSetPACIdentity(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	p := testPAC(t, c)
+	creds := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5"}
+
+	var id identity.Identity
+	setPACIdentity(&id, creds, p, c, identity.PACVerified)
+	assert.Equal(t, identity.PACVerified, id.PACStatus)
+	assert.Equal(t, "Test1 User1", id.DisplayName)
+	assert.NotEmpty(t, id.Groups, "verified PAC should provide groups")
+	assert.Empty(t, id.UnverifiedGroups)
+	assert.Contains(t, id.GroupNames, "Domain Users")
+	assert.Equal(t, "S-1-5-21-3167651404-3865080224-2280184895-1105", id.UserSID)
+	assert.Equal(t, "S-1-5-21-3167651404-3865080224-2280184895", id.DomainSID)
+	assert.Equal(t, "S-1-5-21-3167651404-3865080224-2280184895-513", id.PrimaryGroupSID)
+	assert.Equal(t, "TEST", id.LogonDomainName)
+	assert.Equal(t, "ADDC", id.LogonServer)
+	assert.Equal(t, "testuser1@test.gokrb5", id.UPN)
+	assert.Equal(t, "TEST.GOKRB5", id.DNSDomain)
+	assert.Equal(t, time.Date(2017, 5, 6, 7, 23, 8, 968750000, time.UTC), id.PasswordLastSet)
+	assert.Equal(t, time.Date(2017, 5, 7, 7, 23, 8, 968750000, time.UTC), id.PasswordCanChange)
+	assert.True(t, id.PasswordMustChange.IsZero(), "password that never has to change should be the zero time")
+	assert.Equal(t, uint32(528), id.UserAccountControl)
+
+	id = identity.Identity{}
+	setPACIdentity(&id, creds, p, c, identity.PACServerVerified)
+	assert.Equal(t, identity.PACServerVerified, id.PACStatus)
+	assert.NotEmpty(t, id.Groups, "PAC with a verified server checksum should provide groups")
+	assert.Empty(t, id.UnverifiedGroups)
+
+	id = identity.Identity{}
+	setPACIdentity(&id, creds, p, c, identity.PACNotVerified)
+	assert.Equal(t, identity.PACNotVerified, id.PACStatus)
+	assert.Empty(t, id.Groups, "groups from an unverified PAC should not be provided as verified")
+	assert.Equal(t, p.KerbValidationInfo.GetGroupMembershipSIDs(), id.UnverifiedGroups)
+	assert.Empty(t, id.GroupNames, "groups from an unverified PAC should not be mapped")
+}
+
+func TestVerifyKDCChecksum(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	p := testPAC(t, c)
+
+	// Without the krbtgt key the KDC checksum cannot be checked
+	c.Keytab = keytab.New()
+	status, err := verifyKDCChecksum(p, "TEST.GOKRB5", c)
+	assert.Equal(t, identity.PACServerVerified, status, "only the server checksum is verified without the krbtgt key")
+	assert.NoError(t, err)
+
+	// A krbtgt key that did not sign the PAC
+	c.Keytab.AddEntry("krbtgt/TEST.GOKRB5", "TEST.GOKRB5", "notthekey", time.Now(), 1, etypeID.RC4_HMAC)
+	status, err = verifyKDCChecksum(p, "TEST.GOKRB5", c)
+	assert.Equal(t, identity.PACNotVerified, status, "KDC checksum should fail verification with the wrong krbtgt key")
+	assert.Error(t, err)
+
+	_, err = verifyKDCChecksum(pac.PACType{}, "TEST.GOKRB5", c)
+	assert.Error(t, err, "PAC without checksums should not verify")
+}
@@ -0,0 +1,237 @@
+package httphandling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/client"
+)
+
+// kpasswdResultRegexp matches the result code and text in the error returned by client.ChangePasswd when the kpasswd
+// server rejects the change.
+var kpasswdResultRegexp = regexp.MustCompile(`error response from kadmin: code: (\d+); result: (.*); krberror:`)
+
+// kpasswdNetworkErrRegexp matches the errors returned by client.ChangePasswd when no kpasswd server could be reached.
+// These follow a successful AS exchange and, unlike errors from the exchange, are not wrapped in a krberror.Krberror.
+var kpasswdNetworkErrRegexp = regexp.MustCompile(`^(error sending to a KDC: |error in getting a TCP connection to any of the KDCs)`)
+
+// kpasswdResultNames are the names of the RFC 3244 result codes.
+var kpasswdResultNames = map[int]string{
+	client.KRB5_KPASSWD_SUCCESS:             "KRB5_KPASSWD_SUCCESS",
+	client.KRB5_KPASSWD_MALFORMED:           "KRB5_KPASSWD_MALFORMED",
+	client.KRB5_KPASSWD_HARDERROR:           "KRB5_KPASSWD_HARDERROR",
+	client.KRB5_KPASSWD_AUTHERROR:           "KRB5_KPASSWD_AUTHERROR",
+	client.KRB5_KPASSWD_SOFTERROR:           "KRB5_KPASSWD_SOFTERROR",
+	client.KRB5_KPASSWD_ACCESSDENIED:        "KRB5_KPASSWD_ACCESSDENIED",
+	client.KRB5_KPASSWD_BAD_VERSION:         "KRB5_KPASSWD_BAD_VERSION",
+	client.KRB5_KPASSWD_INITIAL_FLAG_NEEDED: "KRB5_KPASSWD_INITIAL_FLAG_NEEDED",
+}
+
+func changePassword(c *config.Config, b *kdcBreaker, x *kdcLimiter, l *rateLimiter, n *negativeCache) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := c.Current()
+		creds, err := credsFromPost(c, r)
+		if err == nil && creds.NewPassword == "" {
+			err = errors.New("no new password provided")
+		}
+		if err != nil {
+			c.ApplicationLogf("bad request: %v", err)
+			respondGeneric(w, http.StatusBadRequest, "posted data invalid")
+			return
+		}
+		event, err := newEvent(r, actionPasswordChange, creds.LoginName, creds.Domain)
+		if err != nil {
+			c.ApplicationLogf("error generating new event: %v", err)
+			respondGeneric(w, http.StatusInternalServerError, "Error processing request")
+			return
+		}
+		event.Message = "new password change request"
+		c.EventLog(event)
+		// The current password is checked with the KDC so guesses are limited as for authentication
+		if ok, limit, retry := l.allow(creds, callerSource(r)); !ok {
+			rateLimitEvent(c, &event, limit, retry)
+			respondRateLimited(w, c, event, limit, retry)
+			return
+		}
+		ctx, cancel := x.context(r)
+		defer cancel()
+		var pc identity.PasswordChange
+		var perr error
+		// Once the change has been sent it is waited for so that the caller learns if the password was changed
+		err = x.exchangeAll(ctx, func() {
+			pc, perr = krbChangePassword(ctx, c, b, l, creds, event)
+		})
+		if err == nil && (perr == errAuthTimeout || perr == errCallerGone) {
+			// The change was not attempted
+			err = perr
+		}
+		if err != nil {
+			exchangeErrEvent(c, event, err)
+			respondExchangeErr(w, err)
+			return
+		}
+		if perr == errKDCUnavailable {
+			respondKDCUnavailable(w, b, identity.Identity{
+				Domain:    pc.Domain,
+				LoginName: pc.LoginName,
+				SessionID: pc.EventID,
+			})
+			return
+		}
+		if pc.Changed {
+			// Passwords rejected before the change may now be correct
+			n.purge(creds)
+		}
+		code := http.StatusOK
+		if !pc.Changed {
+			code = http.StatusBadRequest
+			if pc.ResultName == "" {
+				// The current credentials were rejected by the KDC
+				code = http.StatusUnauthorized
+			}
+		}
+		respondWithJSON(w, code, pc)
+		return
+	})
+}
+
+func krbChangePassword(ctx context.Context, c *config.Config, b *kdcBreaker, l *rateLimiter, creds identity.Credentials, event eventLog) (identity.PasswordChange, error) {
+	if ctx.Err() != nil {
+		return newPasswordChange(creds, event), contextErr(ctx)
+	}
+	if !c.KnownRealm(creds.Domain) {
+		pc := newPasswordChange(creds, event)
+		event.FailureReason = identity.ReasonUnknownRealm
+		if !c.HideFailureReason {
+			pc.FailureReason = event.FailureReason
+		}
+		validationErrEvent(c, &event, fmt.Errorf("password change not attempted - unknown realm %s", creds.Domain))
+		return pc, nil
+	}
+	if !b.allow(creds.Domain) {
+		event.FailureReason = identity.ReasonKDCUnreachable
+		validationErrEvent(c, &event, fmt.Errorf("password change not attempted - KDC circuit breaker open for realm %s", creds.Domain))
+		return newPasswordChange(creds, event), errKDCUnavailable
+	}
+
+	cl := client.NewWithPassword(creds.LoginName, creds.Domain, creds.Password, c.KRB5Conf, client.DisablePAFXFAST(true))
+	defer cl.Destroy()
+
+	return changePasswd(c, b, l, cl, creds, event)
+}
+
+func newPasswordChange(creds identity.Credentials, event eventLog) identity.PasswordChange {
+	return identity.PasswordChange{
+		Domain:     creds.Domain,
+		LoginName:  creds.LoginName,
+		ResultCode: -1,
+		EventID:    event.EventID,
+	}
+}
+
+// changePasswd changes the password of the client to the new password in the credentials and records the outcome in
+// the event log. The check of the current password is recorded with the rate limiter for the soft lockout.
+func changePasswd(c *config.Config, b *kdcBreaker, l *rateLimiter, cl *client.Client, creds identity.Credentials, event eventLog) (identity.PasswordChange, error) {
+	ok, err := cl.ChangePasswd(creds.NewPassword)
+	return passwdChanged(c, b, l, creds, event, ok, err)
+}
+
+// passwdChanged records the outcome of a password change with the circuit breaker, the rate limiter and the event log
+// and returns it for the caller.
+func passwdChanged(c *config.Config, b *kdcBreaker, l *rateLimiter, creds identity.Credentials, event eventLog, ok bool, err error) (identity.PasswordChange, error) {
+	pc := newPasswordChange(creds, event)
+	if ok {
+		b.success(creds.Domain)
+		l.result(creds, "")
+		pc.Changed = true
+		pc.ResultCode = client.KRB5_KPASSWD_SUCCESS
+		pc.ResultName = kpasswdResultNames[pc.ResultCode]
+		event.Message = "password change successful"
+		event.Validated = true
+		event.ValidationSuccessful = true
+		event.PasswordChanged = true
+		event.Time = time.Now().UTC()
+		c.EventLog(event)
+		return pc, nil
+	}
+	if code, result, isKpasswd := kpasswdResult(err); isKpasswd {
+		// The KDC accepted the current credentials but the kpasswd server rejected the change
+		b.success(creds.Domain)
+		l.result(creds, "")
+		pc.ResultCode = code
+		pc.ResultName = kpasswdResultNames[code]
+		pc.Result = result
+		pc.FailureReason = identity.ReasonPasswordRejected
+		event.Validated = true
+		event.ValidationSuccessful = true
+		event.FailureReason = pc.FailureReason
+		event.KPasswdResultCode = code
+		event.Message = fmt.Sprintf("password change rejected: %s %s", pc.ResultName, result)
+		event.Time = time.Now().UTC()
+		c.EventLog(event)
+		return pc, nil
+	}
+	if kpasswdUnreachable(err) {
+		// The KDC accepted the current credentials but the change could not be sent. The KDC answered so this is a
+		// success for the breaker.
+		b.success(creds.Domain)
+		l.result(creds, "")
+		event.FailureReason = identity.ReasonKDCUnreachable
+		if !c.HideFailureReason {
+			pc.FailureReason = event.FailureReason
+		}
+		event.Validated = true
+		event.ValidationSuccessful = true
+		event.Message = fmt.Sprintf("password change failed - kpasswd server unreachable: %v", err)
+		event.Time = time.Now().UTC()
+		c.EventLog(event)
+		return pc, errKDCUnavailable
+	}
+	event.FailureReason, event.KRBErrorCode = failureReason(err)
+	if !c.HideFailureReason {
+		pc.FailureReason = event.FailureReason
+	}
+	validationErrEvent(c, &event, fmt.Errorf("password change failed: %v", err))
+	if event.FailureReason == identity.ReasonKDCUnreachable {
+		b.failure(creds.Domain)
+		return pc, errKDCUnavailable
+	}
+	b.success(creds.Domain)
+	if l.result(creds, event.FailureReason) {
+		lockoutEvent(c, event)
+	}
+	return pc, nil
+}
+
+// kpasswdResult extracts the result code and text from the error returned by client.ChangePasswd.
+// The bool returned indicates if the error was a rejection from the kpasswd server.
+func kpasswdResult(err error) (int, string, bool) {
+	m := kpasswdResultRegexp.FindStringSubmatch(err.Error())
+	if len(m) != 3 {
+		return 0, "", false
+	}
+	code, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return code, m[2], true
+}
+
+// kpasswdUnreachable indicates if the error returned by client.ChangePasswd is a failure to reach the kpasswd server
+// after the current credentials were accepted.
+func kpasswdUnreachable(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) {
+		// Resolving the kpasswd servers from DNS failed
+		return true
+	}
+	return kpasswdNetworkErrRegexp.MatchString(err.Error())
+}
@@ -0,0 +1,151 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKpasswdResult(t *testing.T) {
+	err := fmt.Errorf("error response from kadmin: code: %d; result: %s; krberror: %v", client.KRB5_KPASSWD_SOFTERROR, "Password too short", errors.New("KRB Error: (0) KDC_ERR_NONE No error"))
+	code, result, ok := kpasswdResult(err)
+	assert.True(t, ok)
+	assert.Equal(t, client.KRB5_KPASSWD_SOFTERROR, code)
+	assert.Equal(t, "Password too short", result)
+
+	_, _, ok = kpasswdResult(errors.New("[Root cause: KDC_Error] KDC_Error: AS Exchange Error"))
+	assert.False(t, ok)
+}
+
+func TestKpasswdUnreachable(t *testing.T) {
+	assert.True(t, kpasswdUnreachable(errors.New("error sending to a KDC: error sending to (127.0.0.1:464): connection refused")))
+	assert.True(t, kpasswdUnreachable(errors.New("error in getting a TCP connection to any of the KDCs")))
+	assert.True(t, kpasswdUnreachable(&net.DNSError{Err: "no such host", Name: "_kpasswd._udp.TEST.GOKRB5", IsNotFound: true}))
+	// Errors from the AS exchange are classified from the KDC's response
+	assert.False(t, kpasswdUnreachable(errors.New("[Root cause: Networking_Error] Networking_Error: AS Exchange Error: failed sending AS_REQ to KDC: error sending to a KDC")))
+	assert.False(t, kpasswdUnreachable(fmt.Errorf("error response from kadmin: code: %d; result: %s; krberror: <nil>", client.KRB5_KPASSWD_SOFTERROR, "Password too short")))
+}
+
+func TestPasswdChangedKpasswdUnreachable(t *testing.T) {
+	c := &config.Config{
+		KDCFailureThreshold: 1,
+		KDCCoolDown:         time.Millisecond * 10,
+	}
+	c.SetApplicationLog("null")
+	c.SetEventLogWriter(json.NewEncoder(ioutil.Discard))
+	b := newKDCBreaker(c)
+	creds := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5", Password: "passwordvalue", NewPassword: "newpasswordvalue"}
+	b.failure(creds.Domain)
+	time.Sleep(c.KDCCoolDown)
+	assert.True(t, b.allow(creds.Domain))
+	assert.Equal(t, BreakerHalfOpen, b.status()[creds.Domain].State)
+
+	// The trial reached the KDC but not the kpasswd server
+	pc, err := passwdChanged(c, b, newRateLimiter(c), creds, eventLog{EventID: "abc"}, false, errors.New("error sending to a KDC: error sending to (127.0.0.1:464): connection refused"))
+	assert.Equal(t, errKDCUnavailable, err)
+	assert.False(t, pc.Changed)
+	assert.True(t, b.allow(creds.Domain), "breaker should close as the KDC answered")
+	assert.Empty(t, b.status())
+}
+
+func TestChangePasswordBadRequest(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	rt := NewRouter(c)
+
+	// No new password in the form data
+	f := url.Values{}
+	f.Set("login-name", "testuser1")
+	f.Set("domain", "TEST.GOKRB5")
+	f.Set("password", "passwordvalue")
+	request, err := http.NewRequest("POST", fmt.Sprintf("/%s/password", APIVersion), strings.NewReader(f.Encode()))
+	if err != nil {
+		t.Fatalf("error building request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Expected 400 Bad Request")
+}
+
+func TestChangePasswordKDCUnavailable(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	rt := NewRouter(c)
+
+	cred := identity.Credentials{
+		LoginName:   "testuser1",
+		Domain:      "TEST.GOKRB5",
+		Password:    "passwordvalue",
+		NewPassword: "newpasswordvalue",
+	}
+	pb, _ := json.Marshal(cred)
+	request, err := http.NewRequest("POST", fmt.Sprintf("/%s/password", APIVersion), bytes.NewReader(pb))
+	if err != nil {
+		t.Fatalf("error building request: %v", err)
+	}
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Expected 503 Service Unavailable")
+}
+
+func TestChangePasswordSoftLockout(t *testing.T) {
+	addr, _, stop := fakeKDC(t, errorcode.KDC_ERR_PREAUTH_FAILED)
+	defer stop()
+	c := readinessConfig(t, fmt.Sprintf(" UP.GOKRB5 = {\n  kdc = %s\n }\n", addr))
+	c.LockoutThreshold = 2
+	c.LockoutDuration = time.Minute
+	rt := NewRouter(c)
+
+	pb, _ := json.Marshal(identity.Credentials{
+		LoginName:   "testuser1",
+		Domain:      "UP.GOKRB5",
+		Password:    "wrongpassword",
+		NewPassword: "newpasswordvalue",
+	})
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("POST", "/"+APIVersion+"/password", bytes.NewReader(pb))
+		response := httptest.NewRecorder()
+		rt.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code, "attempt %d should be passed to the KDC", i+1)
+	}
+
+	// Invalid current passwords count towards the soft lockout shared with authentication
+	for _, path := range []string{"/" + APIVersion + "/password", "/" + APIVersion + "/authenticate"} {
+		request, _ := http.NewRequest("POST", path, bytes.NewReader(pb))
+		response := httptest.NewRecorder()
+		rt.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusTooManyRequests, response.Code, "%s should be refused", path)
+		var e JSONRateLimitedResponse
+		json.Unmarshal(response.Body.Bytes(), &e)
+		assert.Equal(t, LimitLockout, e.Limit)
+	}
+}
@@ -0,0 +1,133 @@
+package httphandling
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jcmturner/authenvoy/config"
+)
+
+// PeerCred identifies the process that connected to the Unix domain socket.
+type PeerCred struct {
+	UID uint32 `json:"UID"`
+	GID uint32 `json:"GID"`
+	PID int32  `json:"PID"`
+}
+
+// peerCredKey is the context key of the peer credentials of a connection.
+type peerCredKey struct{}
+
+// connContext adds the peer credentials of connections to the Unix domain socket to the connection's context. If
+// they cannot be read the connection has none and is refused if callers are restricted.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	p, err := readPeerCred(uc)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, p)
+}
+
+// peerCred returns the credentials of the process that made the request, or nil if it was not made over the Unix
+// domain socket.
+func peerCred(r *http.Request) *PeerCred {
+	p, _ := r.Context().Value(peerCredKey{}).(*PeerCred)
+	return p
+}
+
+// callerSource returns the address of the caller for rate limiting. Callers over the Unix domain socket have no
+// address so are identified by their user ID.
+func callerSource(r *http.Request) string {
+	if p := peerCred(r); p != nil {
+		return fmt.Sprintf("uid:%d", p.UID)
+	}
+	return sourceAddr(r.RemoteAddr)
+}
+
+// checkPeer refuses requests from processes not in the allowlist of users and groups.
+func checkPeer(inner http.Handler, c *config.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.PeerRestricted() {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		p := peerCred(r)
+		if p == nil {
+			c.ApplicationLogf("request refused: caller's peer credentials not available")
+			respondGeneric(w, http.StatusForbidden, "caller not allowed")
+			return
+		}
+		if !c.PeerAllowed(p.UID, p.GID) {
+			c.ApplicationLogf("request refused: caller UID %d GID %d PID %d not allowed", p.UID, p.GID, p.PID)
+			respondGeneric(w, http.StatusForbidden, "caller not allowed")
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// unixListener is a Unix domain socket listener that removes the socket at its path when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// ListenUnix listens on the configured Unix domain socket, replacing a stale socket left at the path. The socket is
+// created in a private directory beside the path and only linked into place once it has been given the configured
+// mode, owner and group, so that it is never more open than that.
+func ListenUnix(c *config.Config) (net.Listener, error) {
+	if fi, err := os.Lstat(c.Socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", c.Socket)
+		}
+		if conn, err := net.Dial("unix", c.Socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", c.Socket)
+		}
+		err = os.Remove(c.Socket)
+		if err != nil {
+			return nil, fmt.Errorf("could not remove stale socket: %v", err)
+		}
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(c.Socket), ".sock")
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory for socket: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: p, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed at its configured path instead
+	ln.SetUnlinkOnClose(false)
+	err = os.Chmod(p, c.SocketMode.Perm())
+	if err == nil && (c.SocketUID != -1 || c.SocketGID != -1) {
+		err = os.Chown(p, c.SocketUID, c.SocketGID)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not set permissions of socket: %v", err)
+	}
+	// Linking fails rather than replacing a socket created at the path since the stale socket was removed
+	err = os.Link(p, c.Socket)
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not create socket: %v", err)
+	}
+	return &unixListener{UnixListener: ln, path: c.Socket}, nil
+}
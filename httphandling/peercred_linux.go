@@ -0,0 +1,26 @@
+package httphandling
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCred reads the credentials of the process connected to the Unix domain socket with SO_PEERCRED.
+func readPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var uerr error
+	err = rc.Control(func(fd uintptr) {
+		ucred, uerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+	return &PeerCred{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package httphandling
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCred returns an error as reading the peer credentials of a Unix domain socket is only supported on Linux.
+func readPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
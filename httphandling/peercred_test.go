@@ -0,0 +1,130 @@
+package httphandling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// unixClient returns an HTTP client that connects to the Unix domain socket.
+func unixClient(p string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", p)
+			},
+		},
+	}
+}
+
+func TestListenUnixPeerCred(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(krb5Conf)
+	dir, _ := ioutil.TempDir(os.TempDir(), "TEST-socket")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "authenvoy.sock")
+
+	c, err := config.New(8088, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	var b bytes.Buffer
+	c.SetAccessLogWriter(json.NewEncoder(&b))
+	err = c.SetSocket(p, "", "", "600")
+	if err != nil {
+		t.Fatalf("could not set socket: %v", err)
+	}
+
+	// A file at the path that is not a socket is not replaced
+	ioutil.WriteFile(p, []byte("not a socket"), 0600)
+	_, err = ListenUnix(c)
+	assert.Error(t, err)
+	os.Remove(p)
+
+	ln, err := ListenUnix(c)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("could not stat socket: %v", err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1, "only the socket should be left in its directory")
+	_, err = ListenUnix(c)
+	assert.Error(t, err, "a socket in use should not be replaced")
+
+	srv := NewServer(c, p, NewRouter(c))
+	go srv.Serve(ln)
+	defer srv.Close()
+	cl := unixClient(p)
+
+	resp, err := cl.Get("http://authenvoy/healthz")
+	if err != nil {
+		t.Fatalf("could not call over socket: %v", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var l accessLog
+	err = json.NewDecoder(&b).Decode(&l)
+	if err != nil {
+		t.Fatalf("could not decode access log: %v", err)
+	}
+	if assert.NotNil(t, l.Peer, "access log should identify the calling process") {
+		assert.Equal(t, uint32(os.Getuid()), l.Peer.UID)
+		assert.Equal(t, uint32(os.Getgid()), l.Peer.GID)
+		assert.Equal(t, int32(os.Getpid()), l.Peer.PID)
+	}
+
+	srv.Close()
+	_, err = os.Stat(p)
+	assert.True(t, os.IsNotExist(err), "socket should be removed when the server closes")
+}
+
+func TestCheckPeer(t *testing.T) {
+	c := &config.Config{AllowUIDs: []uint32{1000}, AllowGIDs: []uint32{2000}}
+	c.SetApplicationLog("null")
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, test := range []struct {
+		peer *PeerCred
+		code int
+	}{
+		{&PeerCred{UID: 1000, GID: 1, PID: 42}, http.StatusOK},
+		{&PeerCred{UID: 1001, GID: 2000, PID: 42}, http.StatusOK},
+		{&PeerCred{UID: 1001, GID: 1, PID: 42}, http.StatusForbidden},
+		// Callers without peer credentials cannot be checked
+		{nil, http.StatusForbidden},
+	} {
+		request, _ := http.NewRequest("GET", "/healthz", nil)
+		if test.peer != nil {
+			request = request.WithContext(context.WithValue(request.Context(), peerCredKey{}, test.peer))
+		}
+		response := httptest.NewRecorder()
+		checkPeer(inner, c).ServeHTTP(response, request)
+		assert.Equal(t, test.code, response.Code, "peer %+v", test.peer)
+	}
+}
+
+func TestNewEventPeer(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/v1/authenticate", nil)
+	event, _ := newEvent(request, actionAuthenticate, "testuser1", "TEST.GOKRB5")
+	assert.Nil(t, event.Peer)
+	p := &PeerCred{UID: 1000, GID: 1000, PID: 42}
+	event, _ = newEvent(request.WithContext(context.WithValue(request.Context(), peerCredKey{}, p)), actionAuthenticate, "testuser1", "TEST.GOKRB5")
+	assert.Equal(t, p, event.Peer, "event should identify the calling process")
+	assert.Equal(t, "uid:1000", callerSource(request.WithContext(context.WithValue(request.Context(), peerCredKey{}, p))))
+}
@@ -0,0 +1,226 @@
+package httphandling
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+)
+
+// Rate limits reported when an authentication attempt is refused.
+const (
+	LimitLoginName = "LoginName"
+	LimitSource    = "Source"
+	LimitClientIP  = "ClientIP"
+	LimitLockout   = "Lockout"
+)
+
+// rateLimitSweepInterval is the minimum period between removals of idle buckets and ended lockouts.
+const rateLimitSweepInterval = time.Minute
+
+// bucket is a token bucket holding up to a minute's allowance of attempts.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// lockout counts the consecutive invalid credential failures of a login name.
+type lockout struct {
+	failures    int
+	lastFailure time.Time
+	until       time.Time
+}
+
+// rateLimiter limits authentication attempts per login name, per calling address and per end user IP address, and
+// stops attempts for a login name reaching the KDC after repeated invalid credentials.
+type rateLimiter struct {
+	c         *config.Config
+	mux       sync.Mutex
+	buckets   map[string]*bucket
+	lockouts  map[string]*lockout
+	lastSweep time.Time
+}
+
+func newRateLimiter(c *config.Config) *rateLimiter {
+	return &rateLimiter{
+		c:        c,
+		buckets:  make(map[string]*bucket),
+		lockouts: make(map[string]*lockout),
+	}
+}
+
+// userKey identifies a login name within its domain.
+func userKey(loginName, domain string) string {
+	return strings.ToLower(loginName) + "@" + strings.ToUpper(domain)
+}
+
+// sourceAddr returns the IP address of the caller without the port.
+func sourceAddr(r string) string {
+	h, _, err := net.SplitHostPort(r)
+	if err != nil {
+		return r
+	}
+	return h
+}
+
+// allow indicates if an authentication attempt should be made. If not, the limit that was hit and the period after
+// which an attempt may be allowed are returned. An attempt is only counted against the limits if it is allowed.
+func (l *rateLimiter) allow(creds identity.Credentials, source string) (bool, string, time.Duration) {
+	now := time.Now().UTC()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	user := userKey(creds.LoginName, creds.Domain)
+	if lo, ok := l.lockouts[user]; ok && now.Before(lo.until) {
+		return false, LimitLockout, lo.until.Sub(now)
+	}
+	type check struct {
+		limit string
+		key   string
+		rate  int
+	}
+	checks := []check{
+		{LimitLoginName, user, l.c.Current().RateLimitUser},
+		{LimitSource, source, l.c.Current().RateLimitSource},
+	}
+	if creds.ClientIP != "" {
+		checks = append(checks, check{LimitClientIP, creds.ClientIP, l.c.Current().RateLimitClientIP})
+	}
+	var take []*bucket
+	for _, ch := range checks {
+		if ch.rate <= 0 {
+			continue
+		}
+		k := ch.limit + ":" + ch.key
+		b, ok := l.buckets[k]
+		if !ok {
+			b = &bucket{tokens: float64(ch.rate), last: now}
+			l.buckets[k] = b
+		}
+		// Refill the bucket for the time since it was last used
+		perSec := float64(ch.rate) / time.Minute.Seconds()
+		b.tokens += now.Sub(b.last).Seconds() * perSec
+		if b.tokens > float64(ch.rate) {
+			b.tokens = float64(ch.rate)
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return false, ch.limit, time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+		}
+		take = append(take, b)
+	}
+	for _, b := range take {
+		b.tokens--
+	}
+	return true, "", 0
+}
+
+// result records the outcome of an authentication attempt for the soft lockout. It returns true if the login name
+// has just been locked out.
+func (l *rateLimiter) result(creds identity.Credentials, reason identity.FailureReason) bool {
+	if l.c.Current().LockoutThreshold <= 0 {
+		return false
+	}
+	now := time.Now().UTC()
+	user := userKey(creds.LoginName, creds.Domain)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if reason != identity.ReasonInvalidCredentials {
+		if reason == "" {
+			// A successful login resets the count as the directory does
+			delete(l.lockouts, user)
+		}
+		return false
+	}
+	lo, ok := l.lockouts[user]
+	if !ok || now.Sub(lo.lastFailure) >= l.c.Current().LockoutDuration {
+		// Failures older than the lockout duration are not counted
+		lo = new(lockout)
+		l.lockouts[user] = lo
+	}
+	lo.failures++
+	lo.lastFailure = now
+	if lo.failures >= l.c.Current().LockoutThreshold {
+		lo.until = now.Add(l.c.Current().LockoutDuration)
+		lo.failures = 0
+		return true
+	}
+	return false
+}
+
+// sweep removes buckets that have refilled and lockouts that have ended. The caller must hold the lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+	for k, lo := range l.lockouts {
+		if now.Sub(lo.lastFailure) >= l.c.Current().LockoutDuration && !now.Before(lo.until) {
+			delete(l.lockouts, k)
+		}
+	}
+}
+
+// rateLimitEvent records an authentication attempt refused by a rate limit or the soft lockout.
+func rateLimitEvent(c *config.Config, event *eventLog, limit string, retry time.Duration) {
+	event.FailureReason = identity.ReasonRateLimited
+	if limit == LimitLockout {
+		event.FailureReason = identity.ReasonSoftLockout
+	}
+	event.RateLimit = limit
+	event.Message = fmt.Sprintf("authentication not attempted - %s limit reached, retry after %v", limit, retry.Round(time.Second))
+	event.Validated = false
+	event.Time = time.Now().UTC()
+	c.EventLog(*event)
+}
+
+// lockoutEvent records that a login name has been locked out after repeated invalid credentials.
+func lockoutEvent(c *config.Config, event eventLog) {
+	event.FailureReason = identity.ReasonSoftLockout
+	event.RateLimit = LimitLockout
+	event.Message = fmt.Sprintf("soft lockout of %s@%s for %v after %d invalid credential failures", event.LoginName,
+		event.Domain, c.LockoutDuration, c.LockoutThreshold)
+	event.Time = time.Now().UTC()
+	c.EventLog(event)
+}
+
+// JSONRateLimitedResponse is the JSON response when an authentication attempt is refused by a rate limit or the soft
+// lockout.
+type JSONRateLimitedResponse struct {
+	Message   string
+	HTTPCode  int
+	Domain    string
+	LoginName string
+	SessionID string
+	Limit     string `json:",omitempty"`
+}
+
+func respondRateLimited(w http.ResponseWriter, c *config.Config, event eventLog, limit string, retry time.Duration) {
+	e := JSONRateLimitedResponse{
+		Message:   "too many authentication attempts",
+		HTTPCode:  http.StatusTooManyRequests,
+		Domain:    event.Domain,
+		LoginName: event.LoginName,
+		SessionID: event.EventID,
+	}
+	if !c.HideFailureReason {
+		e.Limit = limit
+	}
+	secs := int(math.Ceil(retry.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	respondWithJSON(w, http.StatusTooManyRequests, e)
+}
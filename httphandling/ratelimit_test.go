@@ -0,0 +1,119 @@
+package httphandling
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	c := &config.Config{
+		RateLimitUser:     2,
+		RateLimitSource:   3,
+		RateLimitClientIP: 1,
+	}
+	l := newRateLimiter(c)
+	u1 := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5"}
+	u2 := identity.Credentials{LoginName: "testuser2", Domain: "TEST.GOKRB5"}
+
+	ok, _, _ := l.allow(u1, "127.0.0.1")
+	assert.True(t, ok)
+	ok, _, _ = l.allow(identity.Credentials{LoginName: "TestUser1", Domain: "test.gokrb5"}, "127.0.0.1")
+	assert.True(t, ok)
+	ok, limit, retry := l.allow(u1, "127.0.0.1")
+	assert.False(t, ok, "login name should be limited regardless of case")
+	assert.Equal(t, LimitLoginName, limit)
+	assert.True(t, retry > 0 && retry <= time.Minute/2, "retry after should be the time to the next token: %v", retry)
+
+	ok, _, _ = l.allow(u2, "127.0.0.1")
+	assert.True(t, ok, "refused attempts should not count against the source limit")
+	ok, limit, _ = l.allow(u2, "127.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, LimitSource, limit)
+	ok, _, _ = l.allow(u2, "127.0.0.2")
+	assert.True(t, ok, "source limit should be per address")
+
+	u3 := identity.Credentials{LoginName: "testuser3", Domain: "TEST.GOKRB5", ClientIP: "10.0.0.1"}
+	ok, _, _ = l.allow(u3, "127.0.0.3")
+	assert.True(t, ok)
+	u3.LoginName = "testuser4"
+	ok, limit, _ = l.allow(u3, "127.0.0.3")
+	assert.False(t, ok)
+	assert.Equal(t, LimitClientIP, limit)
+}
+
+func TestSoftLockout(t *testing.T) {
+	c := &config.Config{
+		LockoutThreshold: 3,
+		LockoutDuration:  time.Millisecond * 100,
+	}
+	l := newRateLimiter(c)
+	u := identity.Credentials{LoginName: "testuser1", Domain: "TEST.GOKRB5"}
+
+	assert.False(t, l.result(u, identity.ReasonInvalidCredentials))
+	assert.False(t, l.result(u, identity.ReasonInvalidCredentials))
+	l.result(u, "")
+	assert.False(t, l.result(u, identity.ReasonInvalidCredentials), "successful login should reset the count")
+	assert.False(t, l.result(u, identity.ReasonInvalidCredentials))
+	assert.False(t, l.result(u, identity.ReasonUnknownPrincipal), "only invalid credentials should be counted")
+	ok, _, _ := l.allow(u, "127.0.0.1")
+	assert.True(t, ok)
+	assert.True(t, l.result(u, identity.ReasonInvalidCredentials), "login name should be locked out at the threshold")
+
+	ok, limit, retry := l.allow(u, "127.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, LimitLockout, limit)
+	assert.True(t, retry > 0 && retry <= c.LockoutDuration)
+	ok, _, _ = l.allow(identity.Credentials{LoginName: "testuser2", Domain: "TEST.GOKRB5"}, "127.0.0.1")
+	assert.True(t, ok, "lockout should be per login name")
+
+	time.Sleep(c.LockoutDuration)
+	ok, _, _ = l.allow(u, "127.0.0.1")
+	assert.True(t, ok, "lockout should end after the duration")
+}
+
+func TestAuthenticateRateLimited(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	// Point the realm at a port nothing is listening on
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	c.RateLimitUser = 1
+	rt := NewRouter(c)
+
+	pb, _ := json.Marshal(identity.Credentials{
+		LoginName: "testuser1",
+		Domain:    "TEST.GOKRB5",
+		Password:  "passwordvalue",
+	})
+	request, _ := http.NewRequest("POST", "/"+APIVersion+"/authenticate", bytes.NewReader(pb))
+	response := httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "first attempt should be passed to the KDC")
+
+	request, _ = http.NewRequest("POST", "/"+APIVersion+"/authenticate", bytes.NewReader(pb))
+	response = httptest.NewRecorder()
+	rt.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.NotEmpty(t, response.Header().Get("Retry-After"))
+	var e JSONRateLimitedResponse
+	err = json.Unmarshal(response.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	assert.Equal(t, LimitLoginName, e.Limit)
+	assert.Equal(t, "testuser1", e.LoginName)
+}
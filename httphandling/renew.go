@@ -0,0 +1,294 @@
+package httphandling
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Errors returned when a session cannot be renewed.
+var (
+	errSessionNotFound     = errors.New("session not found")
+	errSessionNotRenewable = errors.New("session is not renewable")
+	errRenewTillReached    = errors.New("session renewal period has ended")
+)
+
+// sessionTGT is the TGT of a session and the details needed to renew it.
+// The key is held as separate fields as types.EncryptionKey does not marshal its value to JSON.
+type sessionTGT struct {
+	Ticket   []byte              `json:"Ticket"`
+	KeyType  int32               `json:"KeyType"`
+	KeyValue []byte              `json:"KeyValue"`
+	CName    types.PrincipalName `json:"CName"`
+	CRealm   string              `json:"CRealm"`
+}
+
+// key returns the session key of the TGT.
+func (st sessionTGT) key() types.EncryptionKey {
+	return types.EncryptionKey{
+		KeyType:  st.KeyType,
+		KeyValue: st.KeyValue,
+	}
+}
+
+// renewable indicates if a ticket with the flags and renew till time provided can still be renewed.
+func renewable(f asn1.BitString, renewTill time.Time) bool {
+	if len(f.Bytes) < 4 {
+		// Not a valid set of ticket flags
+		return false
+	}
+	return types.IsFlagSet(&f, flags.Renewable) && time.Now().UTC().Before(renewTill)
+}
+
+// sealTGT encrypts the TGT so that it is not held in memory in the clear.
+func (s *sessionStore) sealTGT(tkt messages.Ticket, key types.EncryptionKey, cname types.PrincipalName, crealm string) ([]byte, error) {
+	if s.tgtKey == nil {
+		return nil, errors.New("no key to encrypt TGT")
+	}
+	tb, err := tkt.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal TGT: %v", err)
+	}
+	b, err := json.Marshal(sessionTGT{
+		Ticket:   tb,
+		KeyType:  key.KeyType,
+		KeyValue: key.KeyValue,
+		CName:    cname,
+		CRealm:   crealm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := s.tgtCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, b, nil), nil
+}
+
+// openTGT decrypts a TGT sealed by sealTGT.
+func (s *sessionStore) openTGT(b []byte) (messages.Ticket, sessionTGT, error) {
+	var tkt messages.Ticket
+	var st sessionTGT
+	gcm, err := s.tgtCipher()
+	if err != nil {
+		return tkt, st, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return tkt, st, errors.New("encrypted TGT too short")
+	}
+	pt, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return tkt, st, fmt.Errorf("could not decrypt TGT: %v", err)
+	}
+	err = json.Unmarshal(pt, &st)
+	if err != nil {
+		return tkt, st, err
+	}
+	err = tkt.Unmarshal(st.Ticket)
+	if err != nil {
+		return tkt, st, fmt.Errorf("could not unmarshal TGT: %v", err)
+	}
+	return tkt, st, nil
+}
+
+func (s *sessionStore) tgtCipher() (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(s.tgtKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// sessionRenewal is what is needed from a session, besides its identity, to renew it.
+type sessionRenewal struct {
+	audience    string
+	tokenIssued bool
+	tgt         []byte
+}
+
+// renewal returns the identity of a session that can be renewed and what is needed to renew it.
+func (s *sessionStore) renewal(sid string, peer *PeerCred) (identity.Identity, sessionRenewal, error) {
+	now := time.Now().UTC()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ss, ok := s.sessions[sid]
+	if !ok {
+		return identity.Identity{}, sessionRenewal{}, errSessionNotFound
+	}
+	if s.expired(ss, now) {
+		s.remove(ss, "session expired", peer)
+		s.persist()
+		return identity.Identity{}, sessionRenewal{}, errSessionNotFound
+	}
+	if ss.tgt == nil {
+		return ss.Identity, sessionRenewal{}, errSessionNotRenewable
+	}
+	if !now.Before(ss.Identity.RenewTill) {
+		return ss.Identity, sessionRenewal{}, errRenewTillReached
+	}
+	return ss.Identity, sessionRenewal{audience: ss.Audience, tokenIssued: ss.TokenIssued, tgt: ss.tgt}, nil
+}
+
+// renewed updates a session with the identity and TGT from a renewal.
+func (s *sessionStore) renewed(id identity.Identity, tgt []byte) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ss, ok := s.sessions[id.SessionID]
+	if !ok {
+		// The session was ended while it was being renewed
+		return
+	}
+	ss.Identity = id
+	ss.Identity.Token = ""
+	ss.LastAccess = time.Now().UTC()
+	ss.persistedAccess = ss.LastAccess
+	ss.tgt = tgt
+	s.persist()
+}
+
+// end removes a session that can no longer be renewed and records the reason.
+func (s *sessionStore) end(id identity.Identity, msg string, peer *PeerCred) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if ss, ok := s.sessions[id.SessionID]; ok {
+		s.remove(ss, msg, peer)
+		s.persist()
+	}
+}
+
+func renewSession(c *config.Config, b *kdcBreaker, x *kdcLimiter, s *sessionStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := c.Current()
+		peer := peerCred(r)
+		id, sr, err := s.renewal(mux.Vars(r)["id"], peer)
+		switch err {
+		case errSessionNotFound:
+			respondGeneric(w, http.StatusNotFound, err.Error())
+			return
+		case errSessionNotRenewable, errRenewTillReached:
+			sessionEvent(c, peer, id, actionSessionRenew, fmt.Sprintf("session renewal not possible: %v", err))
+			respondGeneric(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		event := eventLog{
+			EventID:   id.SessionID,
+			Action:    actionSessionRenew,
+			LoginName: id.LoginName,
+			Domain:    id.Domain,
+			Peer:      peer,
+		}
+		ctx, cancel := x.context(r)
+		defer cancel()
+		var rerr error
+		err = x.exchange(ctx, func() {
+			id, rerr = krbRenew(ctx, c, b, s, id, sr, event)
+		})
+		if err != nil {
+			exchangeErrEvent(c, event, err)
+			respondExchangeErr(w, err)
+			return
+		}
+		err = rerr
+		if err == errKDCUnavailable {
+			respondKDCUnavailable(w, b, id)
+			return
+		}
+		if err != nil {
+			respondGeneric(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !id.Valid {
+			respondWithJSON(w, http.StatusUnauthorized, id)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, id)
+		return
+	})
+}
+
+// krbRenew renews the session's TGT with the KDC. If the KDC refuses the renewal, for example because the account has
+// been disabled, the session is ended.
+func krbRenew(ctx context.Context, c *config.Config, b *kdcBreaker, s *sessionStore, id identity.Identity, sr sessionRenewal, event eventLog) (identity.Identity, error) {
+	if ctx.Err() != nil {
+		return id, contextErr(ctx)
+	}
+	tkt, st, err := s.openTGT(sr.tgt)
+	if err != nil {
+		validationErrEvent(c, &event, fmt.Errorf("session renewal failed: %v", err))
+		return id, errSessionNotRenewable
+	}
+	cl := client.NewWithPassword(id.LoginName, st.CRealm, "", c.KRB5Conf, client.DisablePAFXFAST(true))
+	defer cl.Destroy()
+	spn := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+st.CRealm)
+	tgsReq, err := messages.NewTGSReq(st.CName, st.CRealm, cl.Config, tkt, st.key(), spn, true)
+	if err != nil {
+		validationErrEvent(c, &event, fmt.Errorf("session renewal failed - error generating TGS_REQ: %v", err))
+		return id, errSessionNotRenewable
+	}
+	// Only asked once the request is ready so that a trial allowed through a half-open breaker always has an outcome
+	if !b.allow(id.Domain) {
+		event.FailureReason = identity.ReasonKDCUnreachable
+		validationErrEvent(c, &event, fmt.Errorf("session renewal not attempted - KDC circuit breaker open for realm %s", id.Domain))
+		return id, errKDCUnavailable
+	}
+	tgsRep, err := tgsExchange(c, cl, tgsReq, st.CRealm, tkt, st.key())
+	if err != nil {
+		event.FailureReason, event.KRBErrorCode = failureReason(err)
+		validationErrEvent(c, &event, fmt.Errorf("session renewal failed: %v", err))
+		if event.FailureReason == identity.ReasonKDCUnreachable {
+			b.failure(id.Domain)
+			return id, errKDCUnavailable
+		}
+		b.success(id.Domain)
+		s.end(id, "session ended as the KDC refused renewal", event.Peer)
+		id.Valid = false
+		id.Authorized = false
+		id.Token = ""
+		if !c.HideFailureReason {
+			id.FailureReason = event.FailureReason
+		}
+		return id, nil
+	}
+	b.success(id.Domain)
+	id.Expiry = tgsRep.DecryptedEncPart.EndTime
+	id.RenewTill = tgsRep.DecryptedEncPart.RenewTill
+	if sr.tokenIssued {
+		issueToken(c, &id, sr.audience)
+	}
+	var ntgt []byte
+	if renewable(tgsRep.DecryptedEncPart.Flags, tgsRep.DecryptedEncPart.RenewTill) {
+		ntgt, err = s.sealTGT(tgsRep.Ticket, tgsRep.DecryptedEncPart.Key, st.CName, st.CRealm)
+		if err != nil {
+			c.ApplicationLogf("could not keep renewed TGT for session %s: %v", id.SessionID, err)
+		}
+	}
+	s.renewed(id, ntgt)
+	event.Message = fmt.Sprintf("session renewed until %v", id.Expiry)
+	event.Validated = true
+	event.ValidationSuccessful = true
+	event.Time = time.Now().UTC()
+	c.EventLog(event)
+	return id, nil
+}
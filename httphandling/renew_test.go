@@ -0,0 +1,255 @@
+package httphandling
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/authenvoy/jwt"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTGTRep returns an AS_REP for testuser1 containing a TGT with the flags and renew till time provided.
+func testTGTRep(t *testing.T, f []int, renewTill time.Time) messages.ASRep {
+	b, _ := hex.DecodeString(testdata.KEYTAB_TESTUSER1_TEST_GOKRB5)
+	kt := keytab.New()
+	kt.Unmarshal(b)
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "testuser1")
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/TEST.GOKRB5")
+	kf := types.NewKrbFlags()
+	for _, i := range f {
+		types.SetFlag(&kf, i)
+	}
+	st := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(cname, "TEST.GOKRB5", cname, "TEST.GOKRB5",
+		kf, kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, st, st, st.Add(time.Hour), renewTill)
+	if err != nil {
+		t.Fatalf("error creating ticket: %v", err)
+	}
+	tkt.SName = sname
+	var k messages.ASRep
+	k.Ticket = tkt
+	k.CName = cname
+	k.CRealm = "TEST.GOKRB5"
+	k.DecryptedEncPart.Key = key
+	k.DecryptedEncPart.Flags = kf
+	k.DecryptedEncPart.EndTime = st.Add(time.Hour)
+	k.DecryptedEncPart.RenewTill = renewTill
+	return k
+}
+
+// fakeTGS answers TGS_REQs received over UDP with a TGS_REP renewing the TGT whose session key is provided.
+func fakeTGS(t *testing.T, key types.EncryptionKey) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	b, _ := hex.DecodeString(testdata.KEYTAB_TESTUSER1_TEST_GOKRB5)
+	kt := keytab.New()
+	kt.Unmarshal(b)
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var req messages.TGSReq
+			if req.Unmarshal(b[:n]) != nil {
+				continue
+			}
+			kf := types.NewKrbFlags()
+			types.SetFlag(&kf, flags.Renewable)
+			st := time.Now().UTC()
+			// The ticket is encrypted with the user's key as the test keytab has no krbtgt key
+			tkt, nkey, err := messages.NewTicket(req.ReqBody.CName, req.ReqBody.Realm, req.ReqBody.CName, req.ReqBody.Realm,
+				kf, kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, st, st, st.Add(time.Hour), st.Add(time.Hour*24))
+			if err != nil {
+				continue
+			}
+			tkt.SName = req.ReqBody.SName
+			enc := messages.EncKDCRepPart{
+				Key:       nkey,
+				LastReqs:  []messages.LastReq{},
+				Nonce:     req.ReqBody.Nonce,
+				Flags:     kf,
+				AuthTime:  st,
+				StartTime: st,
+				EndTime:   st.Add(time.Hour),
+				RenewTill: st.Add(time.Hour * 24),
+				SRealm:    req.ReqBody.Realm,
+				SName:     req.ReqBody.SName,
+			}
+			eb, _ := enc.Marshal()
+			ed, _ := crypto.GetEncryptedData(eb, key, keyusage.TGS_REP_ENCPART_SESSION_KEY, 0)
+			rep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+				PVNO:    5,
+				MsgType: msgtype.KRB_TGS_REP,
+				CRealm:  req.ReqBody.Realm,
+				CName:   req.ReqBody.CName,
+				Ticket:  tkt,
+				EncPart: ed,
+			}}
+			rb, _ := rep.Marshal()
+			conn.WriteTo(rb, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestRenewable(t *testing.T) {
+	assert.True(t, renewable(testTGTRep(t, []int{flags.Renewable}, time.Now().Add(time.Hour)).DecryptedEncPart.Flags, time.Now().Add(time.Hour)))
+	assert.False(t, renewable(testTGTRep(t, []int{flags.Forwardable}, time.Now().Add(time.Hour)).DecryptedEncPart.Flags, time.Now().Add(time.Hour)),
+		"ticket without the renewable flag should not be renewable")
+	assert.False(t, renewable(testTGTRep(t, []int{flags.Renewable}, time.Now().Add(time.Hour)).DecryptedEncPart.Flags, time.Now().Add(-time.Second)),
+		"ticket past its renew till time should not be renewable")
+	assert.False(t, renewable(messages.EncKDCRepPart{}.Flags, time.Now().Add(time.Hour)), "empty flags should not be renewable")
+}
+
+func TestSessionTGT(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	s := newSessionStore(c)
+	k := testTGTRep(t, []int{flags.Renewable}, time.Now().Add(time.Hour*24))
+	b, err := s.sealTGT(k.Ticket, k.DecryptedEncPart.Key, k.CName, k.CRealm)
+	if err != nil {
+		t.Fatalf("could not seal TGT: %v", err)
+	}
+	tb, _ := k.Ticket.Marshal()
+	assert.NotContains(t, string(b), string(tb), "TGT should not be held in the clear")
+	tkt, st, err := s.openTGT(b)
+	if err != nil {
+		t.Fatalf("could not open TGT: %v", err)
+	}
+	assert.Equal(t, k.Ticket.SName, tkt.SName)
+	assert.Equal(t, k.DecryptedEncPart.Key, st.key())
+	assert.Equal(t, "TEST.GOKRB5", st.CRealm)
+
+	_, _, err = newSessionStore(c).openTGT(b)
+	assert.Error(t, err, "TGT should not be readable by another store")
+}
+
+func TestRenewSession(t *testing.T) {
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	// Point the realm at a port nothing is listening on
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", "127.0.0.1:1", 1))
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	router := NewRouter(c)
+	s := newSessionStore(c)
+	router.Get("renew").Handler(WrapCommonHandler(renewSession(c, newKDCBreaker(c), newKDCLimiter(c), s), c))
+
+	id := testSessionIdentity("renewable", time.Hour)
+	id.RenewTill = time.Now().UTC().Add(time.Hour * 24)
+	s.add(id, "", testTGTRep(t, []int{flags.Renewable}, id.RenewTill), nil)
+	s.add(testSessionIdentity("notrenewable", time.Hour), "", testTGTRep(t, nil, time.Time{}), nil)
+	id = testSessionIdentity("renewtill", time.Hour)
+	id.RenewTill = time.Now().UTC().Add(time.Millisecond * 10)
+	s.add(id, "", testTGTRep(t, []int{flags.Renewable}, id.RenewTill), nil)
+	time.Sleep(time.Millisecond * 10)
+
+	var tests = []struct {
+		sid  string
+		code int
+	}{
+		{"unknown", http.StatusNotFound},
+		{"notrenewable", http.StatusUnauthorized},
+		{"renewtill", http.StatusUnauthorized},
+		{"renewable", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "/"+APIVersion+"/session/"+test.sid+"/renew", nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		assert.Equal(t, test.code, response.Code, "status code not as expected for session %s", test.sid)
+	}
+	_, ok := s.get("renewable", nil)
+	assert.True(t, ok, "session should not be ended if the KDC could not be contacted")
+}
+
+func TestRenewSessionBreakerTrial(t *testing.T) {
+	c := &config.Config{
+		KDCFailureThreshold: 1,
+		KDCCoolDown:         time.Millisecond * 10,
+	}
+	c.SetApplicationLog("null")
+	c.SetEventLogWriter(json.NewEncoder(ioutil.Discard))
+	b := newKDCBreaker(c)
+	id := testSessionIdentity("renewable", time.Hour)
+	b.failure(id.Domain)
+	time.Sleep(c.KDCCoolDown)
+
+	// The TGT cannot be opened so the KDC is not contacted
+	_, err := krbRenew(context.Background(), c, b, newSessionStore(c), id, sessionRenewal{tgt: []byte("not a TGT")}, eventLog{})
+	assert.Equal(t, errSessionNotRenewable, err)
+	assert.True(t, b.allow(id.Domain), "trial should not be taken by a renewal that did not contact the KDC")
+	assert.Equal(t, BreakerHalfOpen, b.status()[id.Domain].State)
+}
+
+func TestRenewSessionToken(t *testing.T) {
+	id := testSessionIdentity("renewable", time.Minute)
+	id.RenewTill = time.Now().UTC().Add(time.Hour * 24)
+	id.Token = "signed.jwt.token"
+	k := testTGTRep(t, []int{flags.Renewable}, id.RenewTill)
+	addr, stop := fakeTGS(t, k.DecryptedEncPart.Key)
+	defer stop()
+	cf, _ := ioutil.TempFile(os.TempDir(), "TEST-krb5.conf")
+	defer os.Remove(cf.Name())
+	cf.WriteString(strings.Replace(krb5Conf, "127.0.0.1:88", addr, 1))
+	c, err := config.New(8020, cf.Name(), "null", "")
+	if err != nil {
+		t.Fatalf("could not create new config: %v", err)
+	}
+	err = c.SetJWTSigner(jwt.ES256, "", "authenvoy")
+	if err != nil {
+		t.Fatalf("could not set JWT signer: %v", err)
+	}
+	router := NewRouter(c)
+	s := newSessionStore(c)
+	router.Get("renew").Handler(WrapCommonHandler(renewSession(c, newKDCBreaker(c), newKDCLimiter(c), s), c))
+	s.add(id, "payroll", k, nil)
+
+	request, _ := http.NewRequest("POST", fmt.Sprintf("/%s/session/renewable/renew", APIVersion), nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var r identity.Identity
+	json.Unmarshal(response.Body.Bytes(), &r)
+	assert.True(t, r.Expiry.After(id.Expiry), "session should be renewed")
+	parts := strings.Split(r.Token, ".")
+	if assert.Len(t, parts, 3, "a new token should be issued for a session that had one") {
+		b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims jwt.Claims
+		json.Unmarshal(b, &claims)
+		assert.Equal(t, "payroll", claims.Audience)
+		assert.Equal(t, "renewable", claims.SessionID)
+		assert.Equal(t, r.Expiry.Unix(), claims.Expiry, "the token should expire with the renewed ticket")
+	}
+	rid, _ := s.get("renewable", nil)
+	assert.Empty(t, rid.Token, "the token should not be stored with the session")
+}
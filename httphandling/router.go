@@ -1,6 +1,9 @@
 package httphandling
 
 import (
+	"net"
+	"net/http"
+
 	"github.com/gorilla/mux"
 	"github.com/jcmturner/authenvoy/config"
 )
@@ -10,14 +13,93 @@ const (
 	APIVersion = "v1"
 )
 
-// NewRouter returns a newly configured HTTP mux router.
+// NewRouter returns a newly configured HTTP mux router. The administration routes are only matched by requests
+// received on the admin port and the API routes only by requests received elsewhere.
 func NewRouter(c *config.Config) *mux.Router {
-	router := mux.NewRouter().StrictSlash(true)
-	handler := WrapCommonHandler(authenticate(c), c)
+	root := mux.NewRouter().StrictSlash(true)
+	isAdmin := adminRequest(c)
+	admin := root.MatcherFunc(isAdmin).Subrouter()
+	router := root.MatcherFunc(func(r *http.Request, m *mux.RouteMatch) bool {
+		return !isAdmin(r, m)
+	}).Subrouter()
+	b := newKDCBreaker(c)
+	x := newKDCLimiter(c)
+	s := newSessionStore(c)
+	l := newRateLimiter(c)
+	n := newNegativeCache(c)
+	p := newKDCProber(c)
+	handler := WrapCommonHandler(authenticate(c, b, x, s, l, n), c)
 	router.
 		Methods("POST").
 		Path("/" + APIVersion + "/authenticate").
 		Name("authenticate").
 		Handler(handler)
-	return router
+	router.
+		Methods("POST").
+		Path("/" + APIVersion + "/password").
+		Name("password").
+		Handler(WrapCommonHandler(changePassword(c, b, x, l, n), c))
+	router.
+		Methods("GET").
+		Path("/" + APIVersion + "/session/{id}").
+		Name("session").
+		Handler(WrapCommonHandler(getSession(c, s), c))
+	router.
+		Methods("DELETE").
+		Path("/" + APIVersion + "/session/{id}").
+		Name("logout").
+		Handler(WrapCommonHandler(deleteSession(c, s), c))
+	router.
+		Methods("POST").
+		Path("/" + APIVersion + "/session/{id}/renew").
+		Name("renew").
+		Handler(WrapCommonHandler(renewSession(c, b, x, s), c))
+	admin.
+		Methods("GET").
+		Path("/" + APIVersion + "/sessions").
+		Name("sessions").
+		Handler(WrapAdminHandler(listSessions(c, s), c))
+	if c.JWTSigner != nil {
+		router.
+			Methods("GET").
+			Path("/" + APIVersion + "/jwks").
+			Name("jwks").
+			Handler(WrapCommonHandler(jwks(c), c))
+	}
+	if c.Keytab != nil {
+		router.
+			Methods("POST").
+			Path("/" + APIVersion + "/negotiate").
+			Name("negotiate").
+			Handler(WrapCommonHandler(negotiate(c), c))
+	}
+	router.
+		Methods("GET").
+		Path("/healthz").
+		Name("healthz").
+		Handler(WrapCommonHandler(healthz(), c))
+	router.
+		Methods("GET").
+		Path("/readyz").
+		Name("readyz").
+		Handler(WrapCommonHandler(readyz(c, b, p), c))
+	if c.Metrics != nil && c.MetricsPort == 0 {
+		router.
+			Methods("GET").
+			Path("/metrics").
+			Name("metrics").
+			Handler(WrapCommonHandler(c.Metrics.Handler(), c))
+	}
+	return root
+}
+
+// adminRequest matches requests received on the loopback admin port. None match if no admin port is configured.
+func adminRequest(c *config.Config) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		if c.AdminPort == 0 {
+			return false
+		}
+		a, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		return ok && a.Port == c.AdminPort
+	}
 }
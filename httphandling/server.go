@@ -0,0 +1,43 @@
+package httphandling
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jcmturner/authenvoy/config"
+)
+
+// NewServer returns a HTTP server for the handler using the server timeouts from the configuration. The peer
+// credentials of connections over a Unix domain socket are added to the context of their requests.
+func NewServer(c *config.Config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ConnContext:       connContext,
+	}
+}
+
+// Shutdown stops the server accepting connections and waits, until the context is done, for requests in progress, for
+// KDC exchanges that continued after their request ended and for the session file to be written.
+func Shutdown(ctx context.Context, s *http.Server) error {
+	err := s.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		exchanges.Wait()
+		sessionWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
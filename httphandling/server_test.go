@@ -0,0 +1,71 @@
+package httphandling
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	c := &config.Config{}
+	c.SetApplicationLog("null")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := NewServer(c, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go srv.Serve(ln)
+	code := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			code <- 0
+			return
+		}
+		resp.Body.Close()
+		code <- resp.StatusCode
+	}()
+	<-started
+
+	// A KDC exchange that continues after its request has ended
+	x := newKDCLimiter(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	exchanged := make(chan struct{})
+	err = x.exchange(ctx, func() {
+		<-exchanged
+	})
+	assert.Equal(t, errCallerGone, err)
+
+	// The grace period ends with the request in progress
+	sctx, scancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer scancel()
+	assert.Equal(t, context.DeadlineExceeded, Shutdown(sctx, srv))
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.Error(t, err, "new connections should not be accepted")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Shutdown(context.Background(), srv)
+	}()
+	close(release)
+	assert.Equal(t, http.StatusOK, <-code, "request in progress should finish")
+	select {
+	case <-done:
+		t.Fatal("shutdown should wait for the KDC exchange")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(exchanged)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,318 @@
+package httphandling
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/messages"
+)
+
+// sessionSweepInterval is the minimum period between removals of expired sessions from the store.
+const sessionSweepInterval = time.Minute
+
+// sessionRefreshPersistDivisor sets how far, as a fraction of the idle timeout, the last access of a session must move
+// before a lookup writes it to the session file. A session loaded from the file may then expire up to that much early.
+const sessionRefreshPersistDivisor = 10
+
+// sessionWrites counts the writes of the session file that are pending or in progress, so that shutdown can wait for
+// them.
+var sessionWrites sync.WaitGroup
+
+// SessionInfo summarises a session for listing.
+type SessionInfo struct {
+	SessionID  string    `json:"SessionID"`
+	LoginName  string    `json:"LoginName"`
+	Domain     string    `json:"Domain"`
+	Created    time.Time `json:"Created"`
+	LastAccess time.Time `json:"LastAccess"`
+	Expiry     time.Time `json:"Expiry"`
+}
+
+type session struct {
+	Identity   identity.Identity `json:"Identity"`
+	Audience   string            `json:"Audience"`
+	Created    time.Time         `json:"Created"`
+	LastAccess time.Time         `json:"LastAccess"`
+	// TokenIssued indicates a JWT was issued for the session, so a new one is issued when it is renewed.
+	TokenIssued bool `json:"TokenIssued"`
+	// tgt is the encrypted TGT of a renewable session. It is not persisted.
+	tgt []byte
+	// persistedAccess is the LastAccess most recently written to the session file.
+	persistedAccess time.Time
+}
+
+// sessionStore holds the identities of valid sessions keyed by SessionID.
+// Sessions expire at the identity's Expiry or, if an idle timeout is configured, when not accessed for that period.
+type sessionStore struct {
+	c         *config.Config
+	mux       sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+	// pending indicates a write of the session file has been scheduled but has not yet taken its copy of the sessions.
+	pending bool
+	// fileMux serialises writes of the session file so that a later copy of the sessions is never overwritten by an
+	// earlier one.
+	fileMux sync.Mutex
+	// tgtKey encrypts the TGTs held in memory. It is generated each time the store is created.
+	tgtKey []byte
+}
+
+// newSessionStore returns a session store, loading any sessions persisted to the configured session file.
+func newSessionStore(c *config.Config) *sessionStore {
+	s := &sessionStore{
+		c:        c,
+		sessions: make(map[string]*session),
+		tgtKey:   make([]byte, 32),
+	}
+	if _, err := rand.Read(s.tgtKey); err != nil {
+		c.ApplicationLogf("could not generate session TGT key, sessions will not be renewable: %v", err)
+		s.tgtKey = nil
+	}
+	if c.SessionFile == "" {
+		return s
+	}
+	b, err := ioutil.ReadFile(c.SessionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.ApplicationLogf("could not read session file: %v", err)
+		}
+		return s
+	}
+	err = json.Unmarshal(b, &s.sessions)
+	if err != nil {
+		c.ApplicationLogf("could not parse session file %s: %v", c.SessionFile, err)
+		s.sessions = make(map[string]*session)
+		return s
+	}
+	for _, ss := range s.sessions {
+		ss.persistedAccess = ss.LastAccess
+	}
+	s.sweep(time.Now().UTC())
+	return s
+}
+
+// expired indicates if the session has expired at the time provided.
+func (s *sessionStore) expired(ss *session, now time.Time) bool {
+	if !now.Before(ss.Identity.Expiry) {
+		return true
+	}
+	return s.c.Current().SessionIdleTimeout > 0 && now.Sub(ss.LastAccess) >= s.c.Current().SessionIdleTimeout
+}
+
+// add stores the identity of a new session. If the TGT from the login is renewable it is kept, encrypted, so the
+// session can be renewed. The identity's signed token is not stored so that it cannot be read back with the session ID.
+func (s *sessionStore) add(id identity.Identity, audience string, k messages.ASRep, peer *PeerCred) {
+	now := time.Now().UTC()
+	ss := &session{
+		Audience:        audience,
+		Created:         now,
+		LastAccess:      now,
+		TokenIssued:     id.Token != "",
+		persistedAccess: now,
+	}
+	id.Token = ""
+	ss.Identity = id
+	if renewable(k.DecryptedEncPart.Flags, k.DecryptedEncPart.RenewTill) {
+		tgt, err := s.sealTGT(k.Ticket, k.DecryptedEncPart.Key, k.CName, k.CRealm)
+		if err != nil {
+			s.c.ApplicationLogf("could not keep TGT for session %s: %v", id.SessionID, err)
+		}
+		ss.tgt = tgt
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sessions[id.SessionID] = ss
+	if now.Sub(s.lastSweep) >= sessionSweepInterval {
+		s.sweep(now)
+	}
+	s.persist()
+	sessionEvent(s.c, peer, id, actionSessionCreate, "session created")
+}
+
+// get returns the identity of an unexpired session and refreshes its idle timer.
+func (s *sessionStore) get(sid string, peer *PeerCred) (identity.Identity, bool) {
+	now := time.Now().UTC()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ss, ok := s.sessions[sid]
+	if !ok {
+		return identity.Identity{}, false
+	}
+	if s.expired(ss, now) {
+		s.remove(ss, "session expired", peer)
+		s.persist()
+		return identity.Identity{}, false
+	}
+	ss.LastAccess = now
+	// The refresh is only written once it matters to the idle timeout so that lookups do not rewrite the file each time
+	if idle := s.c.Current().SessionIdleTimeout; idle > 0 && now.Sub(ss.persistedAccess) >= idle/sessionRefreshPersistDivisor {
+		ss.persistedAccess = now
+		s.persist()
+	}
+	sessionEvent(s.c, peer, ss.Identity, actionSessionRefresh, "session looked up and refreshed")
+	return ss.Identity, true
+}
+
+// delete ends a session. The bool returned indicates if the session existed.
+func (s *sessionStore) delete(sid string, peer *PeerCred) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ss, ok := s.sessions[sid]
+	if !ok {
+		return false
+	}
+	delete(s.sessions, sid)
+	s.persist()
+	sessionEvent(s.c, peer, ss.Identity, actionSessionLogout, "session ended by logout")
+	return true
+}
+
+// list returns the unexpired sessions ordered by creation time.
+func (s *sessionStore) list() []SessionInfo {
+	now := time.Now().UTC()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sweep(now)
+	l := make([]SessionInfo, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		l = append(l, SessionInfo{
+			SessionID:  ss.Identity.SessionID,
+			LoginName:  ss.Identity.LoginName,
+			Domain:     ss.Identity.Domain,
+			Created:    ss.Created,
+			LastAccess: ss.LastAccess,
+			Expiry:     ss.Identity.Expiry,
+		})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Created.Before(l[j].Created) })
+	return l
+}
+
+// sweep removes expired sessions. The caller must hold the lock. Their expiry is not attributed to the caller.
+func (s *sessionStore) sweep(now time.Time) {
+	s.lastSweep = now
+	var removed bool
+	for _, ss := range s.sessions {
+		if s.expired(ss, now) {
+			s.remove(ss, "session expired", nil)
+			removed = true
+		}
+	}
+	if removed {
+		s.persist()
+	}
+}
+
+// remove deletes a session from the store and records the reason and the caller that found it had ended. The caller
+// must hold the lock.
+func (s *sessionStore) remove(ss *session, msg string, peer *PeerCred) {
+	delete(s.sessions, ss.Identity.SessionID)
+	sessionEvent(s.c, peer, ss.Identity, actionSessionExpire, msg)
+}
+
+// persist schedules the sessions to be written to the session file, if configured. The caller must hold the lock.
+// The file is written in the background, without the lock held, and changes made before a scheduled write has taken
+// its copy of the sessions are written with it.
+func (s *sessionStore) persist() {
+	if s.c.SessionFile == "" || s.pending {
+		return
+	}
+	s.pending = true
+	sessionWrites.Add(1)
+	go func() {
+		defer sessionWrites.Done()
+		err := s.write()
+		if err != nil {
+			s.c.ApplicationLogf("could not persist sessions: %v", err)
+		}
+	}()
+}
+
+// write replaces the session file with the sessions in the store. The file is replaced atomically so a crash cannot
+// leave it partially written.
+func (s *sessionStore) write() error {
+	s.fileMux.Lock()
+	defer s.fileMux.Unlock()
+	s.mux.Lock()
+	s.pending = false
+	m := make(map[string]session, len(s.sessions))
+	for sid, ss := range s.sessions {
+		m[sid] = *ss
+	}
+	s.mux.Unlock()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.c.SessionFile), filepath.Base(s.c.SessionFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.c.SessionFile)
+}
+
+// sessionEvent records a session lifecycle action by the calling process in the event log under the event ID of the
+// authentication that created the session.
+func sessionEvent(c *config.Config, peer *PeerCred, id identity.Identity, action, msg string) {
+	c.EventLog(eventLog{
+		EventID:              id.SessionID,
+		Action:               action,
+		Time:                 time.Now().UTC(),
+		LoginName:            id.LoginName,
+		Domain:               id.Domain,
+		Peer:                 peer,
+		Validated:            true,
+		ValidationSuccessful: true,
+		Message:              msg,
+	})
+}
+
+func getSession(c *config.Config, s *sessionStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := s.get(mux.Vars(r)["id"], peerCred(r))
+		if !ok {
+			respondGeneric(w, http.StatusNotFound, "session not found")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, id)
+		return
+	})
+}
+
+func deleteSession(c *config.Config, s *sessionStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid := mux.Vars(r)["id"]
+		if !s.delete(sid, peerCred(r)) {
+			respondGeneric(w, http.StatusNotFound, "session not found")
+			return
+		}
+		respondGeneric(w, http.StatusOK, fmt.Sprintf("session %s ended", sid))
+		return
+	})
+}
+
+func listSessions(c *config.Config, s *sessionStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, s.list())
+		return
+	})
+}
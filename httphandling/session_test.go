@@ -0,0 +1,209 @@
+package httphandling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSessionIdentity(sid string, expiry time.Duration) identity.Identity {
+	return identity.Identity{
+		Valid:      true,
+		Authorized: true,
+		Domain:     "TEST.GOKRB5",
+		LoginName:  "testuser1",
+		SessionID:  sid,
+		Expiry:     time.Now().UTC().Add(expiry),
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	b := new(bytes.Buffer)
+	c.SetEventLogWriter(json.NewEncoder(b))
+	s := newSessionStore(c)
+	p := &PeerCred{UID: 1000, GID: 1000, PID: 42}
+
+	s.add(testSessionIdentity("sid1", time.Hour), "", messages.ASRep{}, nil)
+	s.add(testSessionIdentity("sid2", time.Millisecond*50), "", messages.ASRep{}, nil)
+	id, ok := s.get("sid1", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "testuser1", id.LoginName)
+	assert.Equal(t, 2, len(s.list()))
+
+	time.Sleep(time.Millisecond * 50)
+	_, ok = s.get("sid2", p)
+	assert.False(t, ok, "session should expire with the ticket")
+	assert.Equal(t, 1, len(s.list()))
+
+	assert.True(t, s.delete("sid1", p))
+	assert.False(t, s.delete("sid1", nil), "session should not exist after logout")
+	_, ok = s.get("sid1", nil)
+	assert.False(t, ok)
+
+	// Lifecycle events are recorded under the session's event ID
+	actions := make(map[string][]string)
+	peers := make(map[string]*PeerCred)
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var e eventLog
+		dec.Decode(&e)
+		actions[e.EventID] = append(actions[e.EventID], e.Action)
+		peers[e.EventID+" "+e.Action] = e.Peer
+	}
+	assert.Equal(t, []string{actionSessionCreate, actionSessionRefresh, actionSessionLogout}, actions["sid1"])
+	assert.Equal(t, []string{actionSessionCreate, actionSessionExpire}, actions["sid2"])
+	assert.Equal(t, p, peers["sid1 "+actionSessionLogout], "logout should identify the calling process")
+	assert.Equal(t, p, peers["sid2 "+actionSessionExpire], "expiry should identify the calling process that found it")
+}
+
+func TestSessionStoreIdleTimeout(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	c.SessionIdleTimeout = time.Millisecond * 50
+	s := newSessionStore(c)
+
+	s.add(testSessionIdentity("sid1", time.Hour), "", messages.ASRep{}, nil)
+	time.Sleep(time.Millisecond * 30)
+	_, ok := s.get("sid1", nil)
+	assert.True(t, ok, "lookup should refresh the idle timer")
+	time.Sleep(time.Millisecond * 30)
+	_, ok = s.get("sid1", nil)
+	assert.True(t, ok, "session should not be idle as it was refreshed")
+	time.Sleep(time.Millisecond * 50)
+	_, ok = s.get("sid1", nil)
+	assert.False(t, ok, "session should have expired after being idle")
+}
+
+func TestSessionStorePersistence(t *testing.T) {
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-sessions.json")
+	f.Close()
+	defer os.Remove(f.Name())
+	defer sessionWrites.Wait()
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	c.SessionFile = f.Name()
+
+	s := newSessionStore(c)
+	s.add(testSessionIdentity("sid1", time.Hour), "", messages.ASRep{}, nil)
+	s.add(testSessionIdentity("sid2", time.Hour), "", messages.ASRep{}, nil)
+	s.delete("sid2", nil)
+	sessionWrites.Wait()
+
+	s = newSessionStore(c)
+	id, ok := s.get("sid1", nil)
+	assert.True(t, ok, "session should be loaded from the session file")
+	assert.Equal(t, "testuser1", id.LoginName)
+	_, ok = s.get("sid2", nil)
+	assert.False(t, ok, "deleted session should not be loaded")
+	sessionWrites.Wait()
+	b, _ := ioutil.ReadFile(f.Name())
+	s.get("sid1", nil)
+	sessionWrites.Wait()
+	nb, _ := ioutil.ReadFile(f.Name())
+	assert.Equal(t, string(b), string(nb), "lookup should not write the session file without an idle timeout")
+
+	c.SessionIdleTimeout = time.Second
+	s.get("sid1", nil)
+	sessionWrites.Wait()
+	nb, _ = ioutil.ReadFile(f.Name())
+	assert.Equal(t, string(b), string(nb), "lookup soon after the last write should not write the session file")
+	time.Sleep(c.SessionIdleTimeout / sessionRefreshPersistDivisor)
+	s.get("sid1", nil)
+	sessionWrites.Wait()
+	la := s.list()[0].LastAccess
+	s = newSessionStore(c)
+	assert.Equal(t, la, s.list()[0].LastAccess, "refresh of the idle timer should be persisted once it has moved far enough")
+	fi, _ := os.Stat(f.Name())
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "session file should only be readable by its owner")
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	c, _ := testNegotiateConfig(t)
+	c.AdminPort = 8089
+	var b bytes.Buffer
+	c.SetAccessLogWriter(json.NewEncoder(&b))
+	router := NewRouter(c)
+	s := newSessionStore(c)
+	router.Get("session").Handler(WrapCommonHandler(getSession(c, s), c))
+	router.Get("logout").Handler(WrapCommonHandler(deleteSession(c, s), c))
+	router.Get("sessions").Handler(WrapAdminHandler(listSessions(c, s), c))
+	id := testSessionIdentity("sid1", time.Hour)
+	id.Token = "signed.jwt.token"
+	s.add(id, "", messages.ASRep{}, nil)
+
+	var tests = []struct {
+		method string
+		path   string
+		admin  bool
+		code   int
+	}{
+		{"GET", "/" + APIVersion + "/session/sid1", false, http.StatusOK},
+		{"GET", "/" + APIVersion + "/session/unknown", false, http.StatusNotFound},
+		{"GET", "/" + APIVersion + "/sessions", false, http.StatusNotFound},
+		{"GET", "/" + APIVersion + "/sessions", true, http.StatusOK},
+		{"GET", "/" + APIVersion + "/session/sid1", true, http.StatusNotFound},
+		{"DELETE", "/" + APIVersion + "/session/sid1", false, http.StatusOK},
+		{"GET", "/" + APIVersion + "/session/sid1", false, http.StatusNotFound},
+		{"DELETE", "/" + APIVersion + "/session/sid1", false, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, test.path, nil)
+		if test.admin {
+			request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.AdminPort}))
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		assert.Equal(t, test.code, response.Code, "status code not as expected for %s %s on admin port %t", test.method, test.path, test.admin)
+		if test.code != http.StatusOK {
+			continue
+		}
+		if test.path == "/"+APIVersion+"/sessions" {
+			var l []SessionInfo
+			json.NewDecoder(response.Body).Decode(&l)
+			assert.Equal(t, 1, len(l))
+			assert.Equal(t, "sid1", l[0].SessionID)
+		} else if test.method == "GET" {
+			var i identity.Identity
+			json.NewDecoder(response.Body).Decode(&i)
+			assert.Equal(t, "testuser1", i.LoginName)
+			assert.Empty(t, i.Token, "the signed token should not be returned from the session")
+		}
+	}
+
+	// Session IDs are not recorded in the access log
+	assert.NotContains(t, b.String(), "sid1")
+	assert.Contains(t, b.String(), `"Path":"/`+APIVersion+`/session/{id}"`)
+}
+
+func TestAdminPortPeerRestricted(t *testing.T) {
+	c, _ := testNegotiateConfig(t)
+	c.AdminPort = 8089
+	c.AllowUIDs = []uint32{1000}
+	router := NewRouter(c)
+
+	// Connections to the admin port carry no peer credentials
+	request, _ := http.NewRequest("GET", "/"+APIVersion+"/sessions", nil)
+	request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.AdminPort}))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "admin routes should not require peer credentials")
+
+	request, _ = http.NewRequest("GET", "/"+APIVersion+"/session/sid1", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusForbidden, response.Code, "API routes should still require peer credentials")
+}
@@ -55,6 +55,14 @@ func generateSelfSignedCert() (cert tls.Certificate, key *rsa.PrivateKey, err er
 
 // ListenAndServeTLS starts a HTTPS listener with an auto generated self signed certificate.
 func ListenAndServeTLS(addr string, handler http.Handler) error {
+	return ServeTLS(&http.Server{
+		Addr:    addr,
+		Handler: handler,
+	})
+}
+
+// ServeTLS starts the server's HTTPS listener with an auto generated self signed certificate.
+func ServeTLS(s *http.Server) error {
 	cert, _, err := generateSelfSignedCert()
 	if err != nil {
 		return err
@@ -71,10 +79,6 @@ func ListenAndServeTLS(addr string, handler http.Handler) error {
 		// failures, deployments of HTTP/2 that use TLS 1.2 MUST support TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
 		// [TLS-ECDHE] with the P-256 elliptic curve [FIPS186].
 	}
-	s := http.Server{
-		Addr:      addr,
-		Handler:   handler,
-		TLSConfig: &cfg,
-	}
+	s.TLSConfig = &cfg
 	return s.ListenAndServeTLS("", "")
 }
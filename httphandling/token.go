@@ -0,0 +1,46 @@
+package httphandling
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/authenvoy/jwt"
+)
+
+// jwksMaxAge is how long clients may cache the JSON Web Key Set for. This is kept short so rotated keys are picked
+// up quickly.
+const jwksMaxAge = "max-age=300"
+
+// issueToken adds a signed JWT to an identity that is valid and authorized.
+func issueToken(c *config.Config, id *identity.Identity, audience string) {
+	if c.JWTSigner == nil || !id.Valid || !id.Authorized {
+		return
+	}
+	now := time.Now().UTC()
+	t, err := c.JWTSigner.Sign(jwt.Claims{
+		Subject:   id.LoginName,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    id.Expiry.Unix(),
+		Realm:     id.Domain,
+		SessionID: id.SessionID,
+		Groups:    id.Groups,
+		Roles:     id.Roles,
+	})
+	if err != nil {
+		c.ApplicationLogf("could not issue token for %s: %v", id.SessionID, err)
+		return
+	}
+	id.Token = t
+}
+
+func jwks(c *config.Config) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", jwksMaxAge)
+		respondWithJSON(w, http.StatusOK, c.JWTSigner.JWKS())
+		return
+	})
+}
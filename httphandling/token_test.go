@@ -0,0 +1,58 @@
+package httphandling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/authenvoy/config"
+	"github.com/jcmturner/authenvoy/identity"
+	"github.com/jcmturner/authenvoy/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueToken(t *testing.T) {
+	c := new(config.Config)
+	c.SetApplicationLog("null")
+	id := identity.Identity{Valid: true, Authorized: true, LoginName: "testuser1", Domain: "TEST.GOKRB5", Expiry: time.Now().Add(time.Hour)}
+	issueToken(c, &id, "")
+	assert.Empty(t, id.Token, "token should not be issued if not enabled")
+
+	err := c.SetJWTSigner(jwt.ES256, "", "authenvoy")
+	if err != nil {
+		t.Fatalf("could not enable JWT issuance: %v", err)
+	}
+	issueToken(c, &id, "payroll")
+	assert.NotEmpty(t, id.Token)
+	id = identity.Identity{Valid: true, LoginName: "testuser1", Domain: "TEST.GOKRB5"}
+	issueToken(c, &id, "payroll")
+	assert.Empty(t, id.Token, "token should not be issued if not authorized")
+}
+
+func TestJWKS(t *testing.T) {
+	c, _ := testNegotiateConfig(t)
+	router := NewRouter(c)
+	request, _ := http.NewRequest("GET", "/"+APIVersion+"/jwks", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code, "JWKS should not be published if JWT issuance not enabled")
+
+	err := c.SetJWTSigner(jwt.EdDSA, "", "authenvoy")
+	if err != nil {
+		t.Fatalf("could not enable JWT issuance: %v", err)
+	}
+	router = NewRouter(c)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, jwksMaxAge, response.Header().Get("Cache-Control"))
+	var ks jwt.JWKSet
+	err = json.NewDecoder(response.Body).Decode(&ks)
+	if err != nil {
+		t.Fatalf("could not decode JWKS: %v", err)
+	}
+	assert.Equal(t, 1, len(ks.Keys))
+	assert.Equal(t, "OKP", ks.Keys[0].KeyType)
+}
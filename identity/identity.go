@@ -2,21 +2,97 @@ package identity
 
 import "time"
 
+// FailureReason is a machine readable reason for an authentication failure.
+type FailureReason string
+
+// Failure reasons reported when the credentials of an entity cannot be validated.
+const (
+	ReasonInvalidCredentials FailureReason = "InvalidCredentials"
+	ReasonUnknownPrincipal   FailureReason = "UnknownPrincipal"
+	ReasonAccountRevoked     FailureReason = "AccountRevoked"
+	ReasonPasswordExpired    FailureReason = "PasswordExpired"
+	ReasonClockSkew          FailureReason = "ClockSkew"
+	ReasonUnsupportedEType   FailureReason = "UnsupportedEncryptionType"
+	ReasonUnknownRealm       FailureReason = "UnknownRealm"
+	ReasonKDCUnreachable     FailureReason = "KDCUnreachable"
+	ReasonPasswordRejected   FailureReason = "PasswordRejected"
+	ReasonKDCNotVerified     FailureReason = "KDCNotVerified"
+	ReasonRateLimited        FailureReason = "RateLimited"
+	ReasonSoftLockout        FailureReason = "SoftLockout"
+	ReasonUnknown            FailureReason = "Unknown"
+)
+
+// PACStatus indicates if the signatures of the PAC that identity information was taken from have been verified.
+type PACStatus string
+
+// PAC verification statuses.
+const (
+	// PACVerified is the status of a PAC whose server and KDC checksums were both verified.
+	PACVerified PACStatus = "Verified"
+	// PACServerVerified is the status of a PAC whose server checksum was verified but whose KDC checksum could not
+	// be checked as the realm's krbtgt key is not available.
+	PACServerVerified PACStatus = "ServerVerified"
+	PACNotVerified    PACStatus = "NotVerified"
+	PACNotPresent     PACStatus = "NotPresent"
+)
+
 // Identity represents an authenticating entity
 type Identity struct {
-	Valid       bool      `json:"Valid"`
-	Domain      string    `json:"Domain"`
-	LoginName   string    `json:"LoginName"`
-	DisplayName string    `json:"DisplayName"`
-	Groups      []string  `json:"Groups"`
-	AuthTime    time.Time `json:"AuthTime"`
-	SessionID   string    `json:"SessionID"`
-	Expiry      time.Time `json:"Expiry"`
+	Valid               bool            `json:"Valid"`
+	Authorized          bool            `json:"Authorized"`
+	AuthorizationRule   string          `json:"AuthorizationRule,omitempty"`
+	FailureReason       FailureReason   `json:"FailureReason,omitempty"`
+	Domain              string          `json:"Domain"`
+	LoginName           string          `json:"LoginName"`
+	DisplayName         string          `json:"DisplayName"`
+	Groups              []string        `json:"Groups"`
+	GroupNames          []string        `json:"GroupNames"`
+	Roles               []string        `json:"Roles"`
+	UnverifiedGroups    []string        `json:"UnverifiedGroups,omitempty"`
+	PACStatus           PACStatus       `json:"PACStatus,omitempty"`
+	UserSID             string          `json:"UserSID,omitempty"`
+	DomainSID           string          `json:"DomainSID,omitempty"`
+	PrimaryGroupSID     string          `json:"PrimaryGroupSID,omitempty"`
+	LogonDomainName     string          `json:"LogonDomainName,omitempty"`
+	LogonServer         string          `json:"LogonServer,omitempty"`
+	UPN                 string          `json:"UPN,omitempty"`
+	DNSDomain           string          `json:"DNSDomain,omitempty"`
+	BadPasswordCount    int             `json:"BadPasswordCount"`
+	LastSuccessfulLogon time.Time       `json:"LastSuccessfulLogon"`
+	PasswordLastSet     time.Time       `json:"PasswordLastSet"`
+	PasswordCanChange   time.Time       `json:"PasswordCanChange"`
+	PasswordMustChange  time.Time       `json:"PasswordMustChange"`
+	UserAccountControl  uint32          `json:"UserAccountControl"`
+	AuthTime            time.Time       `json:"AuthTime"`
+	SessionID           string          `json:"SessionID"`
+	Expiry              time.Time       `json:"Expiry"`
+	RenewTill           time.Time       `json:"RenewTill"`
+	PasswordExpired     bool            `json:"PasswordExpired"`
+	PasswordExpiry      time.Time       `json:"PasswordExpiry"`
+	PasswordChange      *PasswordChange `json:"PasswordChange,omitempty"`
+	Token               string          `json:"Token,omitempty"`
+	ResponseToken       string          `json:"ResponseToken,omitempty"`
 }
 
 // Credentials represents the credentials of an entity
 type Credentials struct {
-	LoginName string `json:"LoginName"`
-	Domain    string `json:"Domain"`
-	Password  string `json:"Password"`
+	LoginName   string `json:"LoginName"`
+	Domain      string `json:"Domain"`
+	Password    string `json:"Password"`
+	NewPassword string `json:"NewPassword,omitempty"`
+	Audience    string `json:"Audience,omitempty"`
+	// ClientIP is the IP address of the end user, if known to the caller, for rate limiting.
+	ClientIP string `json:"ClientIP,omitempty"`
+}
+
+// PasswordChange represents the outcome of a request to change the password of an entity
+type PasswordChange struct {
+	Changed       bool          `json:"Changed"`
+	FailureReason FailureReason `json:"FailureReason,omitempty"`
+	Domain        string        `json:"Domain"`
+	LoginName     string        `json:"LoginName"`
+	ResultCode    int           `json:"ResultCode"`
+	ResultName    string        `json:"ResultName"`
+	Result        string        `json:"Result"`
+	EventID       string        `json:"EventID"`
 }
@@ -0,0 +1,314 @@
+// Package jwt provides signing of JSON Web Tokens for authenticated identities and publication of the signing keys as
+// a JSON Web Key Set.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// rsaKeySize is the size of generated RSA keys.
+const rsaKeySize = 2048
+
+// Claims are the claims of the tokens issued for authenticated identities.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expiry    int64    `json:"exp"`
+	Realm     string   `json:"realm"`
+	SessionID string   `json:"sid"`
+	Groups    []string `json:"groups,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// JWK is a public JSON Web Key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type key struct {
+	id     string
+	alg    string
+	signer crypto.Signer
+	// lastExpiry is the latest expiry of the tokens signed with the key.
+	lastExpiry time.Time
+}
+
+// Signer signs tokens with its current key. When the key is rotated the previous keys remain published until the
+// tokens they signed have expired.
+type Signer struct {
+	alg      string
+	keyFile  string
+	issuer   string
+	mux      sync.RWMutex
+	current  *key
+	previous []*key
+}
+
+// NewSigner returns a Signer using the algorithm specified. If the key file path is empty a key is generated,
+// otherwise the PEM encoded private key is loaded from the file. If the algorithm is empty it is determined from the
+// type of the key loaded.
+func NewSigner(alg, keyFile, issuer string) (*Signer, error) {
+	s := &Signer{
+		alg:     alg,
+		keyFile: keyFile,
+		issuer:  issuer,
+	}
+	if alg == "" && keyFile == "" {
+		s.alg = ES256
+	}
+	k, err := s.newKey()
+	if err != nil {
+		return nil, err
+	}
+	s.current = k
+	return s, nil
+}
+
+// Algorithm returns the signing algorithm of the Signer's current key.
+func (s *Signer) Algorithm() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.current.alg
+}
+
+// Rotate replaces the current key with a newly generated key or, if the Signer uses a key file, with the key
+// currently in the file. If the key in the file has not changed the current key is kept.
+func (s *Signer) Rotate() error {
+	k, err := s.newKey()
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if k.id == s.current.id {
+		return nil
+	}
+	s.previous = append(s.previous, s.current)
+	s.current = k
+	return nil
+}
+
+// Sign returns the signed compact serialization of a token with the claims provided.
+func (s *Signer) Sign(c Claims) (string, error) {
+	s.mux.Lock()
+	k := s.current
+	exp := time.Unix(c.Expiry, 0)
+	if exp.After(k.lastExpiry) {
+		k.lastExpiry = exp
+	}
+	s.mux.Unlock()
+	if c.Issuer == "" {
+		c.Issuer = s.issuer
+	}
+	h, err := json.Marshal(map[string]string{"alg": k.alg, "typ": "JWT", "kid": k.id})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	si := b64(h) + "." + b64(p)
+	sig, err := sign(k, []byte(si))
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %v", err)
+	}
+	return si + "." + b64(sig), nil
+}
+
+// JWKS returns the public keys that tokens which have not yet expired may have been signed with.
+func (s *Signer) JWKS() JWKSet {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now().UTC()
+	var keep []*key
+	for _, k := range s.previous {
+		if k.lastExpiry.After(now) {
+			keep = append(keep, k)
+		}
+	}
+	s.previous = keep
+	ks := JWKSet{Keys: []JWK{jwk(s.current)}}
+	for _, k := range s.previous {
+		ks.Keys = append(ks.Keys, jwk(k))
+	}
+	return ks
+}
+
+func (s *Signer) newKey() (*key, error) {
+	var sk crypto.Signer
+	var err error
+	if s.keyFile == "" {
+		sk, err = generateKey(s.alg)
+	} else {
+		sk, err = loadKey(s.keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	alg, err := keyAlgorithm(sk)
+	if err != nil {
+		return nil, err
+	}
+	if s.alg != "" && s.alg != alg {
+		return nil, fmt.Errorf("key is not suitable for algorithm %s", s.alg)
+	}
+	der, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal public key: %v", err)
+	}
+	id := sha256.Sum256(der)
+	return &key{
+		id:     b64(id[:16]),
+		alg:    alg,
+		signer: sk,
+	}, nil
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		return sk, err
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// loadKey loads a PEM encoded PKCS #8, PKCS #1 RSA or SEC 1 EC private key from the file.
+func loadKey(p string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", err)
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, fmt.Errorf("no PEM data found in key file %s", p)
+	}
+	var k interface{}
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(blk.Bytes)
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(blk.Bytes)
+	default:
+		k, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key file %s: %v", p, err)
+	}
+	sk, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in file %s cannot be used for signing", p)
+	}
+	return sk, nil
+}
+
+func keyAlgorithm(sk crypto.Signer) (string, error) {
+	switch k := sk.(type) {
+	case *rsa.PrivateKey:
+		return RS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 EC keys are supported")
+		}
+		return ES256, nil
+	case ed25519.PrivateKey:
+		return EdDSA, nil
+	}
+	return "", errors.New("unsupported key type")
+}
+
+func sign(k *key, b []byte) ([]byte, error) {
+	switch sk := k.signer.(type) {
+	case *rsa.PrivateKey:
+		h := sha256.Sum256(b)
+		return rsa.SignPKCS1v15(rand.Reader, sk, crypto.SHA256, h[:])
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256(b)
+		r, s, err := ecdsa.Sign(rand.Reader, sk, h[:])
+		if err != nil {
+			return nil, err
+		}
+		// RFC 7518 3.4: the signature is the concatenation of R and S as 32 byte big endian values
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(sk, b), nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func jwk(k *key) JWK {
+	j := JWK{
+		KeyID:     k.id,
+		Use:       "sig",
+		Algorithm: k.alg,
+	}
+	switch pk := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		j.KeyType = "RSA"
+		j.N = b64(pk.N.Bytes())
+		j.E = b64(big.NewInt(int64(pk.E)).Bytes())
+	case *ecdsa.PublicKey:
+		j.KeyType = "EC"
+		j.Curve = "P-256"
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		j.X = b64(pk.X.FillBytes(x))
+		j.Y = b64(pk.Y.FillBytes(y))
+	case ed25519.PublicKey:
+		j.KeyType = "OKP"
+		j.Curve = "Ed25519"
+		j.X = b64(pk)
+	}
+	return j
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
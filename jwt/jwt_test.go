@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verify checks the signature of the token with the public key from the JWK and returns the decoded header and claims.
+func verify(t *testing.T, tkn string, k JWK) (map[string]string, Claims) {
+	parts := strings.Split(tkn, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token does not have three parts: %s", tkn)
+	}
+	si := []byte(parts[0] + "." + parts[1])
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	dec := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	h := sha256.Sum256(si)
+	var ok bool
+	switch k.KeyType {
+	case "RSA":
+		pk := &rsa.PublicKey{N: dec(k.N), E: int(dec(k.E).Int64())}
+		ok = rsa.VerifyPKCS1v15(pk, crypto.SHA256, h[:], sig) == nil
+	case "EC":
+		pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: dec(k.X), Y: dec(k.Y)}
+		ok = len(sig) == 64 && ecdsa.Verify(pk, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case "OKP":
+		x, _ := base64.RawURLEncoding.DecodeString(k.X)
+		ok = ed25519.Verify(ed25519.PublicKey(x), si, sig)
+	}
+	if !ok {
+		t.Fatalf("signature of %s token did not verify", k.Algorithm)
+	}
+	var hdr map[string]string
+	var c Claims
+	b, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(b, &hdr)
+	b, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(b, &c)
+	return hdr, c
+}
+
+func testClaims() Claims {
+	now := time.Now().UTC()
+	return Claims{
+		Subject:   "testuser1",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(time.Hour).Unix(),
+		Realm:     "TEST.GOKRB5",
+		SessionID: "d6e7d370-498a-d6fc-a01d-c228fdb9a2e9",
+		Groups:    []string{"S-1-5-21-2284869408-3503417140-1141177250-513"},
+	}
+}
+
+func TestSigner_Sign(t *testing.T) {
+	for _, alg := range []string{RS256, ES256, EdDSA} {
+		s, err := NewSigner(alg, "", "authenvoy")
+		if err != nil {
+			t.Fatalf("could not create %s signer: %v", alg, err)
+		}
+		tkn, err := s.Sign(testClaims())
+		if err != nil {
+			t.Fatalf("could not sign %s token: %v", alg, err)
+		}
+		ks := s.JWKS()
+		if len(ks.Keys) != 1 {
+			t.Fatalf("expected one key in JWKS, got %d", len(ks.Keys))
+		}
+		hdr, c := verify(t, tkn, ks.Keys[0])
+		assert.Equal(t, alg, hdr["alg"])
+		assert.Equal(t, ks.Keys[0].KeyID, hdr["kid"])
+		assert.Equal(t, "authenvoy", c.Issuer)
+		assert.Equal(t, testClaims().SessionID, c.SessionID)
+	}
+	_, err := NewSigner("HS256", "", "authenvoy")
+	assert.Error(t, err, "unsupported algorithm should error")
+}
+
+func TestSigner_Rotate(t *testing.T) {
+	s, err := NewSigner(ES256, "", "authenvoy")
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	tkn, _ := s.Sign(testClaims())
+	err = s.Rotate()
+	if err != nil {
+		t.Fatalf("could not rotate key: %v", err)
+	}
+	ks := s.JWKS()
+	assert.Equal(t, 2, len(ks.Keys), "previous key should be published until its tokens expire")
+	verify(t, tkn, ks.Keys[1])
+
+	// A key that did not sign any unexpired tokens is not published after rotation
+	err = s.Rotate()
+	if err != nil {
+		t.Fatalf("could not rotate key: %v", err)
+	}
+	s.previous[0].lastExpiry = time.Now().Add(-time.Second)
+	ks = s.JWKS()
+	assert.Equal(t, 1, len(ks.Keys), "keys of expired tokens should no longer be published")
+}
+
+func TestSigner_KeyFile(t *testing.T) {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(k)
+	f, _ := ioutil.TempFile(os.TempDir(), "TEST-jwt.pem")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	f.Close()
+
+	s, err := NewSigner("", f.Name(), "authenvoy")
+	if err != nil {
+		t.Fatalf("could not create signer from key file: %v", err)
+	}
+	assert.Equal(t, ES256, s.Algorithm(), "algorithm should be determined from the key")
+	kid := s.JWKS().Keys[0].KeyID
+	// Rotating with an unchanged key file keeps the key
+	err = s.Rotate()
+	if err != nil {
+		t.Fatalf("could not reload key file: %v", err)
+	}
+	ks := s.JWKS()
+	assert.Equal(t, 1, len(ks.Keys))
+	assert.Equal(t, kid, ks.Keys[0].KeyID)
+
+	_, err = NewSigner(RS256, f.Name(), "authenvoy")
+	assert.Error(t, err, "key of the wrong type for the algorithm should error")
+	_, err = NewSigner("", "/does/not/exist", "authenvoy")
+	assert.Error(t, err, "key file that does not exist should error")
+}
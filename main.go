@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jcmturner/authenvoy/config"
@@ -14,37 +17,472 @@ import (
 
 const appTitle = "Authentication Envoy"
 
+// Exit status codes.
+const (
+	// exitOK is returned when the process stops after finishing all requests in progress.
+	exitOK = 0
+	// exitConfigError is returned when the process does not start as the configuration is invalid.
+	exitConfigError = 1
+	// exitServerError is returned when the server could not listen or stopped unexpectedly.
+	exitServerError = 2
+	// exitShutdownTimeout is returned when requests were still in progress at the end of the shutdown grace period.
+	exitShutdownTimeout = 3
+)
+
 var buildhash = "Not set"
 var buildtime = "Not set"
 
 func main() {
 	version := flag.Bool("version", false, "Print version information.")
-	logs := flag.String("log-dir", "./", "Directory to output logs to.")
+	flag.String(config.ConfigOption, "", "Path to a JSON configuration file of options keyed by option name.")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration, with the paths of keys redacted, and exit.")
+	logs := flag.String("log-dir", "./", "Directory to output logs to, stdout, stderr, null, a syslog URL such as syslog://unix/dev/log or syslog+tcp://host:514, or journald.")
+	syslogFacility := flag.String("syslog-facility", config.DefaultSyslogFacility, "Facility of the logs sent to syslog or journald.")
+	syslogAppName := flag.String("syslog-app-name", config.DefaultSyslogAppName, "App-name of the logs sent to syslog or journald.")
+	logBuffer := flag.Int("log-buffer", 1024, "Number of lines each log buffers to be written asynchronously. Zero writes synchronously.")
+	logMaxSize := flag.Int("log-max-size", 0, "Size in megabytes a log file can grow to before it is rotated. Zero disables.")
+	logMaxAge := flag.Duration("log-max-age", 0, "Period after which a log file is rotated. Zero disables.")
+	logKeep := flag.Int("log-keep", 0, "Number of rotated files of each log to keep. Zero keeps all of them.")
+	logCompress := flag.Bool("log-compress", false, "Compress rotated log files with gzip.")
+	logOverflow := flag.String("log-overflow", config.OverflowBlock, "Policy when a log buffer is full: block to wait for space or drop to discard and count the line.")
 	port := flag.Int("port", 8088, "Port to listen on loopback.")
+	socketPath := flag.String("socket", "", "Path of a Unix domain socket to listen on instead of the loopback port.")
+	socketOwner := flag.String("socket-owner", "", "User name or ID to own the socket. Defaults to the user authenvoy runs as.")
+	socketGroup := flag.String("socket-group", "", "Group name or ID of the socket. Defaults to the group authenvoy runs as.")
+	socketMode := flag.String("socket-mode", config.DefaultSocketMode, "File mode of the socket in octal.")
+	allowUIDs := flag.String("allow-uids", "", "Comma separated user names or IDs of the processes allowed to call over the socket.")
+	allowGIDs := flag.String("allow-gids", "", "Comma separated group names or IDs of the processes allowed to call over the socket, matched against their primary group.")
 	krbconf := flag.String("krb5-conf", "./krb5.conf", "Path to krb5.conf file.")
 	tls := flag.Bool("tls", false, "Enable TLS using self signed certificate.")
+	hideReason := flag.Bool("hide-failure-reason", false, "Do not return the reason for an authentication failure to the caller.")
+	kdcThreshold := flag.Int("kdc-failure-threshold", 5, "Consecutive KDC connection failures after which requests for the realm fail fast. Zero disables.")
+	kt := flag.String("keytab", "", "Path to a keytab file for the service principal.")
+	verifyKDC := flag.Bool("verify-kdc", false, "Verify the KDC using the keytab to protect against KDC spoofing.")
+	spn := flag.String("service-principal", "", "Service principal name in the keytab, for example HTTP/host.example.com.")
+	jwtEnable := flag.Bool("jwt", false, "Issue signed JWTs to valid and authorized users.")
+	jwtAlg := flag.String("jwt-alg", "", "JWT signing algorithm: RS256, ES256 or EdDSA. Defaults to ES256, or the type of the key file.")
+	jwtKey := flag.String("jwt-key", "", "Path to a PEM private key file to sign JWTs with. A key is generated if not provided.")
+	jwtIssuer := flag.String("jwt-issuer", "authenvoy", "Issuer claim of the JWTs.")
+	jwtRotation := flag.Duration("jwt-key-rotation", 24*time.Hour, "Period after which a generated JWT signing key is replaced. Zero disables.")
+	sessionIdle := flag.Duration("session-idle-timeout", 0, "Period after which a session that has not been looked up expires. Zero disables.")
+	sessionFile := flag.String("session-file", "", "Path to a file to persist sessions to across restarts.")
+	renewLifetime := flag.Duration("renew-lifetime", 0, "Period to request renewable tickets for so sessions can be renewed. Zero uses the krb5.conf renew_lifetime.")
+	rateUser := flag.Int("rate-limit-user", 0, "Authentication attempts per minute allowed for each login name. Zero disables.")
+	rateSource := flag.Int("rate-limit-source", 0, "Authentication attempts per minute allowed from each calling address. Zero disables.")
+	rateClientIP := flag.Int("rate-limit-client-ip", 0, "Authentication attempts per minute allowed for each end user IP provided by the caller. Zero disables.")
+	lockoutThreshold := flag.Int("lockout-threshold", 0, "Consecutive invalid credential failures after which attempts for a login name are not passed to the KDC. Zero disables.")
+	lockoutDuration := flag.Duration("lockout-duration", 30*time.Minute, "Period attempts for a login name are refused for after the lockout threshold is reached.")
+	negTTL := flag.Duration("negative-cache-ttl", 0, "Period a password rejected by the KDC is answered from the negative cache without contacting the KDC. Zero disables.")
+	negSize := flag.Int("negative-cache-size", 10000, "Maximum number of rejected passwords held in the negative cache.")
+	authTimeout := flag.Duration("auth-timeout", 30*time.Second, "Overall deadline for the KDC exchanges of a request. Zero disables.")
+	maxKDC := flag.Int("max-kdc-exchanges", 64, "Maximum number of requests exchanging with KDCs at once. Zero disables.")
+	kdcQueue := flag.Duration("kdc-queue-timeout", 5*time.Second, "Period a request waits for a KDC exchange to finish when at the maximum before being refused.")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "Period allowed to read request headers. Zero disables.")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Period allowed to read a request. Zero disables.")
+	writeTimeout := flag.Duration("write-timeout", 60*time.Second, "Period allowed to handle a request and write the response. Zero disables.")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "Period an idle keep-alive connection is kept open for. Zero disables.")
+	policy := flag.String("policy", "", "Path to a JSON file of authorization policies.")
+	groupMap := flag.String("group-map", "", "Path to a JSON file mapping group SIDs to names and roles.")
+	shutdownGrace := flag.Duration("shutdown-grace-period", 30*time.Second, "Period to wait on SIGTERM or SIGINT for requests in progress to finish before exiting.")
+	kdcCoolDown := flag.Duration("kdc-cooldown", 30*time.Second, "Period to fail fast for after the KDC failure threshold is reached.")
+	readyTTL := flag.Duration("readiness-cache-ttl", 30*time.Second, "Period the results of probing the KDCs are reused for by /readyz. Zero probes on every check.")
+	probeTimeout := flag.Duration("kdc-probe-timeout", 2*time.Second, "Period to wait for each KDC to answer a readiness probe.")
+	metricsEnable := flag.Bool("metrics", false, "Serve Prometheus metrics at /metrics.")
+	metricsPort := flag.Int("metrics-port", 0, "Port to serve metrics on loopback. Zero serves them on the API port.")
+	adminPort := flag.Int("admin-port", 0, "Port to serve the administration endpoints, such as the session listing, on loopback. Zero disables them.")
+	reloadInterval := flag.Duration("reload-interval", 0, "Period to check the krb5.conf and configuration file for changes and reload them. Zero disables.")
 	flag.Parse()
 
 	// Print version information and exit.
 	if *version {
 		fmt.Fprintf(os.Stderr, versionStr())
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
-	c, err := config.New(*port, *krbconf, *logs)
+	// Options not given as flags are taken from the environment and then the configuration file.
+	opts, err := config.LoadOptions(flag.CommandLine, "version", "print-config")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+	if *printConfig {
+		opts.Print(os.Stdout)
+		os.Exit(exitOK)
+	}
+
+	c, err := config.New(*port, *krbconf, *logs, *groupMap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+	// applyOptions sets the options that can be changed by reloading the configuration.
+	applyOptions := func(c *config.Config) {
+		c.HideFailureReason = *hideReason
+		c.KDCFailureThreshold = *kdcThreshold
+		c.KDCCoolDown = *kdcCoolDown
+		c.SessionIdleTimeout = *sessionIdle
+		c.RenewLifetime = *renewLifetime
+		c.RateLimitUser = *rateUser
+		c.RateLimitSource = *rateSource
+		c.RateLimitClientIP = *rateClientIP
+		c.LockoutThreshold = *lockoutThreshold
+		c.LockoutDuration = *lockoutDuration
+		c.NegativeCacheTTL = *negTTL
+		c.NegativeCacheSize = *negSize
+		c.AuthTimeout = *authTimeout
+		c.KDCQueueTimeout = *kdcQueue
+		c.ReadinessCacheTTL = *readyTTL
+		c.KDCProbeTimeout = *probeTimeout
+		c.ShutdownGracePeriod = *shutdownGrace
+	}
+	applyOptions(c)
+	c.SessionFile = *sessionFile
+	c.MaxKDCExchanges = *maxKDC
+	c.ReadHeaderTimeout = *readHeaderTimeout
+	c.ReadTimeout = *readTimeout
+	c.WriteTimeout = *writeTimeout
+	c.IdleTimeout = *idleTimeout
+	err = c.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+	err = c.SetSyslog(*syslogFacility, *syslogAppName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
-		os.Exit(1)
+		os.Exit(exitConfigError)
+	}
+	err = c.SetLogRotation(config.LogRotation{
+		MaxSize:  int64(*logMaxSize) * 1024 * 1024,
+		MaxAge:   *logMaxAge,
+		Keep:     *logKeep,
+		Compress: *logCompress,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+	if *logBuffer > 0 {
+		err = c.SetLogBuffer(*logBuffer, *logOverflow)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+			os.Exit(exitConfigError)
+		}
 	}
+	if *kt != "" {
+		err = c.SetServiceKeytab(*kt, *spn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+			os.Exit(exitConfigError)
+		}
+	}
+	if *policy != "" {
+		err = c.SetPolicies(*policy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+			os.Exit(exitConfigError)
+		}
+	}
+	if *jwtEnable {
+		err = c.SetJWTSigner(*jwtAlg, *jwtKey, *jwtIssuer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+			os.Exit(exitConfigError)
+		}
+		if *jwtKey == "" && *jwtRotation > 0 {
+			rotateJWTKey(c, *jwtRotation)
+		}
+	}
+	err = c.SetVerifyKDC(*verifyKDC)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+	if *socketPath != "" {
+		if *tls {
+			fmt.Fprintf(os.Stderr, "%s configuration error: tls: cannot be used with a socket", appTitle)
+			os.Exit(exitConfigError)
+		}
+		err = c.SetSocket(*socketPath, *socketOwner, *socketGroup, *socketMode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+			os.Exit(exitConfigError)
+		}
+	}
+	err = c.SetPeerAllowlist(*allowUIDs, *allowGIDs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s configuration error: %v", appTitle, err)
+		os.Exit(exitConfigError)
+	}
+
+	var servers []*http.Server
+	if *metricsEnable {
+		if *metricsPort < 0 || *metricsPort > 65535 || *metricsPort == c.Port {
+			fmt.Fprintf(os.Stderr, "%s configuration error: metrics-port: must be a port other than the API port", appTitle)
+			os.Exit(exitConfigError)
+		}
+		bh, bt := versionInfo()
+		c.EnableMetrics(bh, bt, *metricsPort)
+		if *metricsPort > 0 {
+			servers = append(servers, serveMetrics(c))
+		}
+	}
+
+	if *adminPort != 0 {
+		if *adminPort < 0 || *adminPort > 65535 || *adminPort == c.Port || *adminPort == c.MetricsPort {
+			fmt.Fprintf(os.Stderr, "%s configuration error: admin-port: must be a port other than the API and metrics ports", appTitle)
+			os.Exit(exitConfigError)
+		}
+		c.AdminPort = *adminPort
+	}
+	router := httphandling.NewRouter(c)
+	if c.AdminPort > 0 {
+		servers = append(servers, serveAdmin(c, router))
+	}
+
+	reloadOnHangup(c, opts, applyOptions, *jwtKey != "", *reloadInterval)
+	reopenLogsOnUSR1(c)
+
+	// Signals to stop are handled before serving so none are missed
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
 	socket := fmt.Sprintf("%s:%d", "127.0.0.1", c.Port)
+	if c.Socket != "" {
+		socket = c.Socket
+	}
 	c.ApplicationLogf(versionStr())
-	if *tls {
-		err = httphandling.ListenAndServeTLS(socket, httphandling.NewRouter(c))
+	srv := httphandling.NewServer(c, socket, router)
+	// The API server is shut down first so that metrics can be scraped while requests finish
+	servers = append([]*http.Server{srv}, servers...)
+	serveErr := make(chan error, 1)
+	go func() {
+		if c.Socket != "" {
+			ln, err := httphandling.ListenUnix(c)
+			if err != nil {
+				serveErr <- err
+				return
+			}
+			c.ApplicationLogf("listening on socket %s", c.Socket)
+			serveErr <- srv.Serve(ln)
+		} else if *tls {
+			serveErr <- httphandling.ServeTLS(srv)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err = <-serveErr:
+		c.ApplicationLogf("%s exit: %v", appTitle, err)
+		c.CloseLogs()
+		fmt.Fprintf(os.Stderr, "%s exit: %v\n", appTitle, err)
+		os.Exit(exitServerError)
+	case sig := <-stop:
+		os.Exit(shutdown(c, servers, sig, stop))
+	}
+}
+
+// shutdown stops the servers accepting connections and waits up to the shutdown grace period for requests in
+// progress, KDC exchanges that continued after their request ended and writes of the session file to finish. Another
+// signal ends the wait early. The logs are then flushed and closed and the exit status returned.
+func shutdown(c *config.Config, servers []*http.Server, sig os.Signal, stop <-chan os.Signal) int {
+	grace := c.Current().ShutdownGracePeriod
+	c.ApplicationLogf("%s received %v: shutting down, waiting up to %v for requests in progress", appTitle, sig, grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			c.ApplicationLogf("%s received %v: not waiting for requests in progress", appTitle, sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	status := exitOK
+	for _, srv := range servers {
+		err := httphandling.Shutdown(ctx, srv)
+		if err != nil {
+			c.ApplicationLogf("%s shutdown of %s: requests still in progress: %v", appTitle, srv.Addr, err)
+			srv.Close()
+			status = exitShutdownTimeout
+		}
+	}
+	c.ApplicationLogf("%s shutdown complete, exit status %d", appTitle, status)
+	c.CloseLogs()
+	return status
+}
+
+// reloadableOptions are the options whose changes take effect when the configuration is reloaded. Changes to other
+// options are only applied on restart.
+var reloadableOptions = map[string]bool{
+	"hide-failure-reason":   true,
+	"kdc-failure-threshold": true,
+	"kdc-cooldown":          true,
+	"session-idle-timeout":  true,
+	"renew-lifetime":        true,
+	"rate-limit-user":       true,
+	"rate-limit-source":     true,
+	"rate-limit-client-ip":  true,
+	"lockout-threshold":     true,
+	"lockout-duration":      true,
+	"negative-cache-ttl":    true,
+	"negative-cache-size":   true,
+	"auth-timeout":          true,
+	"kdc-queue-timeout":     true,
+	"readiness-cache-ttl":   true,
+	"kdc-probe-timeout":     true,
+	"shutdown-grace-period": true,
+	"group-map":             true,
+	"policy":                true,
+}
+
+// reloadOnHangup reloads the configuration when the process receives SIGHUP and, if an interval is given, when the
+// krb5.conf or configuration file changes.
+func reloadOnHangup(c *config.Config, opts *config.Options, apply func(*config.Config), jwtKeyFile bool, interval time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	if interval > 0 {
+		go watchFiles(c, opts, interval, sigs)
+	}
+	go func() {
+		for range sigs {
+			reload(c, opts, apply, jwtKeyFile)
+		}
+	}()
+}
+
+// reload replaces the configuration with one using the options, krb5.conf, group mapping and policy files loaded
+// again, from their new paths if these options changed, and reloads the JWT key file if used. Anything that cannot be loaded is kept as it was. Requests
+// in progress finish with the configuration they started with.
+func reload(c *config.Config, opts *config.Options, apply func(*config.Config), jwtKeyFile bool) {
+	next := *c.Current()
+	changes, err := opts.Reload(func() error {
+		apply(&next)
+		return next.Validate()
+	})
+	if err != nil {
+		c.ApplicationLogf("keeping existing options: %v", err)
+		next = *c.Current()
+	}
+	for _, ch := range changes {
+		if reloadableOptions[ch.Option] {
+			c.ApplicationLogf("option reloaded: %v", ch)
+		} else {
+			c.ApplicationLogf("option not reloaded, restart required: %v", ch)
+		}
+	}
+	kc, err := next.ReloadKRB5Conf()
+	if err != nil {
+		c.ApplicationLogf("keeping existing krb5.conf: %v", err)
+	} else if len(kc) == 0 {
+		c.ApplicationLogf("krb5.conf reloaded: no changes")
 	} else {
-		err = http.ListenAndServe(socket, httphandling.NewRouter(c))
+		c.ApplicationLogf("krb5.conf reloaded: %s", strings.Join(kc, "; "))
+	}
+	err = next.ReloadGroupMap(opts.Value("group-map"))
+	if err != nil {
+		c.ApplicationLogf("keeping existing group mapping: %v", err)
+	} else if next.GroupMap != nil {
+		c.ApplicationLogf("group mapping reloaded")
 	}
-	log.Fatalf("%s exit: %v\n", appTitle, err)
+	err = next.ReloadPolicies(opts.Value("policy"))
+	if err != nil {
+		c.ApplicationLogf("keeping existing authorization policies: %v", err)
+	} else if next.Policies != nil {
+		c.ApplicationLogf("authorization policies reloaded")
+	}
+	c.Replace(&next)
+	if c.JWTSigner != nil && jwtKeyFile {
+		err := c.JWTSigner.Rotate()
+		if err != nil {
+			c.ApplicationLogf("keeping existing JWT signing key: %v", err)
+		} else {
+			c.ApplicationLogf("JWT signing key reloaded")
+		}
+	}
+}
+
+// watchFiles checks the krb5.conf and configuration file for changes at the interval and triggers a reload when
+// either has been modified.
+func watchFiles(c *config.Config, opts *config.Options, interval time.Duration, reload chan<- os.Signal) {
+	last := fileVersions(c.KRB5ConfPath, opts.Value(config.ConfigOption))
+	for range time.Tick(interval) {
+		v := fileVersions(c.KRB5ConfPath, opts.Value(config.ConfigOption))
+		if v != last {
+			last = v
+			c.ApplicationLogf("configuration file change detected")
+			reload <- syscall.SIGHUP
+		}
+	}
+}
+
+// fileVersions returns a string identifying the modification time and size of each of the files.
+func fileVersions(paths ...string) string {
+	var v string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			v += fmt.Sprintf("%s:%d:%d;", p, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return v
+}
+
+// serveMetrics serves the metrics on their own loopback port and returns the server.
+func serveMetrics(c *config.Config) *http.Server {
+	srv := httphandling.NewServer(c, fmt.Sprintf("%s:%d", "127.0.0.1", c.MetricsPort), c.Metrics.Handler())
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			c.ApplicationLogf("metrics server exit: %v", err)
+		}
+	}()
+	return srv
+}
+
+// serveAdmin serves the administration routes of the router on their own loopback port and returns the server.
+func serveAdmin(c *config.Config, router http.Handler) *http.Server {
+	srv := httphandling.NewServer(c, fmt.Sprintf("%s:%d", "127.0.0.1", c.AdminPort), router)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			c.ApplicationLogf("admin server exit: %v", err)
+		}
+	}()
+	return srv
+}
+
+// reopenLogsOnUSR1 reopens the log files when the process receives SIGUSR1, so that an external log rotator can move
+// them and have authenvoy start new files.
+func reopenLogsOnUSR1(c *config.Config) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			err := c.ReopenLogs()
+			if err != nil {
+				c.ApplicationLogf("%v", err)
+				continue
+			}
+			c.ApplicationLogf("log files reopened")
+		}
+	}()
+}
+
+// rotateJWTKey replaces the generated JWT signing key periodically.
+func rotateJWTKey(c *config.Config, d time.Duration) {
+	go func() {
+		for range time.Tick(d) {
+			err := c.JWTSigner.Rotate()
+			if err != nil {
+				c.ApplicationLogf("could not rotate JWT signing key: %v", err)
+				continue
+			}
+			c.ApplicationLogf("JWT signing key rotated")
+		}
+	}()
 }
 
 // Version returns the version number, hash from git and the time of the build.